@@ -9,4 +9,5 @@ require (
 	github.com/epiclabs-io/ut v0.0.0-20210307214010-1babf69b092b
 	github.com/miekg/dns v1.1.40
 	github.com/tilinna/clock v1.1.0
+	golang.org/x/net v0.0.0-20201110031124-69a78807bb2b
 )
@@ -0,0 +1,71 @@
+package mdns
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RFC 6762, section 8.3: the Multicast DNS responder MUST send at least two
+// unsolicited responses, one second apart. Beacons go no faster than that.
+const minBeaconPeriod = time.Second
+
+// Beacon multicasts an address record for the given host name and address right
+// away and then every period, as measured on Clock, until the returned function
+// is called or the client is closed. It is a lightweight way to signal presence
+// for devices that need no service registration: the name is neither probed nor
+// defended, and queries for it are not answered. The record lives for at least
+// two minutes, or two periods if longer, so that it survives a lost beacon.
+// Periods below minBeaconPeriod, zero or negative ones included, are raised to
+// it. An invalid address starts no beacon, and is logged.
+func (c *Client) Beacon(name string, addr net.IP, period time.Duration) (stop func()) {
+	if addr.To16() == nil {
+		log.Printf("error: Invalid beacon address %q for %s", addr, name)
+		return func() {}
+	}
+	if period < minBeaconPeriod {
+		period = minBeaconPeriod
+	}
+	hdr := dns.RR_Header{Name: dns.Fqdn(name), Class: dns.ClassINET | cacheFlushBit, Ttl: hostTTL}
+	if ttl := uint32(2 * period / time.Second); ttl > hdr.Ttl {
+		hdr.Ttl = ttl
+	}
+	var rr dns.RR
+	if ip4 := addr.To4(); ip4 != nil {
+		hdr.Rrtype = dns.TypeA
+		rr = &dns.A{Hdr: hdr, A: ip4}
+	} else {
+		hdr.Rrtype = dns.TypeAAAA
+		rr = &dns.AAAA{Hdr: hdr, AAAA: addr}
+	}
+
+	stopped := make(chan struct{})
+	var once sync.Once
+	stop = func() { once.Do(func() { close(stopped) }) }
+
+	ticker := c.Clock.NewTicker(period)
+	if !c.background(func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopped:
+				return
+			default:
+			}
+			c.sendResponse([]dns.RR{dns.Copy(rr)}, nil, nil)
+			select {
+			case <-ticker.C:
+			case <-stopped:
+				return
+			case <-c.closedCh:
+				return
+			}
+		}
+	}) {
+		ticker.Stop()
+	}
+	return stop
+}
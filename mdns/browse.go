@@ -0,0 +1,347 @@
+package mdns
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ServiceEntry describes a service instance discovered on the network
+type ServiceEntry struct {
+	Instance   string   // Fully qualified instance name, e.g. My\ Printer._ipp._tcp.local.
+	Service    string   // Fully qualified service type name, e.g. _ipp._tcp.local.
+	Host       string   // Host name offering the service, as per the SRV record
+	Port       uint16   // Port the service listens on
+	Priority   uint16   // SRV priority
+	Weight     uint16   // SRV weight
+	Text       []string // TXT record strings
+	IPs        []net.IP // Addresses of Host
+	Incomplete bool     // Whether the instance could not be fully resolved within ResolveTimeout. Only the fields known so far are set
+}
+
+// Snapshot returns the service instances of the given service type that are
+// currently in cache and fully resolved, that is, with PTR, SRV, TXT and at
+// least one address record available. If ResolveTimeout is set, instances
+// still not fully resolved that long after their PTR record was cached are
+// included too, flagged as Incomplete. Entries are sorted by instance name,
+// or, if SortByPriority is set, by ascending SRV priority and then descending
+// weight, so that the preferred instances come first.
+func (c *Client) Snapshot(service string) []ServiceEntry {
+	service = strings.Trim(service, ".") + "."
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := c.Clock.Now()
+	var entries []ServiceEntry
+	for _, cached := range c.cache[cacheKey(service)] {
+		if cached.rr.Header().Rrtype != dns.TypePTR || cached.expired(now) {
+			continue
+		}
+		entry, ok := c.resolveEntry(service, cached.rr.(*dns.PTR).Ptr, now)
+		if !ok && c.ResolveTimeout > 0 && now.Sub(cached.cached) >= c.ResolveTimeout {
+			entry.Incomplete, ok = true, true
+		}
+		if ok {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := &entries[i], &entries[j]
+		if c.SortByPriority && a.Priority != b.Priority {
+			return a.Priority < b.Priority
+		}
+		if c.SortByPriority && a.Weight != b.Weight {
+			return a.Weight > b.Weight
+		}
+		return a.Instance < b.Instance
+	})
+	return entries
+}
+
+// WaitForCount browses for the given service type until at least n distinct
+// instances are fully resolved, as per Snapshot, and returns them. Returns the
+// context error if it is done before.
+func (c *Client) WaitForCount(ctx context.Context, service string, n int) ([]ServiceEntry, error) {
+	service = strings.Trim(service, ".") + "."
+	if entries := resolved(c.Snapshot(service)); len(entries) >= n {
+		return entries, nil
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(service, dns.TypePTR)
+	msg.Id = c.randomID()
+	msg.RecursionDesired = false
+	var entries []ServiceEntry
+	_, err := c.transmit(ctx, msg, c.multicast, func() []dns.RR {
+		if entries = resolved(c.Snapshot(service)); len(entries) >= n {
+			// no records to return, just signal we are done
+			return []dns.RR{}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Device groups the service instances a single host offers on the same port,
+// under different service types, e.g. a printer advertising both _ipp._tcp and
+// _printer._tcp
+type Device struct {
+	Host     string         // Host name, as per the SRV records
+	Port     uint16         // Port the services listen on
+	IPs      []net.IP       // Addresses of Host
+	Services []string       // Service types offered, sorted
+	Entries  []ServiceEntry // Service instances, in the order of Services
+}
+
+// BrowseSpec is a service type to browse on its own period, e.g. frequently for
+// volatile services and rarely for stable ones
+type BrowseSpec struct {
+	Service string        // Service type, e.g. "_ipp._tcp.local."
+	Period  time.Duration // How often scan the service. Zero uses BrowsePeriod
+}
+
+// SnapshotDevices returns the instances of the given service types currently
+// in cache, as per Snapshot, grouped by SRV target and port. If no service types
+// are given, the browsed ones are used.
+func (c *Client) SnapshotDevices(services ...string) []Device {
+	if len(services) == 0 {
+		services = c.ActiveBrowses()
+	}
+	var entries []ServiceEntry
+	for _, service := range services {
+		entries = append(entries, c.Snapshot(service)...)
+	}
+	return GroupByTarget(entries)
+}
+
+// GroupByTarget groups service entries of any service type by SRV target and
+// port, sorted by host name and then port. Entries whose SRV record is not
+// known yet cannot be grouped, so they are left out.
+func GroupByTarget(entries []ServiceEntry) []Device {
+	index := make(map[string]*Device)
+	var devices []*Device
+	for _, entry := range entries {
+		if entry.Host == "" {
+			continue
+		}
+		key := strings.ToLower(entry.Host) + " " + strconv.Itoa(int(entry.Port))
+		device := index[key]
+		if device == nil {
+			device = &Device{Host: entry.Host, Port: entry.Port}
+			index[key] = device
+			devices = append(devices, device)
+		}
+		device.Entries = append(device.Entries, entry)
+	next:
+		for _, ip := range entry.IPs {
+			for _, known := range device.IPs {
+				if known.Equal(ip) {
+					continue next
+				}
+			}
+			device.IPs = append(device.IPs, ip)
+		}
+	}
+
+	grouped := make([]Device, 0, len(devices))
+	for _, device := range devices {
+		sort.SliceStable(device.Entries, func(i, j int) bool {
+			return device.Entries[i].Service < device.Entries[j].Service
+		})
+		for _, entry := range device.Entries {
+			// the same service type may show up more than once, under different instance names
+			if n := len(device.Services); n == 0 || device.Services[n-1] != entry.Service {
+				device.Services = append(device.Services, entry.Service)
+			}
+		}
+		grouped = append(grouped, *device)
+	}
+	sort.Slice(grouped, func(i, j int) bool {
+		if a, b := strings.ToLower(grouped[i].Host), strings.ToLower(grouped[j].Host); a != b {
+			return a < b
+		}
+		return grouped[i].Port < grouped[j].Port
+	})
+	return grouped
+}
+
+// resolved returns the entries that are not flagged as Incomplete
+func resolved(entries []ServiceEntry) []ServiceEntry {
+	var complete []ServiceEntry
+	for _, entry := range entries {
+		if !entry.Incomplete {
+			complete = append(complete, entry)
+		}
+	}
+	return complete
+}
+
+// resolveEntry builds a ServiceEntry for the given instance off the cache.
+// Returns false if the instance cannot be fully resolved, along with the
+// fields that could be.
+func (c *Client) resolveEntry(service, instance string, now time.Time) (ServiceEntry, bool) {
+	entry := ServiceEntry{
+		Instance: instance,
+		Service:  service,
+	}
+
+	var srv *dns.SRV
+	for _, rr := range c.cachedRecords(instance, dns.TypeSRV, now) {
+		if s := rr.(*dns.SRV); srv == nil || s.Priority < srv.Priority ||
+			(s.Priority == srv.Priority && s.Weight > srv.Weight) {
+			srv = s
+		}
+	}
+	txt := c.cachedRecords(instance, dns.TypeTXT, now)
+	for _, rr := range txt {
+		entry.Text = append(entry.Text, rr.(*dns.TXT).Txt...)
+	}
+	if srv == nil {
+		return entry, false
+	}
+	entry.Host = srv.Target
+	entry.Port = srv.Port
+	entry.Priority = srv.Priority
+	entry.Weight = srv.Weight
+
+	_, target := c.resolveCname(srv.Target)
+	for _, rr := range c.cachedRecords(target, dns.TypeA, now) {
+		entry.IPs = append(entry.IPs, rr.(*dns.A).A)
+	}
+	for _, rr := range c.cachedRecords(target, dns.TypeAAAA, now) {
+		entry.IPs = append(entry.IPs, rr.(*dns.AAAA).AAAA)
+	}
+	sort.Slice(entry.IPs, func(i, j int) bool {
+		return bytes.Compare(entry.IPs[i].To16(), entry.IPs[j].To16()) < 0
+	})
+	sort.SliceStable(entry.IPs, func(i, j int) bool {
+		return c.AddressOrder.prefers(entry.IPs[i], entry.IPs[j])
+	})
+	return entry, len(txt) > 0 && len(entry.IPs) > 0
+}
+
+// cachedRecords returns the unexpired cached records of the given name and type
+func (c *Client) cachedRecords(name string, recordType uint16, now time.Time) []dns.RR {
+	var records []dns.RR
+	for _, entry := range c.cache[cacheKey(name)] {
+		if entry.rr.Header().Rrtype == recordType && !entry.expired(now) {
+			records = append(records, entry.rr)
+		}
+	}
+	return records
+}
+
+// DiffEntries compares two snapshots of service entries, as returned by Snapshot,
+// and returns the entries that were added, removed, or changed in the new one.
+func DiffEntries(old, new []ServiceEntry) (added, removed, changed []ServiceEntry) {
+	index := func(entries []ServiceEntry) map[string]*ServiceEntry {
+		m := make(map[string]*ServiceEntry, len(entries))
+		for i := range entries {
+			m[strings.ToLower(entries[i].Instance)] = &entries[i]
+		}
+		return m
+	}
+	oldIndex, newIndex := index(old), index(new)
+
+	for _, entry := range new {
+		prev := oldIndex[strings.ToLower(entry.Instance)]
+		if prev == nil {
+			added = append(added, entry)
+		} else if !reflect.DeepEqual(*prev, entry) {
+			changed = append(changed, entry)
+		}
+	}
+	for _, entry := range old {
+		if newIndex[strings.ToLower(entry.Instance)] == nil {
+			removed = append(removed, entry)
+		}
+	}
+	return added, removed, changed
+}
+
+// Rename pairs a service instance that went away with the one that replaced it
+type Rename struct {
+	Old ServiceEntry // Entry as it was before the rename
+	New ServiceEntry // Entry under its new instance name
+}
+
+// RFC 6762, section 9: a responder finding its name in use picks a new one, and
+// has to probe it for about a second before announcing it. Departures and
+// arrivals further apart than this are not taken for renames.
+const renameWindow = 5 * time.Second
+
+// RenamedFunc is called with a service instance that went away and the one
+// that took its place
+type RenamedFunc func(rename Rename)
+
+// renameCandidate is an instance that recently went away or showed up, waiting
+// for its counterpart to make a rename
+type renameCandidate struct {
+	entry ServiceEntry
+	gone  bool // whether the instance went away, rather than showed up
+	seen  time.Time
+}
+
+// detectRenames looks, if OnRenamed is set, among the PTR records received in a
+// batch for instances that went away, with a goodbye, or showed up, and calls
+// OnRenamed for those that, within renameWindow, took the place of another
+// instance of the same service on the same host and port, as responders do
+// after a name conflict. The detection is a heuristic, and relies on the SRV
+// record of either instance being in cache, as responders send it along.
+func (c *Client) detectRenames(batch CacheBatchEvent) {
+	if c.OnRenamed == nil {
+		return
+	}
+	var renames []Rename
+
+	c.lock.Lock()
+	now := c.Clock.Now()
+	for key, candidate := range c.renames {
+		if now.Sub(candidate.seen) > renameWindow {
+			delete(c.renames, key)
+		}
+	}
+	note := func(rr dns.RR, gone bool) {
+		ptr, ok := rr.(*dns.PTR)
+		if !ok {
+			return
+		}
+		entry, _ := c.resolveEntry(ptr.Hdr.Name, ptr.Ptr, now)
+		if entry.Host == "" {
+			return
+		}
+		key := strings.ToLower(entry.Service) + " " + strings.ToLower(entry.Host) + " " + strconv.Itoa(int(entry.Port))
+		if other, ok := c.renames[key]; ok && other.gone != gone && !strings.EqualFold(other.entry.Instance, entry.Instance) {
+			delete(c.renames, key)
+			if gone {
+				renames = append(renames, Rename{Old: entry, New: other.entry})
+			} else {
+				renames = append(renames, Rename{Old: other.entry, New: entry})
+			}
+			return
+		}
+		c.renames[key] = renameCandidate{entry: entry, gone: gone, seen: now}
+	}
+	for _, rr := range batch.Expiring {
+		note(rr, true)
+	}
+	for _, rr := range batch.Added {
+		note(rr, false)
+	}
+	c.lock.Unlock()
+
+	for _, rename := range renames {
+		c.OnRenamed(rename)
+	}
+}
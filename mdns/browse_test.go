@@ -0,0 +1,294 @@
+package mdns
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/epiclabs-io/ut"
+	"github.com/miekg/dns"
+	"github.com/tilinna/clock"
+)
+
+func TestSnapshot(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+		MinTTL:    50,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	// prefill the cache with the zone content
+	c.addToCache(parseRecords(t, zone))
+
+	snapshot1 := c.Snapshot("_service1._tcp.local")
+	t.EqualsFile("snapshot1.json", snapshot1)
+
+	// a new instance appears and another one changes its text
+	c.addToCache(parseRecords(t, `
+	_service1._tcp.local.		200	IN	PTR		new._service1._tcp.local.
+	new._service1._tcp.local.	230	IN	SRV		1 2 7979 myserver.epiclabs.io.
+	new._service1._tcp.local.	230	IN	TXT		"new text"
+	epic._service1._tcp.local.	240	IN	TXT		"other text"
+	`))
+	snapshot2 := c.Snapshot("_service1._tcp.local.")
+	added, removed, changed := DiffEntries(snapshot1, snapshot2)
+	t.Equals(0, len(removed))
+	t.EqualsFile("added.json", added)
+	t.EqualsFile("changed.json", changed)
+
+	// elapse time so the demo instance, with the shortest TTLs, goes away
+	clk.Add(105 * time.Second)
+	snapshot3 := c.Snapshot("_service1._tcp.local.")
+	added, removed, changed = DiffEntries(snapshot2, snapshot3)
+	t.Equals(0, len(added))
+	t.Equals(0, len(changed))
+	t.EqualsFile("removed.json", removed)
+}
+
+func TestOnRenamed(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	var renames []Rename
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+		MinTTL:    50,
+		OnRenamed: func(rename Rename) {
+			renames = append(renames, rename)
+		},
+	})
+	t.Ok(err)
+	defer c.Close()
+	c.addToCache(parseRecords(t, zone))
+
+	response := func(zone string) *Packet {
+		msg := new(dns.Msg)
+		msg.Response = true
+		msg.Answer = parseRecords(t, zone)
+		return &Packet{Msg: msg}
+	}
+
+	// epic says goodbye and comes back under a new name after a conflict,
+	// while an unrelated instance shows up on another port
+	mt.in <- response(`
+	_service1._tcp.local.			0	IN	PTR		epic._service1._tcp.local.
+	epic._service1._tcp.local.		0	IN	SRV		1 2 7979 praetor.epiclabs.io.
+	`)
+	mt.in <- &Packet{Msg: new(dns.Msg)}
+	clk.Add(time.Second)
+	mt.in <- response(`
+	_service1._tcp.local.			200	IN	PTR		epic-2._service1._tcp.local.
+	epic-2._service1._tcp.local.	230	IN	SRV		1 2 7979 praetor.epiclabs.io.
+	epic-2._service1._tcp.local.	230	IN	TXT		"some text"
+	_service1._tcp.local.			200	IN	PTR		other._service1._tcp.local.
+	other._service1._tcp.local.		230	IN	SRV		0 0 9090 praetor.epiclabs.io.
+	`)
+	mt.in <- &Packet{Msg: new(dns.Msg)}
+	t.Equals(1, len(renames))
+	t.Equals("epic._service1._tcp.local.", renames[0].Old.Instance)
+	t.Equals("epic-2._service1._tcp.local.", renames[0].New.Instance)
+	t.Equals("some text", renames[0].New.Text[0])
+
+	// instances showing up long after another went away are not renames
+	mt.in <- response(`
+	_service1._tcp.local.			0	IN	PTR		demo._service1._tcp.local.
+	`)
+	mt.in <- &Packet{Msg: new(dns.Msg)}
+	clk.Add(renameWindow + time.Second)
+	mt.in <- response(`
+	_service1._tcp.local.			200	IN	PTR		demo-2._service1._tcp.local.
+	demo-2._service1._tcp.local.	230	IN	SRV		5 6 8080 terminus.epiclabs.io.
+	`)
+	mt.in <- &Packet{Msg: new(dns.Msg)}
+	t.Equals(1, len(renames))
+}
+
+func TestSnapshotDevices(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:          clk,
+		Transport:      mt,
+		MinTTL:         50,
+		BrowseServices: []string{"_service1._tcp.local.", "_service2._tcp.local."},
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	// praetor also offers epic under another service type, on the same port
+	c.addToCache(parseRecords(t, zone))
+	c.addToCache(parseRecords(t, `
+	_service2._tcp.local.			200	IN	PTR		epic._service2._tcp.local.
+	epic._service2._tcp.local.		230	IN	SRV		1 2 7979 praetor.epiclabs.io.
+	epic._service2._tcp.local.		240	IN	TXT		"other text"
+	`))
+
+	devices := c.SnapshotDevices()
+	t.Equals(2, len(devices))
+	t.Equals([]string{"_service1._tcp.local.", "_service2._tcp.local."}, devices[0].Services)
+	t.Equals([]string{"_service1._tcp.local."}, devices[1].Services)
+	t.EqualsFile("devices.json", devices)
+}
+
+func TestSortByPriority(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:          clk,
+		Transport:      mt,
+		MinTTL:         50,
+		SortByPriority: true,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	c.addToCache(parseRecords(t, zone))
+	c.addToCache(parseRecords(t, `
+	_service1._tcp.local.		200	IN	PTR		backup._service1._tcp.local.
+	_service1._tcp.local.		200	IN	PTR		heavy._service1._tcp.local.
+	backup._service1._tcp.local.	230	IN	SRV		9 0 7979 praetor.epiclabs.io.
+	backup._service1._tcp.local.	230	IN	TXT		"backup"
+	heavy._service1._tcp.local.	230	IN	SRV		1 8 7979 praetor.epiclabs.io.
+	heavy._service1._tcp.local.	230	IN	TXT		"heavy"
+	`))
+
+	// lowest priority first, highest weight first among equal priorities
+	var instances []string
+	for _, entry := range c.Snapshot("_service1._tcp.local.") {
+		instances = append(instances, entry.Instance)
+	}
+	t.Equals([]string{
+		"heavy._service1._tcp.local.",
+		"epic._service1._tcp.local.",
+		"demo._service1._tcp.local.",
+		"backup._service1._tcp.local.",
+	}, instances)
+}
+
+func TestResolveTimeout(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:          clk,
+		Transport:      mt,
+		ResolveTimeout: 10 * time.Second,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	// one instance is only known by its PTR, the other one lacks an address
+	c.addToCache(parseRecords(t, `
+	_ipp._tcp.local.		4500	IN	PTR		printer._ipp._tcp.local.
+	_ipp._tcp.local.		4500	IN	PTR		scanner._ipp._tcp.local.
+	scanner._ipp._tcp.local.	120	IN	SRV		0 0 631 scanner.local.
+	scanner._ipp._tcp.local.	4500	IN	TXT		"rp=scan"
+	`))
+	t.Equals(0, len(c.Snapshot("_ipp._tcp.local.")))
+
+	// refreshing the PTR records does not restart the timeout
+	clk.Add(5 * time.Second)
+	c.addToCache(parseRecords(t, `
+	_ipp._tcp.local.		4500	IN	PTR		printer._ipp._tcp.local.
+	_ipp._tcp.local.		4500	IN	PTR		scanner._ipp._tcp.local.
+	`))
+	t.Equals(0, len(c.Snapshot("_ipp._tcp.local.")))
+
+	// once the timeout elapses, they show up as incomplete with what is known
+	clk.Add(5 * time.Second)
+	entries := c.Snapshot("_ipp._tcp.local.")
+	t.Equals(2, len(entries))
+	t.Equals(ServiceEntry{
+		Instance:   "printer._ipp._tcp.local.",
+		Service:    "_ipp._tcp.local.",
+		Incomplete: true,
+	}, entries[0])
+	t.Equals(ServiceEntry{
+		Instance:   "scanner._ipp._tcp.local.",
+		Service:    "_ipp._tcp.local.",
+		Host:       "scanner.local.",
+		Port:       631,
+		Text:       []string{"rp=scan"},
+		Incomplete: true,
+	}, entries[1])
+
+	// and become complete when the missing records arrive
+	c.addToCache(parseRecords(t, `
+	scanner.local.	120	IN	A	10.0.0.9
+	`))
+	entries = c.Snapshot("_ipp._tcp.local.")
+	t.Equals(false, entries[1].Incomplete)
+}
+
+func TestWaitForCount(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+		MinTTL:    50,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	// two instances are already known
+	c.addToCache(parseRecords(t, zone))
+	entries, err := c.WaitForCount(context.Background(), "_service1._tcp.local", 2)
+	t.Ok(err)
+	t.Equals(2, len(entries))
+
+	// a third one must be browsed for
+	var waitErr error
+	done := make(chan struct{})
+	go func() {
+		entries, waitErr = c.WaitForCount(context.Background(), "_service1._tcp.local", 3)
+		close(done)
+	}()
+	equalsMessage(t, "question.txt", <-mt.out)
+
+	// a partially resolved instance does not count
+	response := new(dns.Msg)
+	response.Response = true
+	response.Answer = parseRecords(t, `
+	_service1._tcp.local.		200	IN	PTR		new._service1._tcp.local.
+	new._service1._tcp.local.	230	IN	SRV		1 2 7979 myserver.epiclabs.io.
+	`)
+	mt.in <- &Packet{Msg: response}
+
+	response = new(dns.Msg)
+	response.Response = true
+	response.Answer = parseRecords(t, `
+	new._service1._tcp.local.	230	IN	TXT		"new text"
+	`)
+	mt.in <- &Packet{Msg: response}
+	<-done
+	t.Ok(waitErr)
+	t.EqualsFile("entries.json", entries)
+}
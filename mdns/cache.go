@@ -1,23 +1,88 @@
 package mdns
 
 import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
+// RFC 6762, section 10.1.  Goodbye Packets
+//
+// Queriers receiving a Multicast DNS response with a TTL of zero SHOULD NOT
+// immediately delete the record from the cache, but instead record a TTL of 1
+// and then delete the record one second later.  In the case of multiple
+// Multicast DNS responders on the network described in Section 6.6 above, if
+// one of the responders shuts down and incorrectly sends goodbye packets for
+// its records, it gives the other cooperating responders one second to send
+// out their own response to "rescue" the records before they expire and are
+// deleted.
+const goodbyeDelay = time.Second
+
 // cacheEntry keeps track of a dns record in cache
 type cacheEntry struct {
-	expires time.Time
-	rr      dns.RR
+	expires   time.Time
+	lifetime  time.Duration // how long the entry was meant to live when cached
+	received  time.Time     // last time the record was seen on the network
+	cached    time.Time     // first time the record was cached, kept across refreshes
+	ifaces    []string      // network interfaces the record was seen on
+	src       net.Addr      // address the record was last received from. Nil if unknown
+	transient bool          // whether the record type is in IgnoreCacheTypes, so it is only kept while queries ask for it
+	rr        dns.RR
+}
+
+// remaining returns how long the entry has left to live. The system clock carries
+// a monotonic reading that makes this immune to wall clock adjustments, but other
+// clocks may jump, so the result is clamped between zero and the entry lifetime,
+// which otherwise would balloon when the clock is set backwards.
+func (e *cacheEntry) remaining(now time.Time) time.Duration {
+	remaining := e.expires.Sub(now)
+	if remaining > e.lifetime {
+		return e.lifetime
+	}
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// expired returns whether the entry is past its lifetime
+func (e *cacheEntry) expired(now time.Time) bool {
+	return e.remaining(now) == 0
 }
 
 // ttl computes back the TTL based on what time it is now
 func (e *cacheEntry) ttl(now time.Time) uint32 {
-	if ttl := e.expires.Sub(now).Seconds(); ttl > 0 {
-		return uint32(ttl)
+	return uint32(e.remaining(now).Seconds())
+}
+
+// addInterface records that the entry was seen on the given network interface
+func (e *cacheEntry) addInterface(iface string) {
+	if iface != "" && !e.seenOn(iface) {
+		e.ifaces = append(e.ifaces, iface)
+	}
+}
+
+// seenOn returns whether the entry was seen on the given network interface
+func (e *cacheEntry) seenOn(iface string) bool {
+	for _, i := range e.ifaces {
+		if i == iface {
+			return true
+		}
 	}
-	return 0
+	return false
+}
+
+// cacheKey returns the key a name is cached under. DNS names are
+// case-insensitive, so the cache is too. Names are made fully qualified,
+// so that e.g. SRV targets without a trailing dot match cached addresses.
+func cacheKey(name string) string {
+	return strings.ToLower(dns.Fqdn(name))
 }
 
 // cname casts the record to a CNAME struct
@@ -31,22 +96,100 @@ func (c *Client) newCacheEntry(rr dns.RR, now time.Time) *cacheEntry {
 	if ttl < c.MinTTL {
 		ttl = c.MinTTL
 	}
+	lifetime := time.Second * time.Duration(ttl)
 	return &cacheEntry{
-		expires: now.Add(time.Second * time.Duration(ttl)),
-		rr:      rr,
+		expires:   now.Add(lifetime),
+		lifetime:  lifetime,
+		received:  now,
+		cached:    now,
+		transient: containsType(c.IgnoreCacheTypes, rr.Header().Rrtype),
+		rr:        rr,
+	}
+}
+
+// asked returns whether any query in progress asks for the given record,
+// directly or through the cnames cached for the name asked for. Must be
+// called with the lock held.
+func (c *Client) asked(rr dns.RR) bool {
+	name := cacheKey(rr.Header().Name)
+	for _, questions := range c.queries {
+		for _, q := range questions {
+			if !matchesType(rr, q.Qtype) {
+				continue
+			}
+			if _, target := c.resolveCname(q.Name); cacheKey(q.Name) == name || cacheKey(target) == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dropTransient evicts the records of ignored types answering the given
+// questions that no other query in progress asks for. Must be called with
+// the lock held.
+func (c *Client) dropTransient(questions []dns.Question) {
+	for _, q := range questions {
+		_, target := c.resolveCname(q.Name)
+		for _, name := range []string{cacheKey(q.Name), cacheKey(target)} {
+			if entry := c.cnames[name]; entry != nil && entry.transient && !c.asked(entry.rr) {
+				delete(c.cnames, name)
+				count(&c.metrics.Evictions, 1)
+			}
+			var kept []*cacheEntry
+			for _, entry := range c.cache[name] {
+				if !entry.transient || !matchesType(entry.rr, q.Qtype) || c.asked(entry.rr) {
+					kept = append(kept, entry)
+				}
+			}
+			count(&c.metrics.Evictions, len(c.cache[name])-len(kept))
+			if len(kept) == 0 {
+				delete(c.cache, name)
+			} else {
+				c.cache[name] = kept
+			}
+		}
 	}
 }
 
-// purgeCache evicts expired records off the cache
+// purgeCache evicts expired records off the cache. The expiry time of the
+// remaining records is recomputed, in case the clock was set backwards.
+// Expired records that are pinned stay, and are asked for again instead.
 func (c *Client) purgeCache() {
+	for _, question := range c.purge() {
+		msg := new(dns.Msg)
+		msg.Id = c.randomID()
+		msg.RecursionDesired = false
+		msg.Question = []dns.Question{question}
+		c.revalidate(msg, msg.Question)
+	}
+}
+
+// purge does the work of purgeCache with the lock held, returning the
+// questions that refresh the pinned records that expired
+func (c *Client) purge() []dns.Question {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
+	refresh := make(map[string]dns.Question)
+	keep := func(name string, entry *cacheEntry, now time.Time) bool {
+		if !entry.expired(now) {
+			return true
+		}
+		rrtype := entry.rr.Header().Rrtype
+		if !c.pinned(pinKey(name, rrtype)) {
+			return false
+		}
+		refresh[pinKey(name, rrtype)] = dns.Question{Name: entry.rr.Header().Name, Qtype: rrtype, Qclass: dns.ClassINET}
+		return true
+	}
+
 	now := c.Clock.Now()
 	for domain, entries := range c.cache {
 		var newEntries []*cacheEntry
 		for _, entry := range entries {
-			if entry.expires.After(now) {
+			if keep(domain, entry, now) {
+				entry.expires = now.Add(entry.remaining(now))
 				newEntries = append(newEntries, entry)
 			}
 		}
@@ -57,8 +200,148 @@ func (c *Client) purgeCache() {
 		}
 	}
 	for domain, entry := range c.cnames {
-		if entry.expires.After(now) {
+		if !keep(domain, entry, now) {
 			delete(c.cnames, domain)
+		} else {
+			entry.expires = now.Add(entry.remaining(now))
+		}
+	}
+	if c.CacheTargetSize > 0 {
+		c.evictToSize(c.CacheTargetSize, now)
+	}
+
+	questions := make([]dns.Question, 0, len(refresh))
+	for _, question := range refresh {
+		questions = append(questions, question)
+	}
+	return questions
+}
+
+// pinKey returns the key pinned records of the given name and type are tracked by
+func pinKey(name string, qtype uint16) string {
+	return questionsKey([]dns.Question{{Name: name, Qtype: qtype}})
+}
+
+// Pin keeps the cached records of the given name and type from being purged or
+// evicted. Once they expire, they are asked for again when the cache is purged,
+// every CachePurgePeriod, and left in cache, though not served, until then.
+func (c *Client) Pin(name string, qtype uint16) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.pins[pinKey(name, qtype)] = true
+}
+
+// Unpin undoes Pin, letting the records of the given name and type be purged
+// and evicted as usual
+func (c *Client) Unpin(name string, qtype uint16) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.pins, pinKey(name, qtype))
+}
+
+// hold pins the records of the given pin keys on behalf of an InstanceHandle.
+// Unlike Pin, holds are counted, so that handles watching the same records do
+// not release each other's pins.
+func (c *Client) hold(keys ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, key := range keys {
+		c.holds[key]++
+	}
+}
+
+// release undoes hold
+func (c *Client) release(keys ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, key := range keys {
+		if c.holds[key]--; c.holds[key] <= 0 {
+			delete(c.holds, key)
+		}
+	}
+}
+
+// pinned returns whether the records of the given pin key are pinned, either
+// with Pin or by an InstanceHandle. Must be called with the lock held.
+func (c *Client) pinned(key string) bool {
+	return c.pins[key] || c.holds[key] > 0
+}
+
+// evictToSize evicts records in ascending order of remaining TTL until the cache
+// holds at most size records. Records answering questions being asked or service
+// types being browsed are evicted last, and pinned ones never. Must be called
+// with the lock held.
+func (c *Client) evictToSize(size int, now time.Time) {
+	type candidate struct {
+		key    string
+		entry  *cacheEntry
+		active bool
+	}
+	var candidates []candidate
+	kept := 0
+	add := func(key string, entry *cacheEntry) {
+		if c.pinned(pinKey(key, entry.rr.Header().Rrtype)) {
+			kept++
+			return
+		}
+		candidates = append(candidates, candidate{key: key, entry: entry})
+	}
+	for key, entries := range c.cache {
+		for _, entry := range entries {
+			add(key, entry)
+		}
+	}
+	for key, entry := range c.cnames {
+		add(key, entry)
+	}
+	if kept+len(candidates) <= size {
+		return
+	}
+
+	active := make(map[string]bool)
+	for _, questions := range c.queries {
+		for _, q := range questions {
+			active[cacheKey(q.Name)] = true
+		}
+	}
+	for _, service := range c.ActiveBrowses() {
+		active[cacheKey(service)] = true
+	}
+	for i := range candidates {
+		candidates[i].active = active[candidates[i].key]
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].active != candidates[j].active {
+			return !candidates[i].active
+		}
+		return candidates[i].entry.remaining(now) < candidates[j].entry.remaining(now)
+	})
+
+	excess := kept + len(candidates) - size
+	if excess > len(candidates) {
+		excess = len(candidates)
+	}
+	evicted := make(map[*cacheEntry]bool)
+	for _, candidate := range candidates[:excess] {
+		evicted[candidate.entry] = true
+	}
+	count(&c.metrics.Evictions, excess)
+	for key, entries := range c.cache {
+		var kept []*cacheEntry
+		for _, entry := range entries {
+			if !evicted[entry] {
+				kept = append(kept, entry)
+			}
+		}
+		if len(kept) > 0 {
+			c.cache[key] = kept
+		} else {
+			delete(c.cache, key)
+		}
+	}
+	for key, entry := range c.cnames {
+		if evicted[entry] {
+			delete(c.cnames, key)
 		}
 	}
 }
@@ -66,27 +349,228 @@ func (c *Client) purgeCache() {
 // addToCache adds the list of records to the cache
 // updating existing items if necessary
 func (c *Client) addToCache(records []dns.RR) {
+	c.addToCacheFrom(records, nil, "")
+}
+
+// CacheBatchEvent describes all the cache changes a single received message caused
+type CacheBatchEvent struct {
+	Added     []dns.RR // Records that were not in cache before
+	Refreshed []dns.RR // Records already in cache, received again
+	Expiring  []dns.RR // Records received with a TTL of zero, which leave the cache in a second
+	Src       net.Addr // Address the message was sent from
+	Interface string   // Network interface the message arrived on. Empty if unknown
+}
+
+// BatchFunc is called with the cache changes caused by a received message
+type BatchFunc func(event CacheBatchEvent)
+
+// empty returns whether the batch holds no changes at all
+func (e *CacheBatchEvent) empty() bool {
+	return len(e.Added) == 0 && len(e.Refreshed) == 0 && len(e.Expiring) == 0
+}
+
+// addToCacheFrom adds the list of records received from the given source and
+// network interface to the cache, updating existing items if necessary.
+// Returns the changes made.
+func (c *Client) addToCacheFrom(records []dns.RR, src net.Addr, iface string) CacheBatchEvent {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
 	now := c.Clock.Now()
+	batch := CacheBatchEvent{Src: src, Interface: iface}
 
 process_replies:
 	for _, record := range records {
-		name := record.Header().Name
+		name := cacheKey(record.Header().Name)
+		if c.RejectTTLAbove > 0 && record.Header().Ttl > c.RejectTTLAbove {
+			// likely meant to keep a poisoned record in cache for good
+			log.Printf("mdns: rejecting record with suspicious TTL from %v: %s", src, record)
+			continue
+		}
+		if record.Header().Ttl == 0 {
+			c.expireSoon(name, record, now)
+			c.lastChange = now
+			batch.Expiring = append(batch.Expiring, dns.Copy(record))
+			continue
+		}
+		if containsType(c.IgnoreCacheTypes, record.Header().Rrtype) && !c.asked(record) {
+			continue
+		}
 		if record.Header().Rrtype == dns.TypeCNAME {
-			c.cnames[name] = c.newCacheEntry(record.(*dns.CNAME), now)
+			entry := c.newCacheEntry(record.(*dns.CNAME), now)
+			entry.src = src
+			if prev := c.cnames[name]; prev != nil && dns.IsDuplicate(prev.rr, record) {
+				entry.ifaces = prev.ifaces
+				entry.cached = prev.cached
+				batch.Refreshed = append(batch.Refreshed, dns.Copy(record))
+			} else {
+				c.lastChange = now
+				batch.Added = append(batch.Added, dns.Copy(record))
+			}
+			entry.addInterface(iface)
+			c.cnames[name] = entry
 		} else {
 			entries := c.cache[name]
 			for i, entry := range entries {
 				if dns.IsDuplicate(entry.rr, record) {
 					if record.Header().Ttl > entry.ttl(now) {
 						entries[i] = c.newCacheEntry(record, now)
+						entries[i].ifaces = entry.ifaces
+						entries[i].cached = entry.cached
+					} else {
+						entry.received = now
 					}
+					entries[i].src = src
+					entries[i].addInterface(iface)
+					batch.Refreshed = append(batch.Refreshed, dns.Copy(record))
 					continue process_replies
 				}
 			}
-			c.cache[name] = append(entries, c.newCacheEntry(record, now))
+			entry := c.newCacheEntry(record, now)
+			entry.src = src
+			entry.addInterface(iface)
+			c.cache[name] = append(entries, entry)
+			c.lastChange = now
+			batch.Added = append(batch.Added, dns.Copy(record))
+		}
+	}
+	return batch
+}
+
+// WaitQuiescent returns once no new records, nor goodbyes, have arrived to the
+// cache for the given duration, as measured on Clock, so that discovery has
+// likely converged. Refreshes of records already in cache do not count as
+// changes. Returns the context error if it is done first.
+func (c *Client) WaitQuiescent(ctx context.Context, quiet time.Duration) error {
+	timer := c.Clock.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-c.closedCh:
+			return errClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		c.lock.RLock()
+		since := c.Clock.Now().Sub(c.lastChange)
+		c.lock.RUnlock()
+		if since >= quiet {
+			return nil
+		}
+		timer.Reset(quiet - since)
+	}
+}
+
+// RecordTTL returns the remaining time to live of the cached record of the
+// given name, type and data, in presentation format, e.g. "10.10.10.10" for an
+// A record or "0 0 80 myhost.local." for a SRV record. Returns false if the
+// record is not in cache.
+func (c *Client) RecordTTL(name string, qtype uint16, rdata string) (time.Duration, bool) {
+	name = cacheKey(dns.Fqdn(name))
+	rdata = strings.Join(strings.Fields(rdata), " ")
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	entries := c.cache[name]
+	if entry := c.cnames[name]; qtype == dns.TypeCNAME && entry != nil {
+		entries = []*cacheEntry{entry}
+	}
+	now := c.Clock.Now()
+	for _, entry := range entries {
+		if entry.rr.Header().Rrtype != qtype || entry.expired(now) {
+			continue
+		}
+		data := strings.TrimPrefix(entry.rr.String(), entry.rr.Header().String())
+		if strings.Join(strings.Fields(data), " ") == rdata {
+			return entry.remaining(now), true
+		}
+	}
+	return 0, false
+}
+
+// Range calls f with a copy of every record in cache, along with its remaining
+// time to live and the address it was last received from, nil if unknown, until
+// f returns false. The cache is locked for the duration, so f must not call back
+// into the client. Records are visited in no particular order.
+func (c *Client) Range(f func(rr dns.RR, remainingTTL time.Duration, src net.Addr) bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	now := c.Clock.Now()
+	visit := func(entry *cacheEntry) bool {
+		if entry.expired(now) {
+			return true
+		}
+		rr := dns.Copy(entry.rr)
+		rr.Header().Ttl = entry.ttl(now)
+		return f(rr, entry.remaining(now), entry.src)
+	}
+	for _, entries := range c.cache {
+		for _, entry := range entries {
+			if !visit(entry) {
+				return
+			}
+		}
+	}
+	for _, entry := range c.cnames {
+		if !visit(entry) {
+			return
+		}
+	}
+}
+
+// flushGrace is how long records must have been in cache for a record with the
+// cache-flush bit to flush them, and how long they are kept until then.
+//
+// RFC 6762, section 10.2: a record received with the cache-flush bit set tells
+// that the responder sends the whole set of records of that name, rrtype and
+// rrclass, so any other ones in cache are out of date. Since a large set may
+// be split across several packets sent close together, only the records
+// received more than one second earlier are flushed, and rather than being
+// deleted right away, they are set to expire one second later.
+const flushGrace = time.Second
+
+// flushStale flushes the cached records made out of date by the given ones
+// that had the cache-flush bit, as per the flush set, once they are cached
+func (c *Client) flushStale(records []dns.RR, flush map[dns.RR]bool) {
+	if len(flush) == 0 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := c.Clock.Now()
+	for _, record := range records {
+		hdr := record.Header()
+		if !flush[record] || hdr.Ttl == 0 || (c.RejectTTLAbove > 0 && hdr.Ttl > c.RejectTTLAbove) {
+			continue
+		}
+		for _, entry := range c.cache[cacheKey(hdr.Name)] {
+			other := entry.rr.Header()
+			if other.Rrtype != hdr.Rrtype || other.Class != hdr.Class || now.Sub(entry.received) <= flushGrace {
+				continue
+			}
+			if entry.remaining(now) > flushGrace {
+				entry.expires = now.Add(flushGrace)
+				count(&c.metrics.Flushes, 1)
+			}
+		}
+	}
+}
+
+// expireSoon makes the cached copy of a record received with a TTL of zero
+// expire after goodbyeDelay. Must be called with the lock held.
+func (c *Client) expireSoon(name string, record dns.RR, now time.Time) {
+	var entries []*cacheEntry
+	if entry := c.cnames[name]; entry != nil {
+		entries = append(entries, entry)
+	}
+	for _, entry := range append(entries, c.cache[name]...) {
+		if dns.IsDuplicate(entry.rr, record) && entry.remaining(now) > goodbyeDelay {
+			entry.expires = now.Add(goodbyeDelay)
 		}
 	}
 }
@@ -96,7 +580,7 @@ func (c *Client) resolveCname(target string) ([]dns.RR, string) {
 	var chain []dns.RR
 	now := c.Clock.Now()
 	for {
-		entry := c.cnames[target]
+		entry := c.cnames[cacheKey(target)]
 		if entry == nil {
 			return chain, target
 		}
@@ -106,18 +590,97 @@ func (c *Client) resolveCname(target string) ([]dns.RR, string) {
 	}
 }
 
+// receivedSince checks whether records answering a single question, following
+// cnames if necessary, have been seen on the network at or after the given time
+func (c *Client) receivedSince(domain string, recordType uint16, since time.Time) bool {
+	if entry := c.cnames[cacheKey(domain)]; recordType == dns.TypeCNAME || (c.NoFollowCNAME && entry != nil) {
+		return entry != nil && !entry.received.Before(since)
+	}
+	_, target := c.resolveCname(domain)
+	for _, entry := range c.cache[cacheKey(target)] {
+		if matchesType(entry.rr, recordType) && !entry.received.Before(since) {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrAbsent is returned by queries for record types that, according to an NSEC
+// record received from the owner of the name, do not exist
+var ErrAbsent = errors.New("Record type does not exist, as asserted by NSEC")
+
+// assertedAbsent checks whether any of the questions is known to have no answer:
+// there are no answers to it in cache, but there is an NSEC record, received at or
+// after the given time, that leaves the question type out of its type bitmap.
+// RFC 6762, section 6.1: the NSEC record tells queriers which record types exist
+// for a unique name, so they need not ask for the others.
+func (c *Client) assertedAbsent(questions []dns.Question, since time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := c.Clock.Now()
+	for _, question := range questions {
+		qtype := question.Qtype
+		if qtype == dns.TypeANY || qtype == dns.TypeNSEC || qtype == dns.TypeCNAME {
+			continue
+		}
+		if c.hasCachedAnswers(question.Name, qtype) {
+			continue
+		}
+		_, target := c.resolveCname(question.Name)
+		for _, entry := range c.cache[cacheKey(target)] {
+			nsec, ok := entry.rr.(*dns.NSEC)
+			if ok && !entry.expired(now) && !entry.received.Before(since) && !containsType(nsec.TypeBitMap, qtype) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchesType checks whether the record is of the given type. Any record
+// type is stored and served as-is, including types this package knows nothing
+// about. The ANY pseudo-type matches all records.
+func matchesType(rr dns.RR, recordType uint16) bool {
+	return recordType == dns.TypeANY || rr.Header().Rrtype == recordType
+}
+
+// hasCachedAnswers returns whether getCachedAnswers would return any records
+// for a single question, without building them. Must be called with the lock held.
+func (c *Client) hasCachedAnswers(domain string, recordType uint16) bool {
+	now := c.Clock.Now()
+	if entry := c.cnames[cacheKey(domain)]; c.NoFollowCNAME && entry != nil {
+		return !entry.expired(now)
+	}
+	_, target := c.resolveCname(domain)
+	for _, entry := range c.cache[cacheKey(target)] {
+		if matchesType(entry.rr, recordType) && !entry.expired(now) {
+			return true
+		}
+	}
+	return false
+}
+
 // getCachedAnswers attempts to retrieve from cache a collection of records that answer a single question
 // trying to facilitate records that would be requested as well
 func (c *Client) getCachedAnswers(domain string, recordType uint16, cnames map[string]dns.RR) []dns.RR {
+	if entry := c.cnames[cacheKey(domain)]; c.NoFollowCNAME && entry != nil {
+		// the cname itself is the answer
+		if entry.expired(c.Clock.Now()) {
+			return nil
+		}
+		entry.rr.Header().Ttl = entry.ttl(c.Clock.Now())
+		return []dns.RR{entry.rr}
+	}
 	chain, target := c.resolveCname(domain)
 
 	var answers []dns.RR
 
-	entries := c.cache[target]
+	entries := c.cache[cacheKey(target)]
 	now := c.Clock.Now()
 	if entries != nil {
 		for _, entry := range entries {
-			if entry.rr.Header().Rrtype == recordType && entry.expires.After(now) {
+			if matchesType(entry.rr, recordType) && !entry.expired(now) {
 				rr := entry.rr
 				rr.Header().Ttl = entry.ttl(now)
 				answers = append(answers, rr)
@@ -144,6 +707,9 @@ func (c *Client) getCachedAnswers(domain string, recordType uint16, cnames map[s
 		for _, rr := range answers {
 			srv := rr.(*dns.SRV)
 			followup = append(followup, c.getCachedAnswers(srv.Target, dns.TypeA, cnames)...)
+			if c.NoFollowCNAME && c.cnames[cacheKey(srv.Target)] != nil {
+				continue // the cname answers for both address types
+			}
 			followup = append(followup, c.getCachedAnswers(srv.Target, dns.TypeAAAA, cnames)...)
 		}
 	}
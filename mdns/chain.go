@@ -0,0 +1,150 @@
+package mdns
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ResolutionChain describes the records traversed to resolve a service
+// instance, as returned by ResolveChain. It is meant for debugging DNS-SD
+// record graphs: the hops show where resolution stops, if it does.
+type ResolutionChain struct {
+	Instance string    // Fully qualified instance name, e.g. My\ Printer._ipp._tcp.local.
+	Root     *ChainHop // The PTR records of the service type pointing to the instance
+}
+
+// ChainHop is a step of a ResolutionChain: the cached records of a name and
+// type, and the hops that follow from them
+type ChainHop struct {
+	Label   string      // Type of the records looked up, e.g. "SRV", or "CNAME" for an alias followed
+	Name    string      // Name the records were looked up by
+	Records []dns.RR    // Records found, with their remaining TTL
+	Error   string      // Why resolution cannot go on from this hop, if it is a dead end
+	Note    string      // Remark on the hop that does not stop resolution, e.g. a missing PTR record
+	Next    []*ChainHop // Hops following from the records
+}
+
+// ResolveChain resolves the given fully qualified service instance as Resolve
+// does, but returns the whole chain of cached records traversed to do so, from
+// the PTR of the service type, through the SRV and TXT records of the instance,
+// down to the target addresses, following through any CNAME on the way. Dead
+// ends, such as a missing SRV record or a CNAME to a name without addresses,
+// are flagged in the hops they occur. A missing PTR record is only noted, as
+// instances resolve without one. If the context is done before the instance is
+// fully resolved, the chain so far is returned along with the context error.
+func (c *Client) ResolveChain(ctx context.Context, instance string) (*ResolutionChain, error) {
+	instance = dns.Fqdn(instance)
+	_, err := c.Resolve(ctx, instance)
+	if err != nil && ctx.Err() == nil {
+		return nil, err
+	}
+
+	service := instance
+	if labels := dns.Split(instance); len(labels) > 1 {
+		service = instance[labels[1]:]
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	now := c.Clock.Now()
+
+	root := &ChainHop{Label: "PTR", Name: service}
+	for _, rr := range c.chainRecords(service, dns.TypePTR, now) {
+		if strings.EqualFold(rr.(*dns.PTR).Ptr, instance) {
+			root.Records = append(root.Records, rr)
+		}
+	}
+	if len(root.Records) == 0 {
+		// the instance can be resolved all the same, e.g. by a direct Resolve,
+		// but browsing for the service would not find it
+		root.Note = "No cached PTR record points to the instance"
+	}
+
+	srv := &ChainHop{Label: "SRV", Name: instance, Records: c.chainRecords(instance, dns.TypeSRV, now)}
+	if len(srv.Records) == 0 {
+		srv.Error = "Missing SRV record"
+	}
+	for _, rr := range srv.Records {
+		srv.Next = append(srv.Next, c.addressHops(rr.(*dns.SRV).Target, now, make(map[string]bool))...)
+	}
+	txt := &ChainHop{Label: "TXT", Name: instance, Records: c.chainRecords(instance, dns.TypeTXT, now)}
+	if len(txt.Records) == 0 {
+		txt.Error = "Missing TXT record"
+	}
+	root.Next = []*ChainHop{srv, txt}
+
+	return &ResolutionChain{Instance: instance, Root: root}, err
+}
+
+// addressHops returns the hops resolving the given host name: the CNAME it is
+// an alias for, if any, or else its A and AAAA records. Seen has the names
+// already followed, to tell CNAME loops. Must be called with the lock held.
+func (c *Client) addressHops(name string, now time.Time, seen map[string]bool) []*ChainHop {
+	key := cacheKey(name)
+	if entry := c.cnames[key]; entry != nil && !entry.expired(now) {
+		rr := dns.Copy(entry.rr)
+		rr.Header().Ttl = entry.ttl(now)
+		hop := &ChainHop{Label: "CNAME", Name: name, Records: []dns.RR{rr}}
+		seen[key] = true
+		if target := entry.cname().Target; seen[cacheKey(target)] {
+			hop.Error = fmt.Sprintf("CNAME loop back to %s", target)
+		} else {
+			hop.Next = c.addressHops(target, now, seen)
+		}
+		return []*ChainHop{hop}
+	}
+
+	a := &ChainHop{Label: "A", Name: name, Records: c.chainRecords(name, dns.TypeA, now)}
+	aaaa := &ChainHop{Label: "AAAA", Name: name, Records: c.chainRecords(name, dns.TypeAAAA, now)}
+	if len(a.Records) == 0 && len(aaaa.Records) == 0 {
+		// either address family is enough, so only both missing is a dead end
+		a.Error = "Missing address records"
+		aaaa.Error = a.Error
+	}
+	return []*ChainHop{a, aaaa}
+}
+
+// chainRecords returns copies of the unexpired cached records of the given name
+// and type, with their remaining TTL. Must be called with the lock held.
+func (c *Client) chainRecords(name string, recordType uint16, now time.Time) []dns.RR {
+	var records []dns.RR
+	for _, entry := range c.cache[cacheKey(name)] {
+		if entry.rr.Header().Rrtype == recordType && !entry.expired(now) {
+			rr := dns.Copy(entry.rr)
+			rr.Header().Ttl = entry.ttl(now)
+			records = append(records, rr)
+		}
+	}
+	return records
+}
+
+// String renders the chain as an indented tree, one hop per line followed by
+// its records and any dead end
+func (chain *ResolutionChain) String() string {
+	var b strings.Builder
+	var write func(hop *ChainHop, depth int)
+	write = func(hop *ChainHop, depth int) {
+		indent := strings.Repeat("  ", depth)
+		fmt.Fprintf(&b, "%s%s %s\n", indent, hop.Label, hop.Name)
+		for _, rr := range hop.Records {
+			fmt.Fprintf(&b, "%s  %s\n", indent, rr)
+		}
+		if hop.Note != "" {
+			fmt.Fprintf(&b, "%s  note: %s\n", indent, hop.Note)
+		}
+		if hop.Error != "" {
+			fmt.Fprintf(&b, "%s  error: %s\n", indent, hop.Error)
+		}
+		for _, next := range hop.Next {
+			write(next, depth+1)
+		}
+	}
+	if chain.Root != nil {
+		write(chain.Root, 0)
+	}
+	return b.String()
+}
@@ -2,11 +2,20 @@ package mdns
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"net"
+	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/epiclabs-io/epicmdns/mdns/udptransport"
 	"github.com/epiclabs-io/ticker"
 	"github.com/miekg/dns"
 )
@@ -14,14 +23,39 @@ import (
 // Client represents a mDNS client
 type Client struct {
 	Config
-	closed       int32
-	closedCh     chan struct{}
-	lock         sync.RWMutex
-	cache        map[string][]*cacheEntry
-	cnames       map[string]*cacheEntry
-	signal       *signal
-	purgeTicker  *ticker.Ticker
-	browseTicker *ticker.Ticker
+	closed        int32
+	closedCh      chan struct{}
+	transportDown chan struct{} // closed if the transport stops delivering packets
+	lock          sync.RWMutex
+	cache         map[string][]*cacheEntry
+	cnames        map[string]*cacheEntry
+	registrations map[string]*registration
+	listeners     map[chan *Packet]struct{}
+	announceQueue []*registration // registrations waiting to be announced together
+	rotationLock  sync.Mutex
+	randLock      sync.Mutex             // Rand need not be safe for concurrent use
+	rotations     map[string]int         // how many times the addresses of each name were rotated
+	queries       map[int][]dns.Question // questions being asked over the network, by query number
+	queryCount    int
+	signal        *signal
+	tickerLock    sync.Mutex // guards the tickers, which Reconfigure replaces
+	purgeTicker   *ticker.Ticker
+	browseTicker  *ticker.Ticker
+	specTickers   []*ticker.Ticker           // browse tickers of the BrowseSpecs with a period of their own
+	loops         sync.WaitGroup             // background goroutines to wait for on close
+	loopsLock     sync.Mutex                 // orders starting background goroutines against closing
+	refreshes     map[string]bool            // question sets being revalidated in the background
+	pins          map[string]bool            // name and type pairs kept in cache past expiry, by pinKey
+	holds         map[string]int             // pins held by instance handles, by pinKey
+	answered      map[string]time.Time       // when records were last multicast in answers, by answerKey
+	renames       map[string]renameCandidate // instances that recently went away or showed up, for OnRenamed
+	lastChange    time.Time                  // last time new records or goodbyes arrived to the cache
+	querySlots    chan struct{}              // one element per query being transmitted, if MaxConcurrentQueries is set
+	received      chan *Packet               // received packets waiting for the ReceiveWorkers, if set
+	logCount      uint32                     // messages seen by logSampled
+	metrics       *Metrics                   // counters of MetricsSnapshot, allocated apart to keep them 64-bit aligned for atomic access
+	idleLock      sync.Mutex
+	lastPacket    time.Time // last time a packet was sent or received
 }
 
 // New builds a mDNS Client with the given configuration
@@ -32,62 +66,473 @@ func New(config *Config) (*Client, error) {
 	}
 
 	c := &Client{
-		Config:   *config,
-		closedCh: make(chan struct{}),
-		signal:   newSignal(),
-		cache:    make(map[string][]*cacheEntry),
-		cnames:   make(map[string]*cacheEntry),
+		Config:        *config,
+		closedCh:      make(chan struct{}),
+		transportDown: make(chan struct{}),
+		signal:        newSignal(),
+		metrics:       new(Metrics),
+		cache:         make(map[string][]*cacheEntry),
+		cnames:        make(map[string]*cacheEntry),
+		registrations: make(map[string]*registration),
+		listeners:     make(map[chan *Packet]struct{}),
+		rotations:     make(map[string]int),
+		queries:       make(map[int][]dns.Question),
+		refreshes:     make(map[string]bool),
+		pins:          make(map[string]bool),
+		holds:         make(map[string]int),
+		answered:      make(map[string]time.Time),
+		renames:       make(map[string]renameCandidate),
 	}
 
-	// configure periodic tasks
-	c.purgeTicker = ticker.New(&ticker.Config{
-		Clock:    config.Clock,
-		Interval: config.CachePurgePeriod,
-		Callback: func() { c.purgeCache() },
-	})
+	c.lastChange = c.Clock.Now()
+	if c.MaxConcurrentQueries > 0 {
+		c.querySlots = make(chan struct{}, c.MaxConcurrentQueries)
+	}
+	if c.ReceiveWorkers > 0 {
+		size := c.ReceiveQueueSize
+		if size <= 0 {
+			size = defaultReceiveQueueSize
+		}
+		c.received = make(chan *Packet, size)
+		for i := 0; i < c.ReceiveWorkers; i++ {
+			c.background(c.receiveWorker)
+		}
+	}
 
-	c.browseTicker = ticker.New(&ticker.Config{
-		Clock:    config.Clock,
-		Interval: c.BrowsePeriod,
-		Callback: func() {
-			for _, s := range c.BrowseServices {
-				c.serviceQuery(s)
-			}
-		},
-	})
+	// configure periodic tasks
+	c.startTickers(config.CachePurgePeriod, config.BrowsePeriod)
 
 	// start reading incoming messages
+	c.loops.Add(1)
 	go c.messageLoop()
 
+	if c.OnIdle != nil && c.IdleTimeout > 0 {
+		c.lastPacket = c.Clock.Now()
+		timer := c.Clock.NewTimer(c.IdleTimeout)
+		c.background(func() { c.idleLoop(timer) })
+	}
+
 	return c, nil
 }
 
-// Close shuts down the client
+// revalidateTimeout bounds how long stale answers are refreshed in the background
+const revalidateTimeout = 5 * time.Second
+
+// closeTimeout bounds how long Close waits for a clean shutdown
+const closeTimeout = 5 * time.Second
+
+// Close shuts down the client, waiting up to closeTimeout for goodbye
+// packets to go out and background tasks to finish
 func (c *Client) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	return c.CloseContext(ctx)
+}
+
+// CloseContext shuts down the client, saying goodbye for the registered services.
+// If the context is done before goodbye packets are sent and background tasks
+// finish, the client is shut down anyway and the context error is returned.
+func (c *Client) CloseContext(ctx context.Context) error {
 	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
 		// something else already closed it
 		return nil
 	}
+	// from here on, no more background goroutines start
+	c.loopsLock.Lock()
+	c.loopsLock.Unlock()
 	close(c.closedCh)
+	err := waitContext(ctx, c.goodbye)
 	c.Transport.Close()
+	c.stopTickers()
+	if err != nil {
+		return err
+	}
+	return waitContext(ctx, c.loops.Wait)
+}
+
+// background runs f in a goroutine that Close waits for. Returns false,
+// without running f, if the client is closed.
+func (c *Client) background(f func()) bool {
+	c.loopsLock.Lock()
+	defer c.loopsLock.Unlock()
+	if atomic.LoadInt32(&c.closed) != 0 {
+		return false
+	}
+	c.loops.Add(1)
+	go func() {
+		defer c.loops.Done()
+		f()
+	}()
+	return true
+}
+
+// startTickers starts the periodic cache purge and service browsing.
+// Must be called with the ticker lock held, or before the client is returned.
+func (c *Client) startTickers(purgePeriod, browsePeriod time.Duration) {
+	c.purgeTicker = ticker.New(&ticker.Config{
+		Clock:    c.Clock,
+		Interval: purgePeriod,
+		Callback: func() { c.purgeCache() },
+	})
+
+	c.browseTicker = ticker.New(&ticker.Config{
+		Clock:    c.Clock,
+		Interval: browsePeriod,
+		Callback: func() {
+			for _, s := range c.BrowseServices {
+				c.serviceQuery(s)
+			}
+			for _, spec := range c.BrowseSpecs {
+				if spec.Period <= 0 {
+					c.serviceQuery(spec.Service)
+				}
+			}
+		},
+	})
+
+	c.specTickers = nil
+	for _, spec := range c.BrowseSpecs {
+		if spec.Period <= 0 {
+			continue
+		}
+		service := spec.Service
+		c.specTickers = append(c.specTickers, ticker.New(&ticker.Config{
+			Clock:    c.Clock,
+			Interval: spec.Period,
+			Callback: func() { c.serviceQuery(service) },
+		}))
+	}
+}
+
+// stopTickersLocked stops the periodic tasks. Must be called with the ticker lock held.
+func (c *Client) stopTickersLocked() {
 	c.purgeTicker.Stop()
 	c.browseTicker.Stop()
+	for _, t := range c.specTickers {
+		t.Stop()
+	}
+}
+
+// stopTickers stops the periodic tasks
+func (c *Client) stopTickers() {
+	c.tickerLock.Lock()
+	defer c.tickerLock.Unlock()
+	c.stopTickersLocked()
+}
+
+// reconfigurable lists the Config fields Reconfigure applies
+var reconfigurable = map[string]bool{
+	"MinTTL":           true,
+	"RetryPeriod":      true,
+	"BrowsePeriod":     true,
+	"CachePurgePeriod": true,
+}
+
+// Reconfigure applies the fields of the given configuration that can change
+// at runtime: MinTTL, RetryPeriod, BrowsePeriod and CachePurgePeriod. Fields
+// left at their zero value keep the current setting, so a single one can be
+// changed at a time. Any other field must be left unset or equal to the current
+// one, e.g. when passing back a modified copy of the original configuration,
+// otherwise an error is returned and nothing is changed.
+// The cache and ongoing browses are kept. MinTTL applies to records cached from
+// then on, RetryPeriod to queries started from then on, and period changes
+// restart the corresponding ticker.
+func (c *Client) Reconfigure(config *Config) error {
+	if atomic.LoadInt32(&c.closed) != 0 {
+		return errClosed
+	}
+	for _, period := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"RetryPeriod", config.RetryPeriod},
+		{"BrowsePeriod", config.BrowsePeriod},
+		{"CachePurgePeriod", config.CachePurgePeriod},
+	} {
+		if period.value < 0 {
+			return fmt.Errorf("Config field %s cannot be negative", period.name)
+		}
+	}
+
+	c.tickerLock.Lock()
+	defer c.tickerLock.Unlock()
+	c.lock.Lock()
+	current, next := reflect.ValueOf(&c.Config).Elem(), reflect.ValueOf(config).Elem()
+	for i := 0; i < next.NumField(); i++ {
+		name := next.Type().Field(i).Name
+		if !reconfigurable[name] && !next.Field(i).IsZero() && !sameValue(current.Field(i), next.Field(i)) {
+			c.lock.Unlock()
+			return fmt.Errorf("Config field %s cannot be changed at runtime", name)
+		}
+	}
+	purgePeriod, browsePeriod := c.CachePurgePeriod, c.BrowsePeriod
+	if config.MinTTL != 0 {
+		c.MinTTL = config.MinTTL
+	}
+	if config.RetryPeriod != 0 {
+		c.RetryPeriod = config.RetryPeriod
+	}
+	if config.BrowsePeriod != 0 {
+		c.BrowsePeriod = config.BrowsePeriod
+	}
+	if config.CachePurgePeriod != 0 {
+		c.CachePurgePeriod = config.CachePurgePeriod
+	}
+	restart := purgePeriod != c.CachePurgePeriod || browsePeriod != c.BrowsePeriod
+	purgePeriod, browsePeriod = c.CachePurgePeriod, c.BrowsePeriod
+	c.lock.Unlock()
+
+	if restart && atomic.LoadInt32(&c.closed) == 0 {
+		c.stopTickersLocked()
+		c.startTickers(purgePeriod, browsePeriod)
+	}
 	return nil
 }
 
+// sameValue compares two values of the same Config field
+func sameValue(a, b reflect.Value) bool {
+	switch {
+	case a.Kind() == reflect.Func:
+		return a.Pointer() == b.Pointer()
+	case a.Kind() == reflect.Interface && !a.IsNil() && !b.IsNil() && a.Elem().Type().Comparable():
+		return a.Interface() == b.Interface()
+	case a.Type() == reflect.TypeOf(net.IP{}):
+		return a.Interface().(net.IP).Equal(b.Interface().(net.IP))
+	}
+	return reflect.DeepEqual(a.Interface(), b.Interface())
+}
+
+// waitContext runs f, returning early with the context error if
+// the context is done before f returns
+func waitContext(ctx context.Context, f func()) error {
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // messageLoop reads the transport and adds received
 // records to the cache. It signals outstanding queries when
-// records are in cache
+// records are in cache. Incoming queries are answered with
+// the records of registered services, and reconnections of
+// the transport are handled as they are reported. With
+// ReceiveWorkers, packets are queued for the workers instead,
+// so that the transport is drained promptly.
 func (c *Client) messageLoop() {
+	defer c.loops.Done()
+	reconnects := c.reconnects()
+	for {
+		select {
+		case <-c.closedCh:
+			return
+		case <-reconnects:
+			c.reconnected()
+		case packet, ok := <-c.Transport.Receive():
+			if !ok {
+				close(c.transportDown)
+				return
+			}
+			c.packetSeen()
+			if c.OnPacket != nil {
+				c.OnPacket(packet.Msg, false, packet.Src)
+			}
+			if c.received == nil {
+				c.handlePacket(packet)
+				continue
+			}
+			select {
+			case c.received <- packet:
+			default:
+				c.logSampled("mdns: receive queue full, dropping packet from %v", packet.Src)
+			}
+		}
+	}
+}
+
+// defaultReceiveQueueSize is how many received packets wait for a worker at
+// most if ReceiveQueueSize is not set
+const defaultReceiveQueueSize = 64
+
+// receiveWorker handles the packets queued by messageLoop as they come, until
+// the client is closed
+func (c *Client) receiveWorker() {
 	for {
 		select {
 		case <-c.closedCh:
 			return
-		case reply := <-c.Transport.Receive():
-			c.addToCache(append(reply.Answer, reply.Extra...))
-			c.signal.raise()
+		case packet := <-c.received:
+			c.handlePacket(packet)
+		}
+	}
+}
+
+// handlePacket answers a received query, or processes a received response
+func (c *Client) handlePacket(packet *Packet) {
+	if !packet.Msg.Response && len(packet.Msg.Question) > 0 {
+		c.answerQuery(packet)
+		return
+	}
+	c.processResponse(packet)
+}
+
+// processResponse adds the records of a received response to the cache
+// and lets waiting queries know. Records rejected by RecordFilter are
+// dropped first, so they cannot cause conflicts nor reach listeners either.
+func (c *Client) processResponse(packet *Packet) {
+	// RFC 6762, section 10.2: the cache-flush bit is not part of the rrclass,
+	// so it is cleared off all records, whatever section or source they come
+	// from, once the records that had it are noted down
+	flush := make(map[dns.RR]bool)
+	for _, rr := range append(packet.Msg.Answer, packet.Msg.Extra...) {
+		if rr.Header().Class&cacheFlushBit != 0 {
+			flush[rr] = true
+		}
+		rr.Header().Class &^= cacheFlushBit
+	}
+	if c.RecordFilter != nil {
+		packet = c.filterRecords(packet)
+	}
+	if packet.Msg.Truncated && c.TCPTransport != nil && c.fetchComplete(packet) {
+		// the records are processed along with the complete answer, so that
+		// waiting queries do not settle for the partial one
+		return
+	}
+	count(&c.metrics.AnswersReceived, len(packet.Msg.Answer))
+	c.detectConflicts(packet.Msg)
+	c.detectAddressConflicts(packet)
+	c.defendRecords(packet.Msg)
+	c.observeAnswers(packet.Msg)
+	records := cacheableRecords(packet.Msg)
+	batch := c.addToCacheFrom(records, packet.Src, packet.Interface)
+	c.flushStale(records, flush)
+	c.notifyListeners(packet)
+	c.signal.raise()
+	if c.OnCacheBatch != nil && !batch.empty() {
+		c.OnCacheBatch(batch)
+	}
+	c.detectRenames(batch)
+	if c.ProactiveResolve {
+		c.resolveNew(batch.Added)
+	}
+}
+
+// cacheableRecords returns the records of a response to add to the cache: those
+// in the answer section, goodbyes included, and those in the additional section
+// but goodbyes. Additional records are supplementary, so one with a TTL of zero
+// does not say the record is going away, and it is dropped rather than evicting
+// the cached copy.
+func cacheableRecords(msg *dns.Msg) []dns.RR {
+	records := make([]dns.RR, 0, len(msg.Answer)+len(msg.Extra))
+	records = append(records, msg.Answer...)
+	for _, rr := range msg.Extra {
+		if rr.Header().Ttl != 0 {
+			records = append(records, rr)
 		}
 	}
+	return records
+}
+
+// fetchComplete asks the responder of a truncated response for the complete
+// answer set over TCP, for the active questions the response answers in part,
+// and then processes the truncated response along with the fetched records.
+// If fetching fails, the truncated response is processed as is. Returns false
+// if there is nothing to fetch.
+// RFC 6762 leaves TCP as a fallback for answers too large for UDP, so this is
+// only of use with responders that support it.
+func (c *Client) fetchComplete(packet *Packet) bool {
+	var questions []dns.Question
+	for _, question := range c.ActiveQueries() {
+		for _, rr := range packet.Msg.Answer {
+			if strings.EqualFold(rr.Header().Name, question.Name) &&
+				(question.Qtype == dns.TypeANY || question.Qtype == rr.Header().Rrtype) {
+				question.Qclass &^= 1 << 15
+				questions = append(questions, question)
+				break
+			}
+		}
+	}
+	if len(questions) == 0 || packet.Src == nil {
+		return false
+	}
+
+	msg := new(dns.Msg)
+	msg.Id = c.randomID()
+	msg.Question = questions
+	msg.RecursionDesired = false
+
+	return c.background(func() {
+		// the answer is as complete as it will get, do not fall back again
+		complete := packet.Msg.Copy()
+		complete.Truncated = false
+		reply, err := c.TCPTransport.Exchange(msg, packet.Src)
+		if err != nil {
+			c.logSampled("error: %s", err)
+		} else {
+			complete.Answer = append(complete.Answer, reply.Answer...)
+			complete.Extra = append(complete.Extra, reply.Extra...)
+		}
+		c.processResponse(&Packet{Msg: complete, Src: packet.Src, Interface: packet.Interface})
+	})
+}
+
+// RecordFilter decides whether to accept a record received from the given source,
+// e.g. to keep rogue responders from poisoning the cache
+type RecordFilter func(rr dns.RR, src net.Addr) bool
+
+// PacketFunc observes a packet sent to addr, or received from addr if sent is
+// false. addr is nil for packets sent to the mDNS multicast group. It is called
+// from the loop that sends or receives the packet, so it must return quickly and
+// must not modify msg
+type PacketFunc func(msg *dns.Msg, sent bool, addr net.Addr)
+
+// filterRecords returns a copy of the packet without the records RecordFilter rejects
+func (c *Client) filterRecords(packet *Packet) *Packet {
+	filter := func(records []dns.RR) []dns.RR {
+		var kept []dns.RR
+		for _, rr := range records {
+			if c.RecordFilter(rr, packet.Src) {
+				kept = append(kept, rr)
+			}
+		}
+		return kept
+	}
+	msg := *packet.Msg
+	msg.Answer = filter(msg.Answer)
+	msg.Ns = filter(msg.Ns)
+	msg.Extra = filter(msg.Extra)
+	filtered := *packet
+	filtered.Msg = &msg
+	return &filtered
+}
+
+// Inject feeds a DNS message observed by other means, e.g. captured off the
+// network by an external tool, into the client as if it had been received
+// from the given source address. Records in responses are cached as usual.
+// Queries are ignored, since they were not addressed to us.
+func (c *Client) Inject(msg *dns.Msg, src net.Addr) {
+	if !msg.Response && len(msg.Question) > 0 {
+		return
+	}
+	c.processResponse(&Packet{Msg: msg.Copy(), Src: src})
+}
+
+// InjectWire works like Inject, but takes the message in wire format and parses
+// it the same way the UDP transport does, returning the error if it fails to,
+// e.g. because of bad compression pointers or truncated record data.
+func (c *Client) InjectWire(buf []byte, src net.Addr) error {
+	msg, err := udptransport.Unpack(buf)
+	if err != nil {
+		return err
+	}
+	c.Inject(msg, src)
+	return nil
 }
 
 // serviceQuery sends out a PTR query to discover
@@ -96,19 +541,52 @@ func (c *Client) serviceQuery(service string) {
 	service = strings.Trim(service, ".") + "."
 	q := new(dns.Msg)
 	q.SetQuestion(service, dns.TypePTR)
+	q.Id = c.randomID()
 	if c.ForceUnicastResponses {
 		q.Question[0].Qclass |= 1 << 15
 	}
 	q.RecursionDesired = false
-	if err := c.Transport.Send(q); err != nil {
+	q.Answer = c.knownAnswers(service, q)
+	if err := c.send(q, nil); err != nil {
 		log.Printf("error: %s", err)
 	}
 }
 
+// knownAnswers returns the cached PTR records of the given service type to
+// include in a query for it, as long as the query stays within maxMessageSize.
+//
+// RFC 6762, section 7.1: a Multicast DNS querier SHOULD include all of its
+// answers that remain valid in the Answer Section of the query. [...] a
+// Multicast DNS querier MUST NOT include records in the Known-Answer list whose
+// remaining TTL is less than half of their original TTL.
+func (c *Client) knownAnswers(service string, query *dns.Msg) []dns.RR {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	now := c.Clock.Now()
+	size := query.Len()
+	var known []dns.RR
+	for _, entry := range c.cache[cacheKey(service)] {
+		if entry.rr.Header().Rrtype != dns.TypePTR || entry.remaining(now) < entry.lifetime/2 {
+			continue
+		}
+		rr := dns.Copy(entry.rr)
+		rr.Header().Ttl = entry.ttl(now)
+		if size += dns.Len(rr); size > maxMessageSize {
+			break
+		}
+		known = append(known, rr)
+	}
+	return known
+}
+
 // answerQuestions takes a list of DNS questions and attempts
 // to answer all of them. If any question cannot be answered,
-// none are answered.
-func (c *Client) answerQuestions(questions []dns.Question) []dns.RR {
+// none are answered. If since is not zero, questions are only
+// considered answered if records were received at or after that time.
+// Question names need not be fully qualified.
+func (c *Client) answerQuestions(questions []dns.Question, since time.Time) []dns.RR {
+	questions = fqdnQuestions(questions)
 	var records []dns.RR
 	cnames := make(map[string]dns.RR)
 
@@ -116,8 +594,11 @@ func (c *Client) answerQuestions(questions []dns.Question) []dns.RR {
 	defer c.lock.Unlock()
 
 	for _, question := range questions {
+		if !since.IsZero() && !c.receivedSince(question.Name, question.Qtype, since) {
+			return nil
+		}
 		if question.Qtype == dns.TypeCNAME {
-			entry := c.cnames[question.Name]
+			entry := c.cnames[cacheKey(question.Name)]
 			if entry == nil {
 				return nil
 			}
@@ -134,56 +615,675 @@ func (c *Client) answerQuestions(questions []dns.Question) []dns.RR {
 	for _, cname := range cnames {
 		answers = append(answers, cname)
 	}
-	return copyRecords(append(answers, records...))
+	return c.presentRecords(copyRecords(append(answers, records...)))
+}
+
+// CachedAnswers returns the cached records that answer the given question,
+// along with the cnames leading to them and the related records Query would
+// return, without asking over the network. If filter is not nil, only the
+// records it returns true for are included. CNAME records are not filtered,
+// but they are only included if other records remain.
+func (c *Client) CachedAnswers(name string, qtype uint16, filter func(dns.RR) bool) []dns.RR {
+	name = dns.Fqdn(name)
+	cnames := make(map[string]dns.RR)
+	var records []dns.RR
+
+	c.lock.Lock()
+	if qtype == dns.TypeCNAME {
+		if entry := c.cnames[cacheKey(name)]; entry != nil && !entry.expired(c.Clock.Now()) {
+			entry.rr.Header().Ttl = entry.ttl(c.Clock.Now())
+			records = append(records, entry.rr)
+		}
+	} else {
+		records = c.getCachedAnswers(name, qtype, cnames)
+	}
+	records = copyRecords(records)
+	chain := make([]dns.RR, 0, len(cnames))
+	for _, cname := range cnames {
+		chain = append(chain, cname)
+	}
+	chain = copyRecords(chain)
+	c.lock.Unlock()
+
+	if filter != nil {
+		var filtered []dns.RR
+		for _, rr := range records {
+			if filter(rr) {
+				filtered = append(filtered, rr)
+			}
+		}
+		records = filtered
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	return c.presentRecords(append(chain, records...))
+}
+
+// presentRecords lowercases the owner names of the given records
+// if PreserveCase is set to false, otherwise they are left as received.
+// Address records are rotated if RotateAddresses is set.
+func (c *Client) presentRecords(records []dns.RR) []dns.RR {
+	if !c.preserveCase() {
+		for _, rr := range records {
+			rr.Header().Name = strings.ToLower(rr.Header().Name)
+		}
+	}
+	if c.RotateAddresses {
+		c.rotateAddresses(records)
+	}
+	if c.AddressOrder != AsReceived {
+		orderAddresses(records, c.AddressOrder)
+	}
+	return records
+}
+
+// AddressOrder tells in which order to return IPv4 and IPv6 addresses
+type AddressOrder int
+
+const (
+	// AsReceived leaves addresses in the order they are cached or resolved
+	AsReceived AddressOrder = iota
+	// IPv6First returns IPv6 addresses before IPv4 ones, as Happy Eyeballs
+	// (RFC 8305) callers prefer
+	IPv6First
+	// IPv4First returns IPv4 addresses before IPv6 ones
+	IPv4First
+)
+
+// prefers returns whether ip comes before other in the given order
+func (order AddressOrder) prefers(ip, other net.IP) bool {
+	v4, otherV4 := ip.To4() != nil, other.To4() != nil
+	switch order {
+	case IPv6First:
+		return !v4 && otherV4
+	case IPv4First:
+		return v4 && !otherV4
+	}
+	return false
+}
+
+// orderAddresses reorders, in place, the address records among the positions
+// they already take, so that the preferred family comes first. Other records
+// and the relative order within a family are left as they are.
+func orderAddresses(records []dns.RR, order AddressOrder) {
+	var positions []int
+	var addresses []dns.RR
+	for i, rr := range records {
+		if t := rr.Header().Rrtype; t == dns.TypeA || t == dns.TypeAAAA {
+			positions = append(positions, i)
+			addresses = append(addresses, rr)
+		}
+	}
+	ip := func(rr dns.RR) net.IP {
+		if a, ok := rr.(*dns.A); ok {
+			return a.A
+		}
+		return rr.(*dns.AAAA).AAAA
+	}
+	sort.SliceStable(addresses, func(i, j int) bool {
+		return order.prefers(ip(addresses[i]), ip(addresses[j]))
+	})
+	for i, p := range positions {
+		records[p] = addresses[i]
+	}
+}
+
+// rotateAddresses shifts, in place, the order of the address records of each
+// name and type one position further than the last time they were returned,
+// like a DNS round-robin, so that clients spread across all the addresses
+func (c *Client) rotateAddresses(records []dns.RR) {
+	// collect the positions of the address records of each name and type
+	positions := make(map[string][]int)
+	var keys []string
+	for i, rr := range records {
+		if t := rr.Header().Rrtype; t == dns.TypeA || t == dns.TypeAAAA {
+			key := cacheKey(rr.Header().Name) + "/" + dns.TypeToString[t]
+			if positions[key] == nil {
+				keys = append(keys, key)
+			}
+			positions[key] = append(positions[key], i)
+		}
+	}
+
+	c.rotationLock.Lock()
+	defer c.rotationLock.Unlock()
+	for _, key := range keys {
+		pos := positions[key]
+		if len(pos) < 2 {
+			continue
+		}
+		shift := c.rotations[key] % len(pos)
+		c.rotations[key]++
+		group := make([]dns.RR, len(pos))
+		for i, p := range pos {
+			group[i] = records[p]
+		}
+		for i, p := range pos {
+			records[p] = group[(i+shift)%len(group)]
+		}
+	}
 }
 
 // Query takes a list of questions and tries to resove them until
-// answers are received or context is cancelled.
+// answers are received or context is cancelled. It returns ErrAbsent right away
+// if an NSEC record asserts that the type asked for does not exist, and
+// ErrTruncated along with the first MaxAnswers records if there are more.
 func (c *Client) Query(ctx context.Context, questions ...dns.Question) ([]dns.RR, error) {
+	return c.query(ctx, false, questions)
+}
+
+// QueryFresh works like Query, but skips the cache and always asks over
+// the network, returning only once fresh answers are received. Received
+// answers populate the cache as usual.
+func (c *Client) QueryFresh(ctx context.Context, questions ...dns.Question) ([]dns.RR, error) {
+	return c.query(ctx, true, questions)
+}
+
+// QueryDeadline works like Query for a single question, but gives up once the
+// Clock reaches the given deadline, rather than the system clock, as context
+// deadlines do. It returns context.DeadlineExceeded then.
+func (c *Client) QueryDeadline(q dns.Question, deadline time.Time) ([]dns.RR, error) {
+	ctx, cancel := c.Clock.DeadlineContext(context.Background(), deadline)
+	defer cancel()
+	return c.query(ctx, false, []dns.Question{q})
+}
+
+// QueryFirst works like Query for a single question, but returns only the first
+// record answering it, for presence checks that care about latency rather than
+// completeness. It returns as soon as any responder answers, and the whole
+// response is cached all the same.
+func (c *Client) QueryFirst(ctx context.Context, q dns.Question) (dns.RR, error) {
+	records, err := c.ask(ctx, false, []dns.Question{q})
+	if err != nil {
+		return nil, err
+	}
+	// cnames leading to the answer come first
+	for _, rr := range records {
+		if matchesType(rr, q.Qtype) {
+			return rr, nil
+		}
+	}
+	if len(records) == 0 {
+		return nil, ErrAbsent
+	}
+	return records[0], nil
+}
+
+// QueryTo works like QueryFresh, but sends the questions via unicast to the
+// given responder, e.g. a specific gateway, rather than to the multicast group.
+// Answers from other responders, multicast or not, are accepted all the same.
+// A nil dst multicasts the questions, as QueryFresh does.
+func (c *Client) QueryTo(ctx context.Context, dst net.Addr, questions ...dns.Question) ([]dns.RR, error) {
+	questions = fqdnQuestions(questions)
+	msg := new(dns.Msg)
+	msg.Id = c.randomID()
+	msg.Question = questions
+	msg.RecursionDesired = false
+
+	since := c.Clock.Now()
+	send := func(msg *dns.Msg) error {
+		return c.send(msg, dst)
+	}
+	return c.limitAnswers(c.transmit(ctx, msg, send, func() []dns.RR {
+		return c.answerQuestions(questions, since)
+	}))
+}
+
+// QueryInto works like Query for a single question, but hands each answer
+// record to fn instead of returning them, for callers that aggregate answers
+// without keeping them. Records are answered off the cache or over the network
+// exactly as Query does, but no slice of them is built: fn is called while the
+// cache is walked, with the cached records themselves, unless PreserveCase is
+// false. So fn must neither keep nor modify them, dns.Copy them for that, and
+// must not call the client, whose cache stays locked meanwhile. Cnames come
+// right before the records they lead to. Reordering addresses needs the whole
+// answer at hand, so if RotateAddresses or AddressOrder are set, the answer is
+// built as Query does and then handed to fn.
+func (c *Client) QueryInto(ctx context.Context, q dns.Question, fn func(dns.RR)) error {
+	if c.RotateAddresses || c.AddressOrder != AsReceived {
+		records, err := c.query(ctx, false, []dns.Question{q})
+		for _, rr := range records {
+			fn(rr)
+		}
+		return err
+	}
+
+	q.Name = dns.Fqdn(q.Name)
+	v := answerVisitor{fn: fn, max: c.MaxAnswers, copy: !c.preserveCase()}
+	err := c.askWith(ctx, false, []dns.Question{q}, func(since time.Time) bool {
+		return c.visitAnswers(q, since, &v)
+	})
+	if err == nil && v.truncated {
+		return ErrTruncated
+	}
+	return err
+}
+
+// answerVisitor hands the records answering a question to fn, as QueryInto
+// does, up to max of them if not zero
+type answerVisitor struct {
+	fn        func(dns.RR)
+	max       int
+	copy      bool            // whether to hand copies with lowercased owner names, as per PreserveCase
+	n         int             // records handed so far
+	truncated bool            // whether records were left out for being over max
+	cnames    map[string]bool // cnames handed so far, made on the first one
+}
+
+// visit hands the given record to fn, unless max records were handed already
+func (v *answerVisitor) visit(rr dns.RR) {
+	if v.max > 0 && v.n >= v.max {
+		v.truncated = true
+		return
+	}
+	v.n++
+	if v.copy {
+		rr = dns.Copy(rr)
+		rr.Header().Name = strings.ToLower(rr.Header().Name)
+	}
+	v.fn(rr)
+}
+
+// visitAnswers hands the cached records answering a fully qualified question to
+// the visitor, as answerQuestions would return them, and returns whether there
+// were any. If since is not zero, the question is only considered answered if
+// records were received at or after that time.
+func (c *Client) visitAnswers(q dns.Question, since time.Time, v *answerVisitor) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !since.IsZero() && !c.receivedSince(q.Name, q.Qtype, since) {
+		return false
+	}
+	if q.Qtype == dns.TypeCNAME {
+		entry := c.cnames[cacheKey(q.Name)]
+		if entry == nil {
+			return false
+		}
+		v.visit(entry.rr)
+		return true
+	}
+	return c.visitCachedAnswers(q.Name, q.Qtype, v)
+}
+
+// visitCachedAnswers works like getCachedAnswers, but hands the records to the
+// visitor instead of returning them. Must be called with the lock held.
+func (c *Client) visitCachedAnswers(domain string, recordType uint16, v *answerVisitor) bool {
+	now := c.Clock.Now()
+	if entry := c.cnames[cacheKey(domain)]; c.NoFollowCNAME && entry != nil {
+		// the cname itself is the answer
+		if entry.expired(now) {
+			return false
+		}
+		entry.rr.Header().Ttl = entry.ttl(now)
+		v.visit(entry.rr)
+		return true
+	}
+	chain, target := c.resolveCname(domain)
+
+	entries := c.cache[cacheKey(target)]
+	found := false
+	for _, entry := range entries {
+		if matchesType(entry.rr, recordType) && !entry.expired(now) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+
+	for _, cname := range chain {
+		if v.cnames[cname.Header().Name] {
+			continue
+		}
+		if v.cnames == nil {
+			v.cnames = make(map[string]bool)
+		}
+		v.cnames[cname.Header().Name] = true
+		v.visit(cname)
+	}
+	for _, entry := range entries {
+		if matchesType(entry.rr, recordType) && !entry.expired(now) {
+			entry.rr.Header().Ttl = entry.ttl(now)
+			v.visit(entry.rr)
+		}
+	}
+
+	switch recordType {
+	case dns.TypePTR:
+		for _, entry := range entries {
+			if ptr, ok := entry.rr.(*dns.PTR); ok && !entry.expired(now) {
+				c.visitCachedAnswers(ptr.Ptr, dns.TypeTXT, v)
+				c.visitCachedAnswers(ptr.Ptr, dns.TypeSRV, v)
+			}
+		}
+	case dns.TypeSRV:
+		for _, entry := range entries {
+			if srv, ok := entry.rr.(*dns.SRV); ok && !entry.expired(now) {
+				c.visitCachedAnswers(srv.Target, dns.TypeA, v)
+				if c.NoFollowCNAME && c.cnames[cacheKey(srv.Target)] != nil {
+					continue // the cname answers for both address types
+				}
+				c.visitCachedAnswers(srv.Target, dns.TypeAAAA, v)
+			}
+		}
+	}
+	return true
+}
+
+// QueryEach works like Query, but answers each question on its own: questions
+// are dropped from retransmissions as soon as their answers are cached, and the
+// answers are returned by question. If the context is done before all of them
+// are answered, the answers received so far are returned along with the context
+// error, so that the questions missing from the map are the unanswered ones.
+func (c *Client) QueryEach(ctx context.Context, questions ...dns.Question) (map[dns.Question][]dns.RR, error) {
+	answered := make(map[dns.Question][]dns.RR, len(questions))
+	var pending []dns.Question // as given, to key answers by
+	msg := new(dns.Msg)
+	msg.Id = c.randomID()
+	msg.RecursionDesired = false
+
+	// answer moves the questions answered off the cache from pending to answered,
+	// dropping them from the message too
+	answer := func() []dns.RR {
+		var asked []dns.Question
+		msg.Question = nil
+		for _, q := range pending {
+			question := dns.Question{Name: dns.Fqdn(q.Name), Qtype: q.Qtype, Qclass: q.Qclass}
+			if records := c.answerQuestions([]dns.Question{question}, time.Time{}); records != nil {
+				answered[q] = records
+				continue
+			}
+			if c.ForceUnicastResponses {
+				question.Qclass |= 1 << 15
+			}
+			msg.Question = append(msg.Question, question)
+			asked = append(asked, q)
+		}
+		pending = asked
+		if len(pending) == 0 {
+			// no records to return, just signal we are done
+			return []dns.RR{}
+		}
+		return nil
+	}
+
+	pending = questions
+	if answer() != nil {
+		return answered, nil
+	}
+	_, err := c.transmit(ctx, msg, c.multicast, answer)
+	return answered, err
+}
+
+// ErrTruncated is returned, along with the records or instances found, when
+// there are more than MaxAnswers
+var ErrTruncated = errors.New("Too many answers, only MaxAnswers returned")
+
+// query resolves the given questions, optionally bypassing the cache, and
+// caps the answers to MaxAnswers
+func (c *Client) query(ctx context.Context, fresh bool, questions []dns.Question) ([]dns.RR, error) {
+	return c.limitAnswers(c.ask(ctx, fresh, questions))
+}
+
+// limitAnswers caps the records to MaxAnswers, returning ErrTruncated if
+// there are more and no other error
+func (c *Client) limitAnswers(records []dns.RR, err error) ([]dns.RR, error) {
+	if err == nil && c.MaxAnswers > 0 && len(records) > c.MaxAnswers {
+		return records[:c.MaxAnswers], ErrTruncated
+	}
+	return records, err
+}
+
+// fqdnQuestions returns a copy of the questions with their names fully qualified,
+// since queriers may leave out the trailing dot
+func fqdnQuestions(questions []dns.Question) []dns.Question {
+	fqdn := make([]dns.Question, len(questions))
+	for i, q := range questions {
+		fqdn[i] = dns.Question{Name: dns.Fqdn(q.Name), Qtype: q.Qtype, Qclass: q.Qclass}
+	}
+	return fqdn
+}
+
+// ask resolves the given questions, optionally bypassing the cache
+func (c *Client) ask(ctx context.Context, fresh bool, questions []dns.Question) ([]dns.RR, error) {
+	questions = fqdnQuestions(questions)
+	var records []dns.RR
+	err := c.askWith(ctx, fresh, questions, func(since time.Time) bool {
+		records = c.answerQuestions(questions, since)
+		return records != nil
+	})
+	return records, err
+}
 
+// askWith resolves the given fully qualified questions, optionally bypassing
+// the cache, as ask does, but leaves collecting the answers to answered. It is
+// called with the time cached answers have to be received since, zero if any
+// will do, whenever the answers may be complete, and returns whether they are.
+// Once it does, it is not called again.
+func (c *Client) askWith(ctx context.Context, fresh bool, questions []dns.Question, answered func(since time.Time) bool) error {
 	// RFC 6762, section 18.12.  Repurposing of Top Bit of qclass in Question
 	// Section
 	//
 	// In the Question Section of a Multicast DNS query, the top bit of the qclass
 	// field is used to indicate that unicast responses are preferred for this
 	// particular question.  (See Section 5.4.)
-	if c.ForceUnicastResponses {
-		for i, _ := range questions {
-			questions[i].Qclass |= 1 << 15
+	query := func() *dns.Msg {
+		msg := new(dns.Msg)
+		msg.Id = c.randomID()
+		msg.RecursionDesired = false
+		msg.Question = questions
+		if c.ForceUnicastResponses {
+			msg.Question = make([]dns.Question, len(questions))
+			for i, q := range questions {
+				q.Qclass |= 1 << 15
+				msg.Question[i] = q
+			}
 		}
+		return msg
 	}
 
-	// build question message
-	msg := new(dns.Msg)
-	msg.Id = dns.Id()
-	msg.Question = questions
-	msg.RecursionDesired = false
+	// answers are complete once all questions are answered, or as soon as one of
+	// them is known to have no answer
+	var since time.Time
+	var absent bool
+	answer := func() []dns.RR {
+		if answered(since) {
+			// no records to return, just signal we are done
+			return []dns.RR{}
+		}
+		if c.assertedAbsent(questions, since) {
+			absent = true
+			return []dns.RR{}
+		}
+		return nil
+	}
 
-	// first, try to answer the question off the cache, without asking over the network
-	if answers := c.answerQuestions(questions); answers != nil {
-		return answers, nil
+	// first, try to answer the question off the cache, without asking over the
+	// network. Stale answers are only handed to answered if they are served.
+	stale := !fresh && c.isStale(questions)
+	if fresh {
+		since = c.Clock.Now()
+	} else if c.assertedAbsent(questions, since) {
+		count(&c.metrics.CacheHits, 1)
+		return ErrAbsent
+	} else if stale && !c.ServeStale {
+		if c.answerQuestions(questions, since) != nil {
+			// too old to serve, wait for fresh answers instead
+			fresh, since = true, c.Clock.Now()
+		}
+		count(&c.metrics.CacheMisses, 1)
+	} else if answered(since) {
+		count(&c.metrics.CacheHits, 1)
+		// RFC 8767, section 4: serve the stale data while refreshing it
+		if stale {
+			c.revalidate(query(), questions)
+		}
+		return nil
+	} else {
+		count(&c.metrics.CacheMisses, 1)
 	}
 
-	// if all the answers are not in cache, ask over the network:
-	if err := c.Transport.Send(msg); err != nil {
+	// optionally, wait for a while in case answers arrive passively,
+	// prompted by somebody else's query, to save on transmissions
+	if !fresh && c.PassiveGrace > 0 {
+		grace := c.Clock.NewTimer(c.PassiveGrace)
+	passive:
+		for {
+			select {
+			case <-grace.C:
+				break passive
+			case <-c.signal.waitCh():
+			case <-ctx.Done():
+				grace.Stop()
+				return ctx.Err()
+			}
+			if answer() != nil {
+				grace.Stop()
+				if absent {
+					return ErrAbsent
+				}
+				return nil
+			}
+		}
+	}
+
+	// if all the answers are not in cache, ask over the network.
+	_, err := c.transmit(ctx, query(), c.multicast, answer)
+	if absent {
+		return ErrAbsent
+	}
+	return err
+}
+
+// isStale checks whether the cached answers to any of the questions were
+// last received longer than MaxStaleness ago
+func (c *Client) isStale(questions []dns.Question) bool {
+	if c.MaxStaleness <= 0 {
+		return false
+	}
+	since := c.Clock.Now().Add(-c.MaxStaleness)
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for _, question := range questions {
+		if !c.receivedSince(question.Name, question.Qtype, since) {
+			return true
+		}
+	}
+	return false
+}
+
+// revalidate asks the questions over the network in the background until fresh
+// answers are received, revalidateTimeout elapses or the client is closed.
+// Nothing is asked if the same questions are already being revalidated.
+func (c *Client) revalidate(msg *dns.Msg, questions []dns.Question) {
+	key := questionsKey(questions)
+	c.lock.Lock()
+	if c.refreshes[key] {
+		c.lock.Unlock()
+		return
+	}
+	c.refreshes[key] = true
+	c.lock.Unlock()
+	done := func() {
+		c.lock.Lock()
+		delete(c.refreshes, key)
+		c.lock.Unlock()
+	}
+
+	since := c.Clock.Now()
+	started := c.background(func() {
+		defer done()
+		ctx, cancel := context.WithTimeout(context.Background(), revalidateTimeout)
+		defer cancel()
+		go func() {
+			select {
+			case <-c.closedCh:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		_, err := c.transmit(ctx, msg, c.multicast, func() []dns.RR {
+			return c.answerQuestions(questions, since)
+		})
+		if err != nil && ctx.Err() == nil {
+			log.Printf("error: %s", err)
+		}
+	})
+	if !started {
+		done()
+	}
+}
+
+// questionsKey identifies a set of questions regardless of name case and order
+func questionsKey(questions []dns.Question) string {
+	keys := make([]string, len(questions))
+	for i, q := range questions {
+		keys[i] = fmt.Sprintf("%s/%d", cacheKey(q.Name), q.Qtype)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, " ")
+}
+
+// transmit sends the given question message using send, retransmitting it periodically,
+// until answer returns any records or the context is cancelled.
+func (c *Client) transmit(ctx context.Context, msg *dns.Msg, send func(*dns.Msg) error, answer func() []dns.RR) ([]dns.RR, error) {
+	release, err := c.acquireQuerySlot(ctx)
+	if err != nil {
 		return nil, err
 	}
+	defer release()
+	// answers may have arrived while waiting for a slot
+	if c.querySlots != nil {
+		if records := answer(); records != nil {
+			return records, nil
+		}
+	}
+	defer c.trackQuery(msg.Question)()
 
-	// prepare a ticker for retries:
-	ticker := c.Clock.NewTicker(c.RetryPeriod)
+	// answers and retry times may come as soon as the query is sent, so they
+	// are waited for from before then
+	received := c.signal.waitCh()
+	c.lock.RLock()
+	retryPeriod := c.RetryPeriod
+	c.lock.RUnlock()
+	ticker := c.Clock.NewTicker(retryPeriod)
+	defer ticker.Stop()
+
+	// RFC 6762, section 5.4: the first query of a series requests unicast
+	// responses (QU), so as to populate the cache quickly, and retransmits
+	// revert to multicast responses (QM)
+	first := msg.Copy()
+	for i := range first.Question {
+		first.Question[i].Qclass |= 1 << 15
+	}
+	if err := send(first); err != nil {
+		return nil, err
+	}
 
 	for ctx.Err() == nil {
 		select {
 		case <-ticker.C:
+			// answers may have arrived along with the tick, and change what is
+			// asked for, so they are looked at before retransmitting
+			received = c.signal.waitCh()
+			if records := answer(); records != nil {
+				return records, nil
+			}
 			// resend question over the network
-			if err := c.Transport.Send(msg); err != nil {
+			if err := send(msg); err != nil {
 				return nil, err
 			}
-		case <-c.signal.waitCh(): // new data received, exit select and check answers
+		case <-received: // new data received, exit select and check answers
+		case <-c.transportDown: // no answers can arrive anymore
+			return nil, &TransportError{Err: errTransportClosed}
 		case <-ctx.Done(): // context cancelled/timed out
 			return nil, ctx.Err()
 		}
-		if records := c.answerQuestions(questions); records != nil {
+		received = c.signal.waitCh()
+		if records := answer(); records != nil {
 			return records, nil
 		}
 	}
@@ -191,6 +1291,141 @@ func (c *Client) Query(ctx context.Context, questions ...dns.Question) ([]dns.RR
 	return nil, ctx.Err()
 }
 
+// multicast sends the given message to the mDNS multicast group
+func (c *Client) multicast(msg *dns.Msg) error {
+	return c.send(msg, nil)
+}
+
+// send hands the given message to OnPacket, if set, and then sends it to dst,
+// or to the mDNS multicast group if dst is nil. Failures are returned as
+// TransportError.
+func (c *Client) send(msg *dns.Msg, dst net.Addr) error {
+	c.packetSeen()
+	if !msg.Response {
+		count(&c.metrics.QueriesSent, 1)
+	}
+	if c.OnPacket != nil {
+		c.OnPacket(msg, true, dst)
+	}
+	if err := c.Transport.Send(msg, dst); err != nil {
+		return &TransportError{Err: err}
+	}
+	return nil
+}
+
+// sendInterface works like send, but multicasts the message on the given
+// network interface only
+func (c *Client) sendInterface(msg *dns.Msg, iface string) error {
+	c.packetSeen()
+	if !msg.Response {
+		count(&c.metrics.QueriesSent, 1)
+	}
+	if c.OnPacket != nil {
+		c.OnPacket(msg, true, nil)
+	}
+	if err := c.Transport.SendInterface(msg, iface); err != nil {
+		return &TransportError{Err: err}
+	}
+	return nil
+}
+
+// logSampled works like log.Printf, but if LogSampleRate is above 1, it only
+// logs one in every LogSampleRate messages. It is meant for the paths driven by
+// received packets, which would flood the log on busy networks otherwise.
+func (c *Client) logSampled(format string, args ...interface{}) {
+	if rate := c.LogSampleRate; rate > 1 && atomic.AddUint32(&c.logCount, 1)%uint32(rate) != 1 {
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// acquireQuerySlot waits until fewer than MaxConcurrentQueries queries are being
+// transmitted, if set, returning a function to call once done
+func (c *Client) acquireQuerySlot(ctx context.Context) (func(), error) {
+	if c.querySlots == nil {
+		return func() {}, nil
+	}
+	select {
+	case c.querySlots <- struct{}{}:
+		return func() { <-c.querySlots }, nil
+	case <-c.closedCh:
+		return nil, errClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// trackQuery registers the questions as being asked over the network,
+// returning a function to call once done
+func (c *Client) trackQuery(questions []dns.Question) func() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.queryCount++
+	n := c.queryCount
+	c.queries[n] = append([]dns.Question(nil), questions...)
+	return func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		delete(c.queries, n)
+		c.dropTransient(questions)
+	}
+}
+
+// ActiveQueries returns the questions currently being asked over the
+// network by Query and similar calls, in the order they were asked
+func (c *Client) ActiveQueries() []dns.Question {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	numbers := make([]int, 0, len(c.queries))
+	for n := range c.queries {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	var questions []dns.Question
+	for _, n := range numbers {
+		questions = append(questions, c.queries[n]...)
+	}
+	return questions
+}
+
+// EffectiveConfig returns a copy of the configuration in use, with defaults
+// applied and any changes made by Reconfigure
+func (c *Client) EffectiveConfig() Config {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	config := c.Config
+	config.BrowseServices = append([]string(nil), c.BrowseServices...)
+	config.BrowseSpecs = append([]BrowseSpec(nil), c.BrowseSpecs...)
+	config.SearchDomains = append([]string(nil), c.SearchDomains...)
+	return config
+}
+
+// ActiveBrowses returns the service types periodically browsed for, those of
+// BrowseServices first and then those of BrowseSpecs
+func (c *Client) ActiveBrowses() []string {
+	services := make([]string, 0, len(c.BrowseServices)+len(c.BrowseSpecs))
+	for _, s := range c.BrowseServices {
+		services = append(services, strings.Trim(s, ".")+".")
+	}
+	for _, spec := range c.BrowseSpecs {
+		services = append(services, strings.Trim(spec.Service, ".")+".")
+	}
+	return services
+}
+
+// randomID returns a random DNS message ID, read from Rand
+func (c *Client) randomID() uint16 {
+	var b [2]byte
+	c.randLock.Lock()
+	_, err := io.ReadFull(c.Rand, b[:])
+	c.randLock.Unlock()
+	if err != nil {
+		log.Printf("error: %s", err)
+		return dns.Id()
+	}
+	return binary.BigEndian.Uint16(b[:])
+}
+
 func copyRecords(source []dns.RR) []dns.RR {
 	dest := make([]dns.RR, len(source))
 	for i, r := range source {
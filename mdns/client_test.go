@@ -1,8 +1,11 @@
 package mdns
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"net"
 	"sort"
 	"strings"
 	"sync"
@@ -15,28 +18,63 @@ import (
 )
 
 type mockTransport struct {
-	out chan *dns.Msg
-	in  chan *dns.Msg
+	out        chan *dns.Msg
+	in         chan *Packet
+	reconnects chan struct{} // reports reconnections to the client
+	iface      string        // interface the last message was sent on
+	dst        net.Addr      // destination of the last message, nil if multicast
+	err        error         // if set, returned by Send instead of sending
 }
 
 func newMockTransport() *mockTransport {
 	return &mockTransport{
-		out: make(chan *dns.Msg),
-		in:  make(chan *dns.Msg),
+		out:        make(chan *dns.Msg),
+		in:         make(chan *Packet),
+		reconnects: make(chan struct{}),
 	}
 }
 
-func (mt *mockTransport) Send(msg *dns.Msg) error {
+func (mt *mockTransport) Send(msg *dns.Msg, dst net.Addr) error {
+	if mt.err != nil {
+		return mt.err
+	}
+	mt.iface = ""
+	mt.dst = dst
+	mt.out <- msg
+	return nil
+}
+func (mt *mockTransport) SendInterface(msg *dns.Msg, iface string) error {
+	mt.iface = iface
+	mt.dst = nil
 	mt.out <- msg
 	return nil
 }
-func (mt *mockTransport) Receive() <-chan *dns.Msg {
+func (mt *mockTransport) Reconnected() <-chan struct{} {
+	return mt.reconnects
+}
+func (mt *mockTransport) Receive() <-chan *Packet {
 	return mt.in
 }
 func (mt *mockTransport) Close() {
 
 }
 
+// mockExchanger answers queries over a mock stream transport with a canned reply
+type mockExchanger struct {
+	reply *dns.Msg
+	err   error    // if set, returned instead of the reply
+	query *dns.Msg // last query received
+	dst   net.Addr // destination of the last query
+}
+
+func (me *mockExchanger) Exchange(msg *dns.Msg, dst net.Addr) (*dns.Msg, error) {
+	me.query, me.dst = msg, dst
+	if me.err != nil {
+		return nil, me.err
+	}
+	return me.reply.Copy(), nil
+}
+
 // rr2string takes a cache state and turns it to a printable string
 // suitable for comparing test results
 func rr2string(cache []dns.RR, cnames map[string]dns.RR) string {
@@ -159,6 +197,29 @@ func TestServiceQuery(tx *testing.T) {
 
 }
 
+func TestBrowseKnownAnswers(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	mt := newMockTransport()
+	clk := clock.NewMock(time.Unix(0, 0))
+
+	c, err := New(&Config{
+		Transport:    mt,
+		BrowsePeriod: 5000 * time.Second,
+		Clock:        clk,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	// by now, epic has less than half of its PTR TTL left, demo more
+	c.addToCache(parseRecords(t, zone))
+	clk.Add(110 * time.Second)
+
+	go c.serviceQuery("_service1._tcp.local.")
+	equalsMessage(t, "query.txt", <-mt.out)
+}
+
 func TestCache(tx *testing.T) {
 	t := ut.BeginTest(tx, false)
 	defer t.FinishTest()
@@ -196,7 +257,7 @@ func TestCache(tx *testing.T) {
 	t.EqualsTextFile("after-purge.txt", dumpCache(c))
 }
 
-func TestMessageLoop(tx *testing.T) {
+func TestRange(tx *testing.T) {
 	t := ut.BeginTest(tx, false)
 	defer t.FinishTest()
 
@@ -207,36 +268,80 @@ func TestMessageLoop(tx *testing.T) {
 		Clock:     clk,
 		Transport: mt,
 	})
-
 	t.Ok(err)
 	defer c.Close()
 
-	// cook some records:
-	answers := `
+	src := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 5353}
+	msg := new(dns.Msg)
+	msg.Response = true
+	msg.Answer = parseRecords(t, `
 	www.epiclabs.io				300	IN CNAME	myserver.epiclabs.io.
-	myserver.epiclabs.io		300	IN	A		10.10.10.10	
-	`
-	extra := `
-	demo._service1._tcp.local.	230	IN	TXT		"demo text"
-	`
+	myserver.epiclabs.io		300	IN	A		10.10.10.10
+	`)
+	c.Inject(msg, src)
+	c.addToCache(parseRecords(t, "other.epiclabs.io 120 IN A 10.10.10.11"))
+	clk.Add(20 * time.Second)
 
-	// build a message with cooked records
-	var msg = new(dns.Msg)
-	msg.Answer = parseRecords(t, answers)
-	msg.Extra = parseRecords(t, extra)
+	seen := make(map[string]string)
+	c.Range(func(rr dns.RR, remainingTTL time.Duration, src net.Addr) bool {
+		rr.Header().Ttl = 0 // must not touch the cache
+		seen[rr.Header().Name] = fmt.Sprintf("%s %v", remainingTTL, src)
+		return true
+	})
+	t.Equals(map[string]string{
+		"www.epiclabs.io.":      "4m40s 10.0.0.2:5353",
+		"myserver.epiclabs.io.": "4m40s 10.0.0.2:5353",
+		"other.epiclabs.io.":    "1m40s <nil>",
+	}, seen)
+	ttl, ok := c.RecordTTL("myserver.epiclabs.io", dns.TypeA, "10.10.10.10")
+	t.Assert(ok, "expected record in cache")
+	t.Equals(280*time.Second, ttl)
 
-	// simulate the above message is received
+	// iteration stops as soon as f returns false
+	visited := 0
+	c.Range(func(rr dns.RR, remainingTTL time.Duration, src net.Addr) bool {
+		visited++
+		return false
+	})
+	t.Equals(1, visited)
+}
+
+func TestWaitQuiescent(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: newMockTransport(),
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	c.addToCache(parseRecords(t, "myserver.local. 120 IN A 10.0.0.1"))
+	done := make(chan error)
 	go func() {
-		mt.in <- msg
+		done <- c.WaitQuiescent(context.Background(), 10*time.Second)
 	}()
 
-	<-c.signal.waitCh()
-
-	//check the above records entered the cache
-	t.EqualsTextFile("cache.txt", dumpCache(c))
+	// a refresh does not count as a change, while a new record does
+	clk.Add(5 * time.Second)
+	c.addToCache(parseRecords(t, "myserver.local. 120 IN A 10.0.0.1"))
+	c.addToCache(parseRecords(t, "myserver.local. 120 IN A 10.0.0.2"))
+	for {
+		clk.Add(time.Second)
+		time.Sleep(time.Millisecond)
+		select {
+		case err := <-done:
+			t.Ok(err)
+			t.Assert(clk.Now().Sub(time.Unix(0, 0)) >= 15*time.Second, "Returned before the cache was quiet")
+			return
+		default:
+		}
+	}
 }
 
-func TestAnswerQuestions(tx *testing.T) {
+func TestNegativeCache(tx *testing.T) {
 	t := ut.BeginTest(tx, false)
 	defer t.FinishTest()
 
@@ -247,35 +352,76 @@ func TestAnswerQuestions(tx *testing.T) {
 		Clock:     clk,
 		Transport: mt,
 	})
+	t.Ok(err)
+	defer c.Close()
+
+	// the host asserts it only has an IPv4 address
+	msg := new(dns.Msg)
+	msg.Response = true
+	msg.Answer = parseRecords(t, "myserver.local. 120 IN A 10.0.0.1")
+	msg.Extra = parseRecords(t, "myserver.local. 120 IN NSEC myserver.local. A")
+	mt.in <- &Packet{Msg: msg}
+	mt.in <- &Packet{Msg: new(dns.Msg)}
 
+	// the AAAA query returns at once, without asking over the network,
+	// while the A query is still answered
+	_, err = c.Query(context.Background(), dns.Question{Name: "myserver.local.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET})
+	t.Equals(ErrAbsent, err)
+	answers, err := c.Query(context.Background(), dns.Question{Name: "myserver.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	t.Ok(err)
+	t.Equals("10.0.0.1", answers[0].(*dns.A).A.String())
+
+	// once the NSEC record expires, the AAAA record is asked for again,
+	// until a new NSEC record arrives
+	clk.Add(121 * time.Second)
+	done := make(chan struct{})
+	go func() {
+		_, err = c.Query(context.Background(), dns.Question{Name: "myserver.local.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET})
+		close(done)
+	}()
+	<-mt.out
+	mt.in <- &Packet{Msg: msg}
+	<-done
+	t.Equals(ErrAbsent, err)
+}
+
+func TestRotateAddresses(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:           clk,
+		Transport:       mt,
+		RotateAddresses: true,
+	})
 	t.Ok(err)
 	defer c.Close()
 
-	// prefill the cache with the zone content
-	c.addToCache(parseRecords(t, zone))
+	c.addToCache(parseRecords(t, `
+	backend.epiclabs.io		300	IN	A		10.0.0.1
+	backend.epiclabs.io		300	IN	A		10.0.0.2
+	backend.epiclabs.io		300	IN	A		10.0.0.3
+	`))
 
-	// list of questions to resolve
-	questionSets := [][]dns.Question{
-		{{Name: "www.epiclabs.io.", Qtype: dns.TypeA, Qclass: dns.ClassINET}},
-		{{Name: "_service1._tcp.local.", Qtype: dns.TypePTR, Qclass: dns.ClassINET}},
-		{{Name: "www.epiclabs.io.", Qtype: dns.TypeCNAME, Qclass: dns.ClassINET}},
-		{{Name: "www.doesnotexist.not.", Qtype: dns.TypeCNAME, Qclass: dns.ClassINET}},
-		{{Name: "www.doesnotexist.not.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}},
+	q := dns.Question{Name: "backend.epiclabs.io.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	first := func() string {
+		records, err := c.Query(context.Background(), q)
+		t.Ok(err)
+		t.Equals(3, len(records))
+		return records[0].(*dns.A).A.String()
 	}
 
-	// invoke answerQuestions and see if questions are appropriately
-	// responded, comparing with testdata
-	for i, qs := range questionSets {
-		msg := &dns.Msg{
-			Question: qs,
-			Answer:   c.answerQuestions(qs),
-		}
-		equalsMessage(t, fmt.Sprintf("set%02d.txt", i), msg)
-	}
+	// every call starts one address further, wrapping around
+	t.Equals("10.0.0.1", first())
+	t.Equals("10.0.0.2", first())
+	t.Equals("10.0.0.3", first())
+	t.Equals("10.0.0.1", first())
 }
 
-func TestQuery(tx *testing.T) {
-
+func TestActiveQueries(tx *testing.T) {
 	t := ut.BeginTest(tx, false)
 	defer t.FinishTest()
 
@@ -283,84 +429,2193 @@ func TestQuery(tx *testing.T) {
 	mt := newMockTransport()
 
 	c, err := New(&Config{
-		Clock:       clk,
-		Transport:   mt,
-		RetryPeriod: 500 * time.Millisecond,
+		Clock:          clk,
+		Transport:      mt,
+		BrowseServices: []string{"_service1._tcp.local", "_printer._tcp.local."},
 	})
-
 	t.Ok(err)
 	defer c.Close()
 
-	ctx := context.Background()
+	t.Equals([]string{"_service1._tcp.local.", "_printer._tcp.local."}, c.ActiveBrowses())
+	t.Equals(0, len(c.ActiveQueries()))
 
-	// attempt to resolve a name
 	q := dns.Question{Name: "www.epiclabs.io.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
-	var wg sync.WaitGroup
-	wg.Add(1)
-	var queryErr error
-	var queryResult []dns.RR
-
-	// launch the query
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
 	go func() {
-		queryResult, queryErr = c.Query(ctx, q)
-		wg.Done()
+		c.Query(ctx, q)
+		close(done)
 	}()
+	<-mt.out
+	t.Equals([]dns.Question{q}, c.ActiveQueries())
 
-	// since the requested info is not in cache, we expect that a question
-	// message comes out over the transport
-	msg := <-mt.out
-	equalsMessage(t, "question1.txt", msg) // check message against testdata
+	// once the query is over, it is no longer reported
+	cancel()
+	<-done
+	t.Equals(0, len(c.ActiveQueries()))
+}
 
-	// if time passes without an answer, a retransmit must be sent
-	clk.Add(c.RetryPeriod)
-	msg2 := <-mt.out
-	t.Equals(msg, msg2) //make sure the retransmit is the same
+func TestMaxConcurrentQueries(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
 
-	// cook an answer message to the question
-	answerMsg := new(dns.Msg).SetReply(msg)
-	answerMsg.Answer = parseRecords(t, `
-	www.epiclabs.io				300	IN CNAME	myserver.epiclabs.io.
-	myserver.epiclabs.io		300	IN	A		10.10.10.10	
-	`)
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
 
-	mt.in <- answerMsg                                           //respond the question via the transport
-	wg.Wait()                                                    // wait for the Query() call to complete
-	t.Ok(queryErr)                                               // verify it went well
-	t.EqualsTextFile("answer1.txt", rr2string(queryResult, nil)) //check answer against testdata
+	c, err := New(&Config{
+		Clock:                clk,
+		Transport:            mt,
+		MaxConcurrentQueries: 2,
+	})
+	t.Ok(err)
+	defer c.Close()
 
-	// test query again to trigger cache
-	queryResult2, err := c.Query(ctx, q)
+	question := func(name string) dns.Question {
+		return dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	}
+	done := make(chan error, 3)
+	query := func(ctx context.Context, name string) {
+		go func() {
+			_, err := c.Query(ctx, question(name))
+			done <- err
+		}()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	query(ctx, "first.local.")
+	t.Equals("first.local.", (<-mt.out).Question[0].Name)
+	query(ctx, "second.local.")
+	t.Equals("second.local.", (<-mt.out).Question[0].Name)
+
+	// the third query waits for a slot, unless its context is done first
+	query(ctx, "third.local.")
+	select {
+	case msg := <-mt.out:
+		t.Fatalf("Expected no more queries in flight, got %s", msg.Question[0].Name)
+	case mt.in <- &Packet{Msg: new(dns.Msg)}:
+	}
+	t.Equals(2, len(c.ActiveQueries()))
+	cancelled, cancelWaiting := context.WithCancel(context.Background())
+	cancelWaiting()
+	_, err = c.Query(cancelled, question("fourth.local."))
+	t.Equals(context.Canceled, err)
+
+	// once the first query is answered, the third one is sent
+	response := new(dns.Msg)
+	response.Response = true
+	response.Answer = parseRecords(t, "first.local. 120 IN A 10.0.0.1")
+	mt.in <- &Packet{Msg: response}
+	t.Equals("third.local.", (<-mt.out).Question[0].Name)
+	t.Ok(<-done)
+}
+
+func TestUndottedNames(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
 	t.Ok(err)
-	t.Equals(queryResult, queryResult2)
+	defer c.Close()
 
-	// test context cancellation
-	// first clear the cache by elapsing time
-	clk.Add(500 * time.Hour)
-	c.purgeCache()
+	// records built by hand may lack the trailing dot, unlike those parsed off the wire
+	c.addToCache([]dns.RR{
+		&dns.SRV{
+			Hdr:    dns.RR_Header{Name: "demo._service1._tcp.local.", Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 300},
+			Target: "terminus.epiclabs.io",
+			Port:   8080,
+		},
+		&dns.A{
+			Hdr: dns.RR_Header{Name: "terminus.epiclabs.io", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.ParseIP("5.6.7.8"),
+		},
+	})
 
-	ctx2, cancel := context.WithCancel(context.Background())
-	wg.Add(1)
-	go func() {
-		queryResult, queryErr = c.Query(ctx2, q)
-		wg.Done()
-	}()
+	// following the SRV target finds the address regardless
+	cnames := make(map[string]dns.RR)
+	records := c.getCachedAnswers("demo._service1._tcp.local.", dns.TypeSRV, cnames)
+	t.Equals(2, len(records))
+	t.Equals("5.6.7.8", records[1].(*dns.A).A.String())
 
-	// read the outgoing mdns query and ignore it
-	msg = <-mt.out
+	records, err = c.Query(context.Background(), dns.Question{Name: "terminus.epiclabs.io.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	t.Ok(err)
+	t.Equals(1, len(records))
+}
 
-	//cancel context
-	cancel()
-	wg.Wait()
-	t.MustFail(queryErr, "Expected to have an error when context is cancelled")
+func TestSearchDomains(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
 
-	// query again, forcing unicast responses:
-	c.ForceUnicastResponses = true
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:         clk,
+		Transport:     mt,
+		SearchDomains: []string{"local.", "home.arpa."},
+		RetryPeriod:   time.Minute,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	c.addToCache(parseRecords(t, `
+	printer.local.		120	IN	A		10.0.0.1
+	printer.home.arpa.	120	IN	A		10.0.0.2
+	scanner.home.arpa.	120	IN	A		10.0.0.3
+	`))
 
+	// domains are tried in order
+	ips, err := c.LookupHost(context.Background(), "printer")
+	t.Ok(err)
+	t.Equals("[10.0.0.1]", fmt.Sprint(ips))
+	ips, err = c.LookupHost(context.Background(), "scanner")
+	t.Ok(err)
+	t.Equals("[10.0.0.3]", fmt.Sprint(ips))
+	ips, err = c.LookupHost(context.Background(), "printer.home.arpa.")
+	t.Ok(err)
+	t.Equals("[10.0.0.2]", fmt.Sprint(ips))
+
+	// names not in cache are asked for in all domains at once
+	done := make(chan struct{})
 	go func() {
-		queryResult, queryErr = c.Query(ctx, q)
+		ips, err = c.LookupHost(context.Background(), "nas")
+		close(done)
 	}()
+	msg := <-mt.out
+	var names []string
+	for _, q := range msg.Question {
+		names = append(names, q.Name)
+	}
+	t.Equals([]string{"nas.local.", "nas.local.", "nas.home.arpa.", "nas.home.arpa."}, names)
 
-	// retrieve questiona and compare with testdata
+	// so a later domain answering first does not win unless the earlier ones
+	// stay silent during the settle window
+	response := new(dns.Msg)
+	response.Response = true
+	response.Answer = parseRecords(t, "nas.home.arpa. 120 IN AAAA fe80::1")
+	mt.in <- &Packet{Msg: response}
+	mt.in <- &Packet{Msg: new(dns.Msg)}
+	select {
+	case <-done:
+		t.Fatal("Expected LookupHost to wait for the earlier domain")
+	default:
+	}
+	response.Answer = parseRecords(t, "nas.local. 120 IN A 10.0.0.4")
+	mt.in <- &Packet{Msg: response}
+	<-done
+	t.Ok(err)
+	t.Equals("[10.0.0.4]", fmt.Sprint(ips))
+
+	done = make(chan struct{})
+	go func() {
+		ips, err = c.LookupHost(context.Background(), "router")
+		close(done)
+	}()
+	<-mt.out
+	response.Answer = parseRecords(t, "router.home.arpa. 120 IN AAAA fe80::2")
+	mt.in <- &Packet{Msg: response}
+	mt.in <- &Packet{Msg: new(dns.Msg)}
+	clk.Add(c.SettleWindow)
+	<-done
+	t.Ok(err)
+	t.Equals("[fe80::2]", fmt.Sprint(ips))
+
+	// names ending in a dot bypass the search
+	ctx, cancel := context.WithCancel(context.Background())
+	done = make(chan struct{})
+	go func() {
+		_, err = c.LookupHost(ctx, "printer.")
+		close(done)
+	}()
 	msg = <-mt.out
-	equalsMessage(t, "question-unicast.txt", msg)
+	t.Equals(2, len(msg.Question))
+	t.Equals("printer.", msg.Question[0].Name)
+	cancel()
+	<-done
+	t.Equals(context.Canceled, err)
+}
+
+func TestCachedAnswers(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		MinTTL:    50,
+		Transport: mt,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	c.addToCache(parseRecords(t, zone))
+	clk.Add(10 * time.Second)
+
+	// without filter, the same records a query would return
+	t.EqualsTextFile("all.txt", rr2string(c.CachedAnswers("_service1._tcp.local", dns.TypePTR, nil), nil))
+
+	// only TXT records matching a pattern
+	t.EqualsTextFile("txt.txt", rr2string(c.CachedAnswers("demo._service1._tcp.local.", dns.TypeTXT, func(rr dns.RR) bool {
+		return strings.Contains(strings.Join(rr.(*dns.TXT).Txt, ""), "more")
+	}), nil))
+
+	// only addresses in a subnet, following cnames
+	_, subnet, _ := net.ParseCIDR("1.2.3.0/24")
+	inSubnet := func(rr dns.RR) bool {
+		a, ok := rr.(*dns.A)
+		return ok && subnet.Contains(a.A)
+	}
+	t.EqualsTextFile("subnet.txt", rr2string(c.CachedAnswers("praetor.epiclabs.io.", dns.TypeANY, inSubnet), nil))
+	t.Equals(0, len(c.CachedAnswers("www.epiclabs.io.", dns.TypeA, inSubnet)))
+}
+
+func TestNoFollowCNAME(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		MinTTL:    50,
+		Transport: mt,
+	})
+	t.Ok(err)
+	defer c.Close()
+	c.addToCache(parseRecords(t, zone))
+
+	question := dns.Question{Name: "praetor.epiclabs.io.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	answers, err := c.Query(context.Background(), question)
+	t.Ok(err)
+	t.Equals(2, len(answers))
+	t.Equals(dns.TypeA, answers[1].Header().Rrtype)
+
+	// the cname is returned as is, also when following SRV targets
+	c.NoFollowCNAME = true
+	answers, err = c.Query(context.Background(), question)
+	t.Ok(err)
+	t.Equals(1, len(answers))
+	t.Equals("primus.epiclabs.io.", answers[0].(*dns.CNAME).Target)
+	records := c.CachedAnswers("epic._service1._tcp.local.", dns.TypeSRV, nil)
+	t.Equals(2, len(records))
+	t.Equals(dns.TypeCNAME, records[1].Header().Rrtype)
+}
+
+func TestRecordTTL(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		MinTTL:    50,
+		Transport: mt,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	c.addToCache(parseRecords(t, zone))
+	clk.Add(10 * time.Second)
+
+	ttl, ok := c.RecordTTL("myserver.epiclabs.io", dns.TypeA, "10.10.10.10")
+	t.Assert(ok, "Expected A record to be in cache")
+	t.Equals(390*time.Second, ttl)
+
+	ttl, ok = c.RecordTTL("Epic._service1._tcp.local.", dns.TypeSRV, "1 2 7979   praetor.epiclabs.io.")
+	t.Assert(ok, "Expected SRV record to be in cache")
+	t.Equals(220*time.Second, ttl)
+
+	ttl, ok = c.RecordTTL("www.epiclabs.io.", dns.TypeCNAME, "myserver.epiclabs.io.")
+	t.Assert(ok, "Expected CNAME record to be in cache")
+	t.Equals(290*time.Second, ttl)
+
+	_, ok = c.RecordTTL("myserver.epiclabs.io.", dns.TypeA, "10.10.10.11")
+	t.Assert(!ok, "Expected unknown record not to be found")
+
+	// expired records are not found
+	clk.Add(40 * time.Second)
+	_, ok = c.RecordTTL("terminus.epiclabs.io.", dns.TypeA, "5.6.7.8")
+	t.Assert(!ok, "Expected expired record not to be found")
+}
+
+func TestGoodbye(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:            clk,
+		CachePurgePeriod: 5000 * time.Second,
+		MinTTL:           50,
+		Transport:        mt,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	c.addToCache(parseRecords(t, zone))
+
+	// goodbyes leave the records one more second in cache, and
+	// goodbyes for records we do not know are not cached
+	c.addToCache(parseRecords(t, `
+	primus.epiclabs.io			0	IN	A		1.2.3.4
+	www.epiclabs.io				0	IN CNAME	myserver.epiclabs.io.
+	unknown.epiclabs.io			0	IN	A		10.0.0.1
+	`))
+	t.EqualsTextFile("goodbye.txt", dumpCache(c))
+
+	clk.Add(goodbyeDelay)
+	c.purgeCache()
+	t.EqualsTextFile("after-delay.txt", dumpCache(c))
+}
+
+func TestExtraGoodbye(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:            clk,
+		CachePurgePeriod: 5000 * time.Second,
+		Transport:        mt,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	c.addToCache(parseRecords(t, `
+	myserver.local.		120	IN	A		10.0.0.1
+	other.local.		120	IN	A		10.0.0.2
+	`))
+
+	// a goodbye in the additional section is ignored, unlike in the answer section
+	msg := new(dns.Msg)
+	msg.Response = true
+	msg.Answer = parseRecords(t, `
+	myserver.local.		120	IN	A		10.0.0.3
+	other.local.		0	IN	A		10.0.0.2
+	`)
+	msg.Extra = parseRecords(t, "myserver.local. 0 IN A 10.0.0.1")
+	mt.in <- &Packet{Msg: msg}
+	mt.in <- &Packet{Msg: new(dns.Msg)}
+	clk.Add(goodbyeDelay)
+	c.purgeCache()
+	t.Equals("myserver.local.\t119\tIN\tA\t10.0.0.1\nmyserver.local.\t119\tIN\tA\t10.0.0.3", dumpCache(c))
+}
+
+func TestPressurePurge(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:            clk,
+		CachePurgePeriod: 5000 * time.Second,
+		CacheTargetSize:  5,
+		MinTTL:           50,
+		BrowseServices:   []string{"_service1._tcp.local"},
+		Transport:        mt,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	c.addToCache(parseRecords(t, zone))
+
+	// the records closest to expiry go first, but the browsed PTR records stay
+	c.purgeCache()
+	t.EqualsTextFile("after-purge.txt", dumpCache(c))
+}
+
+func TestPin(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:            clk,
+		CachePurgePeriod: 5000 * time.Second,
+		Transport:        mt,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	c.Pin("critical.local", dns.TypeA)
+	c.addToCache(parseRecords(t, `
+	critical.local.		10	IN	A		10.0.0.1
+	other.local.		10	IN	A		10.0.0.2
+	`))
+
+	// once expired, the pinned record stays and is asked for again
+	clk.Add(20 * time.Second)
+	c.purgeCache()
+	t.Equals("critical.local.\t0\tIN\tA\t10.0.0.1", dumpCache(c))
+	msg := <-mt.out
+	t.Equals(1, len(msg.Question))
+	t.Equals("critical.local.", msg.Question[0].Name)
+	response := new(dns.Msg)
+	response.Response = true
+	response.Answer = parseRecords(t, "critical.local. 120 IN A 10.0.0.1")
+	mt.in <- &Packet{Msg: response}
+	mt.in <- &Packet{Msg: new(dns.Msg)}
+	t.Equals("critical.local.\t120\tIN\tA\t10.0.0.1", dumpCache(c))
+	for len(c.ActiveQueries()) > 0 {
+		// let the refresh see its answer before the clock moves on
+		time.Sleep(time.Millisecond)
+	}
+
+	// pinned records are never evicted to make room
+	c.CacheTargetSize = 1
+	c.addToCache(parseRecords(t, "other.local. 300 IN A 10.0.0.2"))
+	c.purgeCache()
+	t.Equals("critical.local.\t120\tIN\tA\t10.0.0.1", dumpCache(c))
+
+	// unpinned, it goes away as usual
+	c.Unpin("critical.local.", dns.TypeA)
+	clk.Add(200 * time.Second)
+	c.purgeCache()
+	t.Equals("", dumpCache(c))
+	select {
+	case msg := <-mt.out:
+		t.Fatal("Unexpected query for unpinned record: %s", msg)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestClockJump(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(10000, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:            clk,
+		CachePurgePeriod: 5000 * time.Second,
+		MinTTL:           50,
+		Transport:        mt,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	c.addToCache(parseRecords(t, zone))
+
+	// set the clock backwards, as an NTP correction would
+	clk.Set(time.Unix(1000, 0))
+	for _, entries := range c.cache {
+		for _, entry := range entries {
+			t.Assert(entry.ttl(clk.Now()) <= 400, "Expected TTL of %s to stay within its original value", entry.rr)
+		}
+	}
+	t.EqualsTextFile("after-jump.txt", dumpCache(c))
+
+	// purging rebases expiry, so records do not outlive their TTL after the jump
+	c.purgeCache()
+	clk.Add(105 * time.Second)
+	c.purgeCache()
+	t.EqualsTextFile("after-purge.txt", dumpCache(c))
+}
+
+func TestCacheBatch(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	batches := make(chan CacheBatchEvent, 10)
+	c, err := New(&Config{
+		Clock:     clock.NewMock(time.Unix(0, 0)),
+		Transport: newMockTransport(),
+		OnCacheBatch: func(event CacheBatchEvent) {
+			batches <- event
+		},
+	})
+	t.Ok(err)
+	defer c.Close()
+	mt := c.Transport.(*mockTransport)
+
+	// all the records of a message come in a single batch
+	src := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 5353}
+	msg := new(dns.Msg)
+	msg.Response = true
+	msg.Answer = parseRecords(t, `
+	_service1._tcp.local.		200	IN	PTR		epic._service1._tcp.local.
+	epic._service1._tcp.local.	230	IN	SRV		1 2 7979 praetor.local.
+	epic._service1._tcp.local.	240	IN	TXT		"some text"
+	`)
+	msg.Extra = parseRecords(t, "praetor.local. 120 IN A 1.2.3.4")
+	mt.in <- &Packet{Msg: msg, Src: src}
+	mt.in <- &Packet{Msg: new(dns.Msg)}
+	t.Equals(1, len(batches))
+	batch := <-batches
+	t.Equals(4, len(batch.Added))
+	t.Equals(0, len(batch.Refreshed))
+	t.Equals(src, batch.Src)
+
+	// receiving them again refreshes them, along with a goodbye
+	msg.Answer = append(msg.Answer, parseRecords(t, "_service1._tcp.local. 0 IN PTR demo._service1._tcp.local.")...)
+	mt.in <- &Packet{Msg: msg, Src: src}
+	mt.in <- &Packet{Msg: new(dns.Msg)}
+	t.Equals(1, len(batches))
+	batch = <-batches
+	t.Equals(0, len(batch.Added))
+	t.Equals(4, len(batch.Refreshed))
+	t.Equals(1, len(batch.Expiring))
+	t.Equals("demo._service1._tcp.local.", batch.Expiring[0].(*dns.PTR).Ptr)
+}
+
+func TestMessageLoop(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+
+	t.Ok(err)
+	defer c.Close()
+
+	// cook some records:
+	answers := `
+	www.epiclabs.io				300	IN CNAME	myserver.epiclabs.io.
+	myserver.epiclabs.io		300	IN	A		10.10.10.10	
+	`
+	extra := `
+	demo._service1._tcp.local.	230	IN	TXT		"demo text"
+	`
+
+	// build a message with cooked records
+	var msg = new(dns.Msg)
+	msg.Answer = parseRecords(t, answers)
+	msg.Extra = parseRecords(t, extra)
+
+	// the cache-flush bit is not kept, in any section
+	for _, rr := range append(msg.Answer, msg.Extra...) {
+		rr.Header().Class |= cacheFlushBit
+	}
+
+	// simulate the above message is received
+	go func() {
+		mt.in <- &Packet{Msg: msg}
+	}()
+
+	<-c.signal.waitCh()
+
+	//check the above records entered the cache
+	t.EqualsTextFile("cache.txt", dumpCache(c))
+}
+
+func TestInject(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	src := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 5353}
+
+	// a captured response, with the cache-flush bit set, populates the cache
+	response := new(dns.Msg)
+	response.Response = true
+	response.Answer = parseRecords(t, `
+	www.epiclabs.io				300	IN CNAME	myserver.epiclabs.io.
+	myserver.epiclabs.io		300	IN	A		10.10.10.10
+	`)
+	for _, rr := range response.Answer {
+		rr.Header().Class |= cacheFlushBit
+	}
+	c.Inject(response, src)
+	t.Equals(uint16(dns.ClassINET|cacheFlushBit), response.Answer[0].Header().Class)
+	t.EqualsTextFile("cache.txt", dumpCache(c))
+
+	// captured queries are ignored
+	query := new(dns.Msg)
+	query.SetQuestion("_service1._tcp.local.", dns.TypePTR)
+	c.Inject(query, src)
+	t.EqualsTextFile("cache.txt", dumpCache(c))
+}
+
+func TestInjectWire(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	src := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 5353}
+	response := new(dns.Msg)
+	response.Response = true
+	response.Compress = true
+	response.Answer = parseRecords(t, `
+	www.epiclabs.io				300	IN CNAME	myserver.epiclabs.io.
+	myserver.epiclabs.io		300	IN	A		10.10.10.10
+	`)
+	buf, err := response.Pack()
+	t.Ok(err)
+
+	// a compression pointer pointing past the end of the packet
+	bad := append([]byte{}, buf...)
+	bad[len(bad)-15] = 0xff
+	t.MustFail(c.InjectWire(bad, src), "expected bad compression pointer to fail")
+	// record data cut short
+	t.MustFail(c.InjectWire(buf[:len(buf)-2], src), "expected truncated rdata to fail")
+	t.Equals("", dumpCache(c))
+
+	t.Ok(c.InjectWire(buf, src))
+	t.EqualsTextFile("cache.txt", dumpCache(c))
+}
+
+func TestTCPFallback(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+	me := &mockExchanger{reply: new(dns.Msg)}
+	me.reply.Response = true
+	me.reply.Answer = parseRecords(t, `
+	_service1._tcp.local.	300	IN	PTR	one._service1._tcp.local.
+	_service1._tcp.local.	300	IN	PTR	two._service1._tcp.local.
+	_service1._tcp.local.	300	IN	PTR	three._service1._tcp.local.
+	`)
+
+	c, err := New(&Config{
+		Clock:        clk,
+		Transport:    mt,
+		TCPTransport: me,
+	})
+	t.Ok(err)
+
+	query := func(service string) chan []dns.RR {
+		answers := make(chan []dns.RR, 1)
+		go func() {
+			records, err := c.Query(context.Background(), dns.Question{Name: service, Qtype: dns.TypePTR, Qclass: dns.ClassINET})
+			t.Ok(err)
+			answers <- records
+		}()
+		<-mt.out
+		return answers
+	}
+	src := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 5353}
+	truncated := func(zone string) *Packet {
+		response := new(dns.Msg)
+		response.Response = true
+		response.Truncated = true
+		response.Answer = parseRecords(t, zone)
+		return &Packet{Msg: response, Src: src}
+	}
+
+	// a truncated response makes the client ask the responder over TCP,
+	// and the query only gets the answers once they are complete
+	answers := query("_service1._tcp.local.")
+	mt.in <- truncated(`
+	_service1._tcp.local.	300	IN	PTR	one._service1._tcp.local.
+	`)
+	t.Equals(3, len(<-answers))
+	t.Equals(src, me.dst)
+	equalsMessage(t, "query.txt", me.query)
+
+	// if the responder cannot be reached over TCP, the partial answer is used
+	me.err = errors.New("Connection refused")
+	answers = query("_service2._tcp.local.")
+	mt.in <- truncated(`
+	_service2._tcp.local.	300	IN	PTR	four._service2._tcp.local.
+	`)
+	t.Equals(1, len(<-answers))
+
+	t.Ok(c.Close())
+	t.EqualsTextFile("cache.txt", dumpCache(c))
+}
+
+func TestRecordFilter(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	// only the bank's own server may speak for its name
+	bank := net.ParseIP("10.0.0.1")
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+		RecordFilter: func(rr dns.RR, src net.Addr) bool {
+			return !strings.EqualFold(rr.Header().Name, "mybank.local.") || src.(*net.UDPAddr).IP.Equal(bank)
+		},
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	response := func(record string, src string) *Packet {
+		msg := new(dns.Msg)
+		msg.Response = true
+		msg.Answer = parseRecords(t, record)
+		return &Packet{Msg: msg, Src: &net.UDPAddr{IP: net.ParseIP(src), Port: 5353}}
+	}
+
+	// a rogue responder spoofs the bank's address, along with a record of its own
+	spoofed := response(`
+	mybank.local.	120	IN	A	10.6.6.6
+	rogue.local.	120	IN	A	10.6.6.6
+	`, "10.6.6.6")
+	mt.in <- spoofed
+	mt.in <- response("mybank.local. 120 IN A 10.0.0.1", "10.0.0.1")
+	mt.in <- &Packet{Msg: new(dns.Msg)}
+	t.Equals(2, len(spoofed.Msg.Answer))
+
+	answers := c.CachedAnswers("mybank.local.", dns.TypeA, nil)
+	t.Equals(1, len(answers))
+	t.Equals("10.0.0.1", answers[0].(*dns.A).A.String())
+	t.Equals(1, len(c.CachedAnswers("rogue.local.", dns.TypeA, nil)))
+}
+
+func TestEffectiveConfig(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	c, err := New(&Config{
+		Clock:          clock.NewMock(time.Unix(0, 0)),
+		Transport:      newMockTransport(),
+		BrowseServices: []string{"_service1._tcp.local."},
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	// defaults are filled in
+	config := c.EffectiveConfig()
+	t.Equals(DefaultConfig.RetryPeriod, config.RetryPeriod)
+	t.Equals(DefaultConfig.SettleWindow, config.SettleWindow)
+	t.Equals([]string{"_service1._tcp.local."}, config.BrowseServices)
+
+	// the copy is the caller's to modify
+	config.BrowseServices[0] = "_printer._tcp.local."
+	t.Equals([]string{"_service1._tcp.local."}, c.EffectiveConfig().BrowseServices)
+
+	// and changes at runtime show up
+	t.Ok(c.Reconfigure(&Config{RetryPeriod: time.Second}))
+	t.Equals(time.Second, c.EffectiveConfig().RetryPeriod)
+}
+
+func TestReconfigure(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:          clk,
+		Transport:      mt,
+		BrowseServices: []string{"_service1._tcp.local."},
+		BrowsePeriod:   time.Minute,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	// the plumbing cannot change while running
+	err = c.Reconfigure(&Config{Clock: clock.NewMock(time.Unix(0, 0))})
+	t.MustFail(err, "Expected an error changing the clock")
+	t.Equals("Config field Clock cannot be changed at runtime", err.Error())
+	err = c.Reconfigure(&Config{RetryPeriod: -time.Second})
+	t.MustFail(err, "Expected an error setting a negative period")
+	t.Equals("Config field RetryPeriod cannot be negative", err.Error())
+
+	// the same transport and clock may be passed along when reusing a config
+	t.Ok(c.Reconfigure(&Config{
+		Clock:        clk,
+		Transport:    mt,
+		MinTTL:       500,
+		BrowsePeriod: 10 * time.Second,
+	}))
+	t.Equals(DefaultConfig.RetryPeriod, c.RetryPeriod)
+
+	// fields left unset keep their current values
+	t.Ok(c.Reconfigure(&Config{RetryPeriod: time.Second}))
+	t.Equals(time.Second, c.RetryPeriod)
+	t.Equals(uint32(500), c.MinTTL)
+	t.Equals(10*time.Second, c.BrowsePeriod)
+
+	// changes to fields that cannot be applied are not ignored
+	err = c.Reconfigure(&Config{BrowseServices: []string{"_other._tcp.local."}})
+	t.MustFail(err, "Expected an error changing the browsed services")
+	t.Equals("Config field BrowseServices cannot be changed at runtime", err.Error())
+	preserve := false
+	err = c.Reconfigure(&Config{PreserveCase: &preserve})
+	t.MustFail(err, "Expected an error changing PreserveCase")
+	t.Equals("Config field PreserveCase cannot be changed at runtime", err.Error())
+	t.Ok(c.Reconfigure(&Config{BrowseServices: []string{"_service1._tcp.local."}}))
+
+	// browsing follows the new period
+	clk.Add(10 * time.Second)
+	msg := <-mt.out
+	t.Equals("_service1._tcp.local.", msg.Question[0].Name)
+
+	// records are kept for at least the new minimum TTL
+	c.addToCache(parseRecords(t, "myserver.local. 100 IN A 10.0.0.1"))
+	ttl, ok := c.RecordTTL("myserver.local.", dns.TypeA, "10.0.0.1")
+	t.Assert(ok, "Expected the record to be cached")
+	t.Equals(500*time.Second, ttl)
+}
+
+func TestMaxStaleness(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:        clk,
+		Transport:    mt,
+		MinTTL:       3600,
+		MaxStaleness: 20 * time.Second,
+	})
+	t.Ok(err)
+
+	response := func(ip string) *Packet {
+		msg := new(dns.Msg)
+		msg.Response = true
+		msg.Answer = parseRecords(t, "myserver.local. 120 IN A "+ip)
+		return &Packet{Msg: msg}
+	}
+	question := dns.Question{Name: "myserver.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	mt.in <- response("10.0.0.1")
+	mt.in <- &Packet{Msg: new(dns.Msg)}
+
+	// recent answers are served off the cache
+	clk.Add(10 * time.Second)
+	answers, err := c.Query(context.Background(), question)
+	t.Ok(err)
+	t.Equals("10.0.0.1", answers[0].(*dns.A).A.String())
+
+	// stale ones are asked for again
+	clk.Add(20 * time.Second)
+	done := make(chan struct{})
+	go func() {
+		answers, err = c.Query(context.Background(), question)
+		close(done)
+	}()
+	<-mt.out
+	mt.in <- response("10.0.0.2")
+	<-done
+	t.Ok(err)
+	t.Equals(2, len(answers))
+
+	// or served right away while refreshed in the background
+	c.ServeStale = true
+	clk.Add(30 * time.Second)
+	answers, err = c.Query(context.Background(), question)
+	t.Ok(err)
+	t.Equals(2, len(answers))
+
+	// further reads while refreshing do not start other refreshes
+	_, err = c.Query(context.Background(), question)
+	t.Ok(err)
+	c.lock.RLock()
+	t.Equals(1, len(c.refreshes))
+	c.lock.RUnlock()
+	<-mt.out
+	mt.in <- response("10.0.0.2")
+	mt.in <- &Packet{Msg: new(dns.Msg)}
+	answers, err = c.Query(context.Background(), question)
+	t.Ok(err)
+	t.Equals(2, len(answers))
+	t.Assert(!c.isStale([]dns.Question{question}), "Expected the answers to be fresh")
+
+	// the background refresh is done, nothing else is asked
+	select {
+	case msg := <-mt.out:
+		t.Fatal("Unexpected message sent: %s", msg)
+	default:
+	}
+	t.Ok(c.Close())
+}
+
+func TestOnPacket(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+	responder := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5353}
+
+	var lock sync.Mutex
+	var observed []string
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+		OnPacket: func(msg *dns.Msg, sent bool, addr net.Addr) {
+			lock.Lock()
+			defer lock.Unlock()
+			observed = append(observed, fmt.Sprintf("sent=%t response=%t addr=%v", sent, msg.Response, addr))
+		},
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	question := dns.Question{Name: "myserver.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	done := make(chan struct{})
+	go func() {
+		_, err = c.Query(context.Background(), question)
+		close(done)
+	}()
+	<-mt.out
+	msg := new(dns.Msg)
+	msg.Response = true
+	msg.Answer = parseRecords(t, "myserver.local. 120 IN A 10.0.0.1")
+	mt.in <- &Packet{Msg: msg, Src: responder}
+	<-done
+	t.Ok(err)
+
+	lock.Lock()
+	defer lock.Unlock()
+	t.Equals([]string{
+		"sent=true response=false addr=<nil>",
+		"sent=false response=true addr=10.0.0.1:5353",
+	}, observed)
+}
+
+func TestTransportError(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	question := dns.Question{Name: "myserver.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	cause := errors.New("Network is down")
+	mt.err = cause
+	_, err = c.Query(context.Background(), question)
+	var transportErr *TransportError
+	t.Assert(errors.As(err, &transportErr), "expected a TransportError, got %v", err)
+	t.Equals(cause, errors.Unwrap(err))
+
+	// timeouts are not transport failures
+	mt.err = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		_, err = c.Query(ctx, question)
+		close(done)
+	}()
+	<-mt.out
+	cancel()
+	<-done
+	t.Assert(!errors.As(err, &transportErr), "expected no TransportError, got %v", err)
+
+	// queries also fail once the transport stops delivering packets
+	done = make(chan struct{})
+	go func() {
+		_, err = c.Query(context.Background(), question)
+		close(done)
+	}()
+	<-mt.out
+	close(mt.in)
+	<-done
+	t.Assert(errors.As(err, &transportErr), "expected a TransportError, got %v", err)
+}
+
+func TestOnIdle(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+	idle := make(chan time.Duration, 10)
+
+	c, err := New(&Config{
+		Clock:       clk,
+		Transport:   mt,
+		IdleTimeout: 10 * time.Second,
+		OnIdle: func(since time.Duration) {
+			idle <- since
+		},
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	// advance returns what OnIdle was called with, if at all, within the given time
+	advance := func(d time.Duration) (time.Duration, bool) {
+		for step := time.Second; d > 0; d -= step {
+			clk.Add(step)
+			time.Sleep(time.Millisecond)
+			select {
+			case since := <-idle:
+				return since, true
+			default:
+			}
+		}
+		return 0, false
+	}
+
+	_, ok := advance(9 * time.Second)
+	t.Assert(!ok, "expected no idle notification yet")
+	since, ok := advance(time.Second)
+	t.Assert(ok, "expected an idle notification")
+	t.Equals(10*time.Second, since)
+
+	// staying quiet does not notify again
+	_, ok = advance(30 * time.Second)
+	t.Assert(!ok, "expected a single notification per quiet stretch")
+
+	// traffic restarts the count
+	msg := new(dns.Msg)
+	msg.Response = true
+	mt.in <- &Packet{Msg: msg}
+	mt.in <- &Packet{Msg: new(dns.Msg)}
+	since, ok = advance(30 * time.Second)
+	t.Assert(ok, "expected an idle notification after traffic")
+	t.Assert(since >= 10*time.Second && since < 20*time.Second, "unexpected idle time %s", since)
+}
+
+func TestStrayRecords(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	var answers []dns.RR
+	done := make(chan struct{})
+	go func() {
+		answers, err = c.Query(context.Background(), dns.Question{Name: "www.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+		close(done)
+	}()
+	<-mt.out
+
+	// a cname alone, or records of other types, do not answer the question
+	// though they are cached
+	response := new(dns.Msg)
+	response.Response = true
+	response.Answer = parseRecords(t, `
+	www.local.			120	IN	CNAME	myserver.local.
+	myserver.local.		120	IN	TXT		"not an address"
+	`)
+	mt.in <- &Packet{Msg: response}
+	mt.in <- &Packet{Msg: new(dns.Msg)}
+	select {
+	case <-done:
+		t.Fatal("Expected the query to wait for an address record")
+	default:
+	}
+	t.Equals(2, len(strings.Split(dumpCache(c), "\n")))
+
+	// until the address of the cname target arrives
+	response.Answer = parseRecords(t, "myserver.local. 120 IN A 10.0.0.1")
+	mt.in <- &Packet{Msg: response}
+	<-done
+	t.Ok(err)
+	t.Equals(2, len(answers))
+	t.Equals(dns.TypeCNAME, answers[0].Header().Rrtype)
+	t.Equals("10.0.0.1", answers[1].(*dns.A).A.String())
+}
+
+func TestQueryInto(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	mt := newMockTransport()
+	mt.err = errors.New("Network is down")
+	c, err := New(&Config{
+		Clock:     clock.NewMock(time.Unix(0, 0)),
+		Transport: mt,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	c.addToCache(parseRecords(t, `
+	myserver.local.		120	IN	A		10.0.0.1
+	myserver.local.		120	IN	A		10.0.0.2
+	`))
+	var ips []string
+	t.Ok(c.QueryInto(context.Background(), dns.Question{Name: "myserver.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, func(rr dns.RR) {
+		ips = append(ips, rr.(*dns.A).A.String())
+	}))
+	t.Equals([]string{"10.0.0.1", "10.0.0.2"}, ips)
+
+	// errors are returned as Query does
+	err = c.QueryInto(context.Background(), dns.Question{Name: "unknown.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, func(rr dns.RR) {
+		t.Fatal("Unexpected record")
+	})
+	var transportErr *TransportError
+	t.Assert(errors.As(err, &transportErr), "Expected a transport error")
+}
+
+func TestQueryIntoAnswers(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	c, err := New(&Config{
+		Clock:     clock.NewMock(time.Unix(0, 0)),
+		Transport: newMockTransport(),
+	})
+	t.Ok(err)
+	defer c.Close()
+	c.addToCache(parseRecords(t, zone))
+
+	// the same records as Query returns are handed, cnames included
+	for _, q := range []dns.Question{
+		{Name: "_service1._tcp.local.", Qtype: dns.TypePTR, Qclass: dns.ClassINET},
+		{Name: "www.epiclabs.io.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+	} {
+		records, err := c.Query(context.Background(), q)
+		t.Ok(err)
+		var handed []dns.RR
+		t.Ok(c.QueryInto(context.Background(), q, func(rr dns.RR) {
+			handed = append(handed, dns.Copy(rr))
+		}))
+		sort.Slice(records, func(i, j int) bool { return records[i].String() < records[j].String() })
+		sort.Slice(handed, func(i, j int) bool { return handed[i].String() < handed[j].String() })
+		t.Equals(rr2string(records, nil), rr2string(handed, nil))
+	}
+}
+
+func TestQueryIntoAllocs(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	c, err := New(&Config{
+		Clock:     clock.NewMock(time.Unix(0, 0)),
+		Transport: newMockTransport(),
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	var zone strings.Builder
+	for i := 0; i < 32; i++ {
+		fmt.Fprintf(&zone, "many.local.	120	IN	A	10.0.0.%d\n", i+1)
+	}
+	c.addToCache(parseRecords(t, zone.String()+"one.local.	120	IN	A	10.0.1.1"))
+
+	allocs := func(name string, query func(dns.Question)) float64 {
+		q := dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET}
+		return testing.AllocsPerRun(100, func() { query(q) })
+	}
+	n := 0
+	into := func(q dns.Question) {
+		t.Ok(c.QueryInto(context.Background(), q, func(rr dns.RR) { n++ }))
+	}
+	query := func(q dns.Question) {
+		_, err := c.Query(context.Background(), q)
+		t.Ok(err)
+	}
+
+	// handing records in place costs the same whatever their number, unlike
+	// building the slice Query returns
+	t.Equals(allocs("one.local.", into), allocs("many.local.", into))
+	t.Assert(allocs("many.local.", into) < allocs("one.local.", query), "Expected QueryInto to allocate less than Query")
+	t.Assert(allocs("one.local.", query) < allocs("many.local.", query), "Expected Query to allocate per record")
+}
+
+func TestQueryEach(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	cached := dns.Question{Name: "myserver.local", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	srv := dns.Question{Name: "epic._service1._tcp.local.", Qtype: dns.TypeSRV, Qclass: dns.ClassINET}
+	host := dns.Question{Name: "praetor.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	c.addToCache(parseRecords(t, "myserver.local. 120 IN A 10.0.0.1"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var answers map[dns.Question][]dns.RR
+	done := make(chan struct{})
+	go func() {
+		answers, err = c.QueryEach(ctx, cached, srv, host)
+		close(done)
+	}()
+
+	// only the questions not answered off the cache are asked
+	msg := <-mt.out
+	t.Equals(2, len(msg.Question))
+	t.Equals(srv.Name, msg.Question[0].Name)
+	t.Equals(host.Name, msg.Question[1].Name)
+
+	// and once some are answered, the rest are asked again alone
+	response := new(dns.Msg)
+	response.Response = true
+	response.Answer = parseRecords(t, "epic._service1._tcp.local. 120 IN SRV 0 0 7979 praetor.local.")
+	mt.in <- &Packet{Msg: response}
+	mt.in <- &Packet{Msg: new(dns.Msg)}
+	clk.Add(c.RetryPeriod)
+	msg = <-mt.out
+	t.Equals([]dns.Question{host}, msg.Question)
+
+	// the questions left unanswered are missing from the answers
+	cancel()
+	<-done
+	t.Equals(context.Canceled, err)
+	t.Equals(2, len(answers))
+	t.Equals("10.0.0.1", answers[cached][0].(*dns.A).A.String())
+	t.Equals(uint16(7979), answers[srv][0].(*dns.SRV).Port)
+	_, ok := answers[host]
+	t.Assert(!ok, "Expected no answers for the unanswered question")
+}
+
+func TestQueryDeadline(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:       clk,
+		Transport:   mt,
+		RetryPeriod: time.Hour,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	question := dns.Question{Name: "myserver.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	c.addToCache(parseRecords(t, "cached.local. 120 IN A 10.0.0.1"))
+	answers, err := c.QueryDeadline(dns.Question{Name: "cached.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, clk.Now())
+	t.Ok(err)
+	t.Equals(1, len(answers))
+
+	// the deadline is only reached when the mock clock says so
+	done := make(chan struct{})
+	go func() {
+		_, err = c.QueryDeadline(question, clk.Now().Add(10*time.Second))
+		close(done)
+	}()
+	<-mt.out
+	clk.Add(9 * time.Second)
+	select {
+	case <-done:
+		t.Fatal("Query gave up before its deadline: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	clk.Add(time.Second)
+	<-done
+	t.Equals(context.DeadlineExceeded, err)
+}
+
+func TestAddressOrder(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+	defer c.Close()
+	c.addToCache(parseRecords(t, zone))
+
+	// primus has both an IPv4 and an IPv6 address, and the epic service runs on it
+	for _, tc := range []struct {
+		order AddressOrder
+		types []uint16
+		ips   []string
+	}{
+		{AsReceived, []uint16{dns.TypeA, dns.TypeAAAA}, []string{"1.2.3.4", "fe80::abc:cdef:123:4567"}},
+		{IPv6First, []uint16{dns.TypeAAAA, dns.TypeA}, []string{"fe80::abc:cdef:123:4567", "1.2.3.4"}},
+		{IPv4First, []uint16{dns.TypeA, dns.TypeAAAA}, []string{"1.2.3.4", "fe80::abc:cdef:123:4567"}},
+	} {
+		c.AddressOrder = tc.order
+		answers, err := c.Query(context.Background(),
+			dns.Question{Name: "primus.epiclabs.io.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+			dns.Question{Name: "primus.epiclabs.io.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET})
+		t.Ok(err)
+		var types []uint16
+		for _, rr := range answers {
+			types = append(types, rr.Header().Rrtype)
+		}
+		t.Equals(tc.types, types)
+
+		var ips []string
+		for _, entry := range c.Snapshot("_service1._tcp.local.") {
+			if entry.Instance == "epic._service1._tcp.local." {
+				for _, ip := range entry.IPs {
+					ips = append(ips, ip.String())
+				}
+			}
+		}
+		t.Equals(tc.ips, ips)
+	}
+}
+
+func TestAnswerQuestions(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+
+	t.Ok(err)
+	defer c.Close()
+
+	// prefill the cache with the zone content
+	c.addToCache(parseRecords(t, zone))
+
+	// list of questions to resolve
+	questionSets := [][]dns.Question{
+		{{Name: "www.epiclabs.io.", Qtype: dns.TypeA, Qclass: dns.ClassINET}},
+		{{Name: "_service1._tcp.local.", Qtype: dns.TypePTR, Qclass: dns.ClassINET}},
+		{{Name: "www.epiclabs.io.", Qtype: dns.TypeCNAME, Qclass: dns.ClassINET}},
+		{{Name: "www.doesnotexist.not.", Qtype: dns.TypeCNAME, Qclass: dns.ClassINET}},
+		{{Name: "www.doesnotexist.not.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}},
+	}
+
+	// invoke answerQuestions and see if questions are appropriately
+	// responded, comparing with testdata
+	for i, qs := range questionSets {
+		msg := &dns.Msg{
+			Question: qs,
+			Answer:   c.answerQuestions(qs, time.Time{}),
+		}
+		equalsMessage(t, fmt.Sprintf("set%02d.txt", i), msg)
+	}
+
+	// names without the trailing dot are answered the same
+	nonDotted := []dns.Question{{Name: "www.epiclabs.io", Qtype: dns.TypeA, Qclass: dns.ClassINET}}
+	t.Equals(c.answerQuestions(questionSets[0], time.Time{}), c.answerQuestions(nonDotted, time.Time{}))
+
+	// and asked over the network fully qualified
+	var records []dns.RR
+	done := make(chan struct{})
+	go func() {
+		records, err = c.Query(context.Background(), dns.Question{Name: "printer.local", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+		close(done)
+	}()
+	msg := <-mt.out
+	t.Equals("printer.local.", msg.Question[0].Name)
+	response := new(dns.Msg)
+	response.Response = true
+	response.Answer = parseRecords(t, "printer.local. 120 IN A 10.0.0.7")
+	mt.in <- &Packet{Msg: response}
+	<-done
+	t.Ok(err)
+	t.Equals(1, len(records))
+}
+
+func TestQuery(tx *testing.T) {
+
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:       clk,
+		Transport:   mt,
+		RetryPeriod: 500 * time.Millisecond,
+	})
+
+	t.Ok(err)
+	defer c.Close()
+
+	ctx := context.Background()
+
+	// attempt to resolve a name
+	q := dns.Question{Name: "www.epiclabs.io.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	var queryErr error
+	var queryResult []dns.RR
+
+	// launch the query
+	go func() {
+		queryResult, queryErr = c.Query(ctx, q)
+		wg.Done()
+	}()
+
+	// since the requested info is not in cache, we expect that a question
+	// message comes out over the transport
+	msg := <-mt.out
+	equalsMessage(t, "question1.txt", msg) // check message against testdata
+
+	// if time passes without an answer, a retransmit must be sent
+	clk.Add(c.RetryPeriod)
+	msg2 := <-mt.out
+	equalsMessage(t, "question1-retransmit.txt", msg2) // the retransmit asks for multicast responses
+	t.Equals(msg.Id, msg2.Id)
+
+	// cook an answer message to the question
+	answerMsg := new(dns.Msg).SetReply(msg)
+	answerMsg.Answer = parseRecords(t, `
+	www.epiclabs.io				300	IN CNAME	myserver.epiclabs.io.
+	myserver.epiclabs.io		300	IN	A		10.10.10.10	
+	`)
+
+	mt.in <- &Packet{Msg: answerMsg}                             //respond the question via the transport
+	wg.Wait()                                                    // wait for the Query() call to complete
+	t.Ok(queryErr)                                               // verify it went well
+	t.EqualsTextFile("answer1.txt", rr2string(queryResult, nil)) //check answer against testdata
+
+	// test query again to trigger cache
+	queryResult2, err := c.Query(ctx, q)
+	t.Ok(err)
+	t.Equals(queryResult, queryResult2)
+
+	// test context cancellation
+	// first clear the cache by elapsing time
+	clk.Add(500 * time.Hour)
+	c.purgeCache()
+
+	ctx2, cancel := context.WithCancel(context.Background())
+	wg.Add(1)
+	go func() {
+		queryResult, queryErr = c.Query(ctx2, q)
+		wg.Done()
+	}()
+
+	// read the outgoing mdns query and ignore it
+	msg = <-mt.out
+
+	//cancel context
+	cancel()
+	wg.Wait()
+	t.MustFail(queryErr, "Expected to have an error when context is cancelled")
+
+	// query again, forcing unicast responses:
+	c.ForceUnicastResponses = true
+
+	go func() {
+		queryResult, queryErr = c.Query(ctx, q)
+	}()
+
+	// retrieve questiona and compare with testdata
+	msg = <-mt.out
+	equalsMessage(t, "question-unicast.txt", msg)
+}
+
+func TestRand(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+		Rand:      bytes.NewReader([]byte{0x12, 0x34, 0x56, 0x78}),
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	// message IDs come from the configured source of randomness
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Query(ctx, dns.Question{Name: "www.epiclabs.io.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	t.Equals(uint16(0x1234), (<-mt.out).Id)
+	go c.serviceQuery("_service1._tcp.local")
+	t.Equals(uint16(0x5678), (<-mt.out).Id)
+}
+
+func TestQueryFresh(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+
+	t.Ok(err)
+	defer c.Close()
+
+	// prefill the cache with the zone content
+	c.addToCache(parseRecords(t, zone))
+	clk.Add(10 * time.Second)
+
+	q := dns.Question{Name: "www.epiclabs.io.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	var queryErr error
+	var queryResult []dns.RR
+
+	go func() {
+		queryResult, queryErr = c.QueryFresh(context.Background(), q)
+		wg.Done()
+	}()
+
+	// despite the answer being in cache, the question must go out
+	msg := <-mt.out
+	equalsMessage(t, "question.txt", msg)
+
+	// a retransmit does not make the cached answer valid
+	clk.Add(c.RetryPeriod)
+	<-mt.out
+
+	answerMsg := new(dns.Msg).SetReply(msg)
+	answerMsg.Answer = parseRecords(t, `
+	www.epiclabs.io				300	IN CNAME	myserver.epiclabs.io.
+	myserver.epiclabs.io		300	IN	A		10.10.10.20
+	`)
+	mt.in <- &Packet{Msg: answerMsg}
+	wg.Wait()
+	t.Ok(queryErr)
+	t.EqualsTextFile("answer.txt", rr2string(queryResult, nil))
+
+	// the fresh answer made it to the cache
+	t.EqualsTextFile("cache.txt", dumpCache(c))
+}
+
+func TestUncommonTypes(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+
+	t.Ok(err)
+	defer c.Close()
+
+	// prefill the cache with records whose type is not handled specially,
+	// including one unknown to the DNS library
+	c.addToCache(parseRecords(t, `
+	device.local.	120	IN	HINFO	"ARMv7" "Linux"
+	device.local.	120	IN	LOC		52 22 23.000 N 4 53 32.000 E -2.00m 0.00m 10000m 10m
+	device.local.	120	IN	TYPE65280	\# 4 0a000001
+	device.local.	120	IN	A		10.0.0.1
+	`))
+
+	questionSets := [][]dns.Question{
+		{{Name: "device.local.", Qtype: dns.TypeHINFO, Qclass: dns.ClassINET}},
+		{{Name: "device.local.", Qtype: dns.TypeLOC, Qclass: dns.ClassINET}},
+		{{Name: "device.local.", Qtype: 65280, Qclass: dns.ClassINET}},
+		{{Name: "device.local.", Qtype: dns.TypeANY, Qclass: dns.ClassINET}},
+	}
+
+	for i, qs := range questionSets {
+		// all of them resolve off the cache, without network traffic
+		answers, err := c.Query(context.Background(), qs...)
+		t.Ok(err)
+		equalsMessage(t, fmt.Sprintf("set%02d.txt", i), &dns.Msg{
+			Question: qs,
+			Answer:   answers,
+		})
+	}
+}
+
+func TestPassiveGrace(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:        clk,
+		Transport:    mt,
+		PassiveGrace: 2 * time.Second,
+	})
+
+	t.Ok(err)
+	defer c.Close()
+
+	q := dns.Question{Name: "www.epiclabs.io.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	done := make(chan struct{})
+	var queryErr error
+	var queryResult []dns.RR
+	go func() {
+		queryResult, queryErr = c.Query(context.Background(), q)
+		close(done)
+	}()
+
+	// an answer prompted by someone else arrives during the grace period
+	answerMsg := new(dns.Msg)
+	answerMsg.Response = true
+	answerMsg.Answer = parseRecords(t, `
+	www.epiclabs.io				300	IN CNAME	myserver.epiclabs.io.
+	myserver.epiclabs.io		300	IN	A		10.10.10.10
+	`)
+	mt.in <- &Packet{Msg: answerMsg}
+
+	// the query must complete without transmitting anything
+	select {
+	case <-done:
+	case <-mt.out:
+		t.Fatal("Expected no question to be sent during the grace period")
+	}
+	t.Ok(queryErr)
+	t.EqualsTextFile("answer.txt", rr2string(queryResult, nil))
+
+	// if nothing arrives passively, the question goes out
+	// only once the grace period elapses
+	q.Name = "myserver2.epiclabs.io."
+	start := clk.Now()
+	go c.Query(context.Background(), q)
+	var msg *dns.Msg
+	for msg == nil {
+		select {
+		case msg = <-mt.out:
+		default:
+			clk.Add(100 * time.Millisecond)
+			time.Sleep(time.Millisecond)
+		}
+	}
+	t.Assert(clk.Since(start) >= c.PassiveGrace, "Expected question to be sent after the grace period")
+	t.Equals(q.Name, msg.Question[0].Name)
+}
+
+func TestResolveOnInterface(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+
+	t.Ok(err)
+	defer c.Close()
+
+	// the same name resolves differently on two network segments
+	c.addToCacheFrom(parseRecords(t, `
+	www.epiclabs.io				300	IN CNAME	myserver.epiclabs.io.
+	myserver.epiclabs.io		300	IN	A		10.10.10.10
+	`), nil, "eth0")
+	c.addToCacheFrom(parseRecords(t, `
+	myserver.epiclabs.io		300	IN	A		192.168.1.10
+	`), nil, "eth1")
+
+	records, err := c.ResolveOnInterface(context.Background(), "www.epiclabs.io", "eth0")
+	t.Ok(err)
+	t.EqualsTextFile("eth0.txt", rr2string(records, nil))
+
+	records, err = c.ResolveOnInterface(context.Background(), "myserver.epiclabs.io", "eth1")
+	t.Ok(err)
+	t.EqualsTextFile("eth1.txt", rr2string(records, nil))
+
+	// the cname was not seen on eth1, so the question must go out on that interface only
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.ResolveOnInterface(ctx, "www.epiclabs.io", "eth1")
+	msg := <-mt.out
+	t.Equals("eth1", mt.iface)
+	t.Equals(2, len(msg.Question))
+	t.Equals("www.epiclabs.io.", msg.Question[0].Name)
+}
+
+func TestPreserveCase(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+
+	t.Ok(err)
+	defer c.Close()
+
+	// the cache matches names regardless of case
+	c.addToCache(parseRecords(t, `
+	WWW.EpicLabs.io				300	IN CNAME	MyServer.epiclabs.io.
+	myserver.EPICLABS.io		300	IN	A		10.10.10.10
+	`))
+	q := dns.Question{Name: "www.epiclabs.io.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	// by default, records keep the case they were received with
+	records, err := c.Query(context.Background(), q)
+	t.Ok(err)
+	t.EqualsTextFile("preserved.txt", rr2string(records, nil))
+
+	preserve := false
+	c.PreserveCase = &preserve
+	records, err = c.Query(context.Background(), q)
+	t.Ok(err)
+	t.EqualsTextFile("normalized.txt", rr2string(records, nil))
+}
+
+func TestMaxAnswers(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	mt := newMockTransport()
+	c, err := New(&Config{
+		Clock:      clock.NewMock(time.Unix(0, 0)),
+		Transport:  mt,
+		MaxAnswers: 5,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	response := new(dns.Msg)
+	response.Response = true
+	for i := 0; i < 20; i++ {
+		response.Answer = append(response.Answer, parseRecords(t, fmt.Sprintf(
+			"_service1._tcp.local. 4500 IN PTR instance%d._service1._tcp.local.", i))...)
+	}
+	mt.in <- &Packet{Msg: response}
+	mt.in <- &Packet{Msg: new(dns.Msg)}
+
+	q := dns.Question{Name: "_service1._tcp.local.", Qtype: dns.TypePTR, Qclass: dns.ClassINET}
+	records, err := c.Query(context.Background(), q)
+	t.Equals(ErrTruncated, err)
+	t.Equals(5, len(records))
+
+	// queries with fewer answers than the cap are not truncated
+	c.MaxAnswers = 20
+	records, err = c.Query(context.Background(), q)
+	t.Ok(err)
+	t.Equals(20, len(records))
+}
+
+func TestQueryTo(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	c.addToCache(parseRecords(t, "myserver.local. 120 IN A 10.0.0.1"))
+	clk.Add(time.Second)
+
+	gateway := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 254), Port: mDNSPort}
+	q := dns.Question{Name: "myserver.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	var records []dns.RR
+	done := make(chan struct{})
+	go func() {
+		records, err = c.QueryTo(context.Background(), gateway, q)
+		close(done)
+	}()
+
+	// the question goes to the given responder, cached answers notwithstanding,
+	// retransmissions too
+	<-mt.out
+	t.Equals(gateway, mt.dst)
+	clk.Add(c.RetryPeriod)
+	<-mt.out
+	t.Equals(gateway, mt.dst)
+
+	// answers multicast by another responder are accepted
+	response := new(dns.Msg)
+	response.Response = true
+	response.Answer = parseRecords(t, "myserver.local. 120 IN A 10.0.0.2")
+	mt.in <- &Packet{Msg: response, Src: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: mDNSPort}}
+	<-done
+	t.Ok(err)
+	t.Equals(2, len(records))
+}
+
+func TestQueryFirst(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	mt := newMockTransport()
+	c, err := New(&Config{
+		Clock:     clock.NewMock(time.Unix(0, 0)),
+		Transport: mt,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	var first dns.RR
+	done := make(chan struct{})
+	go func() {
+		first, err = c.QueryFirst(context.Background(), dns.Question{Name: "_printer._tcp.local.", Qtype: dns.TypePTR, Qclass: dns.ClassINET})
+		close(done)
+	}()
+	<-mt.out
+
+	// the first response answers, whatever else others may have
+	response := new(dns.Msg)
+	response.Response = true
+	response.Answer = parseRecords(t, `
+	_printer._tcp.local.	4500	IN	PTR		laser._printer._tcp.local.
+	_printer._tcp.local.	4500	IN	PTR		inkjet._printer._tcp.local.
+	laser._printer._tcp.local.	120	IN	SRV		0 0 515 laser.local.
+	`)
+	mt.in <- &Packet{Msg: response}
+	<-done
+	t.Ok(err)
+	t.Equals(uint16(dns.TypePTR), first.Header().Rrtype)
+
+	// the whole response is cached
+	t.Equals(2, len(c.CachedAnswers("_printer._tcp.local.", dns.TypePTR, func(rr dns.RR) bool {
+		return rr.Header().Rrtype == dns.TypePTR
+	})))
+	t.Equals(1, len(c.CachedAnswers("laser._printer._tcp.local.", dns.TypeSRV, nil)))
+}
+
+func TestRejectTTLAbove(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	mt := newMockTransport()
+	c, err := New(&Config{
+		Clock:          clock.NewMock(time.Unix(0, 0)),
+		Transport:      mt,
+		RejectTTLAbove: 24 * 3600,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	response := new(dns.Msg)
+	response.Response = true
+	response.Answer = parseRecords(t, `
+	myserver.local.		4294967295	IN	A		10.0.0.66
+	myserver.local.		86400		IN	A		10.0.0.1
+	`)
+	mt.in <- &Packet{Msg: response}
+	mt.in <- &Packet{Msg: new(dns.Msg)}
+
+	// the record with the absurd TTL is not cached at all
+	t.Equals("myserver.local.\t86400\tIN\tA\t10.0.0.1", dumpCache(c))
+}
+
+func TestBrowseSpecs(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:        clk,
+		Transport:    mt,
+		BrowsePeriod: 30 * time.Second,
+		BrowseSpecs: []BrowseSpec{
+			{Service: "_presence._tcp.local.", Period: 10 * time.Second},
+			{Service: "_printer._tcp.local."},
+		},
+	})
+	t.Ok(err)
+	defer c.Close()
+	t.Equals([]string{"_presence._tcp.local.", "_printer._tcp.local."}, c.ActiveBrowses())
+
+	// each service is browsed on its own period
+	queries := make(map[string]int)
+	for i := 1; i <= 6; i++ {
+		clk.Add(10 * time.Second)
+		expected := 1
+		if i%3 == 0 {
+			expected++
+		}
+		for j := 0; j < expected; j++ {
+			queries[(<-mt.out).Question[0].Name]++
+		}
+	}
+	t.Equals(map[string]int{"_presence._tcp.local.": 6, "_printer._tcp.local.": 2}, queries)
+}
+
+func TestReconnect(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	reconnects := make(chan struct{}, 1)
+	c, err := New(&Config{
+		Clock:          clk,
+		Transport:      mt,
+		BrowseServices: []string{"_service1._tcp.local."},
+		OnReconnect:    func() { reconnects <- struct{}{} },
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	c.addToCache(parseRecords(t, `
+	_service1._tcp.local.	4500	IN	PTR		gone._service1._tcp.local.
+	_service1._tcp.local.	4500	IN	PTR		epic._service1._tcp.local.
+	critical.local.		120	IN	A		10.0.0.1
+	`))
+	c.Pin("critical.local.", dns.TypeA)
+	clk.Add(time.Second)
+
+	// once reconnected, browses go out again right away
+	mt.reconnects <- struct{}{}
+	<-reconnects
+	msg := <-mt.out
+	t.Equals("_service1._tcp.local.", msg.Question[0].Name)
+
+	// and the records that are not received again within the grace period go away
+	clk.Add(time.Second)
+	response := new(dns.Msg)
+	response.Response = true
+	response.Answer = parseRecords(t, "_service1._tcp.local. 4500 IN PTR epic._service1._tcp.local.")
+	mt.in <- &Packet{Msg: response}
+	mt.in <- &Packet{Msg: new(dns.Msg)}
+	t.Equals(3, strings.Count(dumpCache(c), "\n")+1)
+	for strings.Contains(dumpCache(c), "gone.") {
+		clk.Add(reconnectGrace)
+		time.Sleep(time.Millisecond)
+	}
+	t.Equals(2, strings.Count(dumpCache(c), "\n")+1)
+	t.Assert(strings.Contains(dumpCache(c), "critical.local."), "Expected the pinned record to stay")
+}
+
+func TestCacheFlush(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	flush := func(records string) {
+		response := new(dns.Msg)
+		response.Response = true
+		response.Answer = parseRecords(t, records)
+		for _, rr := range response.Answer {
+			rr.Header().Class |= cacheFlushBit
+		}
+		mt.in <- &Packet{Msg: response}
+		mt.in <- &Packet{Msg: new(dns.Msg)}
+	}
+
+	flush(`myserver.local.	120	IN	A	10.0.0.1`)
+
+	// records received within the last second are part of the same set
+	clk.Add(500 * time.Millisecond)
+	flush(`myserver.local.	120	IN	A	10.0.0.2`)
+	t.Equals("myserver.local.\t119\tIN\tA\t10.0.0.1\nmyserver.local.\t120\tIN\tA\t10.0.0.2", dumpCache(c))
+
+	// older ones are flushed, one second later
+	clk.Add(1500 * time.Millisecond)
+	flush(`myserver.local.	120	IN	A	10.0.0.3`)
+	t.Equals("myserver.local.\t1\tIN\tA\t10.0.0.1\nmyserver.local.\t1\tIN\tA\t10.0.0.2\nmyserver.local.\t120\tIN\tA\t10.0.0.3", dumpCache(c))
+
+	clk.Add(time.Second)
+	c.purgeCache()
+	t.Equals("myserver.local.\t119\tIN\tA\t10.0.0.3", dumpCache(c))
+}
+
+func TestIgnoreCacheTypes(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	mt := newMockTransport()
+	c, err := New(&Config{
+		Clock:            clock.NewMock(time.Unix(0, 0)),
+		Transport:        mt,
+		IgnoreCacheTypes: []uint16{dns.TypeTXT},
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	response := new(dns.Msg)
+	response.Response = true
+	response.Answer = parseRecords(t, `
+	epic._service1._tcp.local.	230	IN	SRV		1 2 7979 praetor.epiclabs.io.
+	epic._service1._tcp.local.	240	IN	TXT		"some text"
+	`)
+	mt.in <- &Packet{Msg: response}
+	mt.in <- &Packet{Msg: new(dns.Msg)}
+
+	// the TXT record is not cached
+	t.Equals("epic._service1._tcp.local.\t230\tIN\tSRV\t1 2 7979 praetor.epiclabs.io.", dumpCache(c))
+
+	// but it still answers a query asking for it
+	var answers []dns.RR
+	done := make(chan struct{})
+	go func() {
+		answers, err = c.Query(context.Background(), dns.Question{Name: "epic._service1._tcp.local.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET})
+		close(done)
+	}()
+	<-mt.out
+	mt.in <- &Packet{Msg: response}
+	<-done
+	t.Ok(err)
+	t.Equals("epic._service1._tcp.local.\t240\tIN\tTXT\t\"some text\"", rr2string(answers, nil))
+
+	// and is dropped once the query is done
+	t.Equals("epic._service1._tcp.local.\t230\tIN\tSRV\t1 2 7979 praetor.epiclabs.io.", dumpCache(c))
+}
+
+func TestReceiveWorkers(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	mt := newMockTransport()
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	batches := make(chan CacheBatchEvent, 8)
+	var once sync.Once
+	c, err := New(&Config{
+		Clock:            clock.NewMock(time.Unix(0, 0)),
+		Transport:        mt,
+		ReceiveWorkers:   1,
+		ReceiveQueueSize: 4,
+		RecordFilter: func(rr dns.RR, src net.Addr) bool {
+			// the first packet takes long to process
+			once.Do(func() {
+				close(entered)
+				<-release
+			})
+			return true
+		},
+		OnCacheBatch: func(batch CacheBatchEvent) {
+			batches <- batch
+		},
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	packet := func(i int) *Packet {
+		response := new(dns.Msg)
+		response.Response = true
+		response.Answer = parseRecords(t, fmt.Sprintf("host%d.local. 120 IN A 10.0.0.%d", i, i))
+		return &Packet{Msg: response}
+	}
+	mt.in <- packet(0)
+	<-entered
+
+	// packets keep being received meanwhile, up to the queue size
+	for i := 1; i <= 4; i++ {
+		mt.in <- packet(i)
+	}
+	// beyond which they are dropped
+	mt.in <- packet(5)
+	mt.in <- &Packet{Msg: new(dns.Msg)}
+
+	close(release)
+	for i := 0; i <= 4; i++ {
+		batch := <-batches
+		t.Equals(fmt.Sprintf("host%d.local.", i), batch.Added[0].Header().Name)
+	}
+	select {
+	case batch := <-batches:
+		t.Fatalf("Unexpected batch for a dropped packet: %v", batch.Added)
+	default:
+	}
+}
+
+func TestMetricsSnapshot(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	question := dns.Question{Name: "praetor.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	response := new(dns.Msg)
+	response.Response = true
+	response.Answer = parseRecords(t, `
+	praetor.local.	120	IN	A	10.20.30.40
+	`)
+
+	// the first query misses the cache and is asked over the network
+	done := make(chan struct{})
+	go func() {
+		_, err = c.Query(context.Background(), question)
+		close(done)
+	}()
+	<-mt.out
+	mt.in <- &Packet{Msg: response}
+	<-done
+	t.Ok(err)
+
+	// the second one is answered off the cache
+	_, err = c.Query(context.Background(), question)
+	t.Ok(err)
+
+	// and a new address with the cache-flush bit flushes the old one
+	clk.Add(1500 * time.Millisecond)
+	response.Answer = parseRecords(t, `
+	praetor.local.	120	IN	A	10.20.30.41
+	`)
+	response.Answer[0].Header().Class |= cacheFlushBit
+	mt.in <- &Packet{Msg: response}
+	mt.in <- &Packet{Msg: new(dns.Msg)}
+
+	t.Equals(Metrics{
+		QueriesSent:     1,
+		AnswersReceived: 2,
+		CacheHits:       1,
+		CacheMisses:     1,
+		Flushes:         1,
+	}, c.MetricsSnapshot())
 }
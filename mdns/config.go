@@ -1,6 +1,8 @@
 package mdns
 
 import (
+	"crypto/rand"
+	"io"
 	"net"
 	"time"
 
@@ -10,16 +12,52 @@ import (
 
 // Config contains the configuration of the mDNS client
 type Config struct {
-	ForceUnicastResponses bool          // whether to force unicast according to RFC 6762, section 18.12.
-	BindIPAddressV4       net.IP        // IPv4 interface to bind to
-	BindIPAddressV6       net.IP        // IPv6 interface to bind to
-	MinTTL                uint32        // minimum TTL to keep records for, overriding mDNS response
-	BrowseServices        []string      // List of services to scan and keep updated
-	BrowsePeriod          time.Duration // How often scan the list of services
-	CachePurgePeriod      time.Duration // How often clean the cache for stale records
-	RetryPeriod           time.Duration // How often retry mDNS queries
-	Transport             transport     // Network transport. Defaults to UDP. Useful for testing
-	Clock                 clock.Clock   // Time reference. Defaults to system time. Useful for testing
+	ForceUnicastResponses   bool          // whether to force unicast according to RFC 6762, section 18.12.
+	ForceMulticastResponses bool          // whether the responder answers every query via multicast, ignoring the unicast-response bit and legacy queriers, so that answers are observable on the network
+	BindIPAddressV4         net.IP        // IPv4 interface to bind to
+	BindIPAddressV6         net.IP        // IPv6 interface to bind to
+	MinTTL                  uint32        // minimum TTL to keep records for, overriding mDNS response
+	RejectTTLAbove          uint32        // If not zero, received records with a TTL above this are dropped as suspicious rather than cached
+	IgnoreCacheTypes        []uint16      // Record types never kept in cache, e.g. dns.TypeTXT on constrained devices. Records of these types answering a query in progress are still returned to it, and dropped once it is done
+	BrowseServices          []string      // List of services to scan and keep updated
+	BrowseSpecs             []BrowseSpec  // Further services to scan and keep updated, each on its own period
+	ProactiveResolve        bool          // Whether to ask for the SRV, TXT and address records of newly seen instances of browsed services that responders left out
+	SearchDomains           []string      // Domains to try, in order, when looking up host names without dots with LookupHost
+	BrowsePeriod            time.Duration // How often scan the list of services
+	CachePurgePeriod        time.Duration // How often clean the cache for stale records
+	CacheTargetSize         int           // If not zero, purging also evicts the records closest to expiry until the cache holds at most this many
+	RetryPeriod             time.Duration // How often retry mDNS queries
+	MaxAnswers              int           // If not zero, how many records Query, and how many instances Browse, return at most, along with ErrTruncated if there are more
+	MaxConcurrentQueries    int           // If not zero, how many queries can be transmitting at once. Further queries wait for one of them to finish
+	ReceiveWorkers          int           // If not zero, how many received packets are processed at once, so that a slow one does not hold up those behind it. By default, packets are processed one at a time, in order
+	ReceiveQueueSize        int           // How many received packets wait at most for one of the ReceiveWorkers to be free. Further ones are dropped. Defaults to 64
+	PassiveGrace            time.Duration // How long to wait for answers to show up in cache before asking over the network. Defaults to 0
+	MaxStaleness            time.Duration // If not zero, cached answers last received longer ago than this are asked for again
+	ServeStale              bool          // whether to return answers older than MaxStaleness right away while asking for fresh ones in the background
+	SettleWindow            time.Duration // How long ResolveAll collects answers from responders, and LookupHost waits for earlier SearchDomains to answer
+	MaxSourcesPerRecord     int           // If not zero, how many distinct responders ResolveAll and Discover keep answers from per record name and type. The answers of the first one are dropped to make room for others
+	ResolveTimeout          time.Duration // If not zero, browsed instances that cannot be resolved for this long are returned as incomplete entries
+	NoFollowCNAME           bool          // whether to answer queries for names that are cnames with the CNAME record itself, instead of following it to the records of its target
+	PreserveCase            *bool         // whether owner names of returned records keep the case as received, the default if nil, or are lowercased if false
+	PartialAnswers          bool          // whether to answer for registered services whose host has no registered addresses
+	RotateAddresses         bool          // whether to rotate the order of returned address records on every call, to spread load
+	AddressOrder            AddressOrder  // Order of IPv4 and IPv6 addresses in returned records and service entries. Defaults to AsReceived
+	SortByPriority          bool          // whether to sort browsed service instances by SRV priority and then weight, instead of by instance name
+	AllowDebugDump          bool          // whether to answer queries for _epicmdns-debug._udp.local. TXT with a summary of registrations, sent to the querier only. For diagnostics only
+	RecordFilter            RecordFilter  // If set, called for every received record. Records it rejects are dropped before caching
+	IdleTimeout             time.Duration // How long without packets sent or received before calling OnIdle
+	OnIdle                  IdleFunc      // If set, along with IdleTimeout, called when the network goes quiet
+	OnReconnect             ReconnectFunc // If set, called when the transport reports it reconnected, before records cached until then are asked for again and, unless received within a few seconds, evicted
+	RenameFormat            RenameFunc    // If set, builds the instance name to try when the name of a registered service is found in use while probing. Defaults to "<base> (<n>)"
+	OnAddressConflict       ConflictFunc  // If set, called when another host answers for the host name of a registered service with an address that is not ours
+	OnCacheBatch            BatchFunc     // If set, called once per received message that changes the cache, with all the changes, after the message is processed
+	OnRenamed               RenamedFunc   // If set, called when an instance goes away and another one of the same service shows up on the same host and port shortly before or after, as responders renaming after a name conflict do
+	OnPacket                PacketFunc    // If set, called with every packet sent and received, before it is sent or processed. For debugging
+	LogSampleRate           int           // If above 1, only one in every LogSampleRate errors handling received packets, e.g. failing to send responses, is logged
+	Transport               Transport     // Network transport. Defaults to UDP. Useful for testing
+	TCPTransport            Exchanger     // If set, used to fetch the complete answer set from responders that send truncated responses
+	Clock                   clock.Clock   // Time reference. Defaults to system time. Useful for testing
+	Rand                    io.Reader     // Source of randomness, e.g. for message IDs. Defaults to crypto/rand. Useful for testing
 }
 
 // DefaultConfig represents the defaut mDNS config
@@ -29,12 +67,20 @@ var DefaultConfig = &Config{
 	BrowsePeriod:          60 * time.Second,
 	CachePurgePeriod:      300 * time.Second,
 	RetryPeriod:           250 * time.Millisecond,
+	SettleWindow:          time.Second,
 	Transport:             nil,
 	Clock:                 clock.Realtime(),
+	Rand:                  rand.Reader,
 	BindIPAddressV4:       net.IPv4zero,
 	BindIPAddressV6:       net.IPv6zero,
 }
 
+// preserveCase returns whether owner names of returned records keep the case
+// as received, as they do unless PreserveCase is set to false
+func (config *Config) preserveCase() bool {
+	return config.PreserveCase == nil || *config.PreserveCase
+}
+
 // ApplyDefaults fills the missing fields with sane default values
 func (config *Config) ApplyDefaults() error {
 	if config.BindIPAddressV4 == nil {
@@ -56,6 +102,9 @@ func (config *Config) ApplyDefaults() error {
 	if config.Clock == nil {
 		config.Clock = DefaultConfig.Clock
 	}
+	if config.Rand == nil {
+		config.Rand = DefaultConfig.Rand
+	}
 	if config.CachePurgePeriod == 0 {
 		config.CachePurgePeriod = DefaultConfig.CachePurgePeriod
 	}
@@ -65,5 +114,8 @@ func (config *Config) ApplyDefaults() error {
 	if config.RetryPeriod == 0*time.Millisecond {
 		config.RetryPeriod = DefaultConfig.RetryPeriod
 	}
+	if config.SettleWindow == 0 {
+		config.SettleWindow = DefaultConfig.SettleWindow
+	}
 	return nil
 }
@@ -0,0 +1,70 @@
+package mdns
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// debugDumpName is the query name answered with a summary of the
+// registrations when AllowDebugDump is set. This is not standard mDNS.
+const debugDumpName = "_epicmdns-debug._udp.local."
+
+// sendDebugDump answers a query for debugDumpName with a unicast response to the
+// querier only, echoing its ID and questions. The dump is never multicast, so
+// the rest of the link does not get to see it.
+func (c *Client) sendDebugDump(query *dns.Msg, dst net.Addr) {
+	dump := c.debugAnswers(query.Question)
+	if len(dump) == 0 {
+		return
+	}
+	msg := newResponse()
+	msg.Id = query.Id
+	msg.Question = query.Question
+	msg.Answer = dump
+	if err := c.send(msg, dst); err != nil {
+		c.logSampled("error: %s", err)
+	}
+}
+
+// debugAnswers returns a TXT record summarizing the registrations, one string
+// per service instance, if any of the questions asks for debugDumpName
+func (c *Client) debugAnswers(questions []dns.Question) []dns.RR {
+	asked := false
+	for _, q := range questions {
+		if strings.EqualFold(q.Name, debugDumpName) && (q.Qtype == dns.TypeTXT || q.Qtype == dns.TypeANY) {
+			asked = true
+		}
+	}
+	if !asked {
+		return nil
+	}
+
+	c.lock.RLock()
+	txt := make([]string, 0, len(c.registrations))
+	for _, r := range c.registrations {
+		state := "announced"
+		if r.probing {
+			state = "probing"
+		}
+		entry := fmt.Sprintf("%s host=%s port=%d state=%s", r.service.instanceName(), r.service.hostName(), r.service.Port, state)
+		if len(entry) > maxTXTStringSize {
+			entry = entry[:maxTXTStringSize]
+		}
+		txt = append(txt, entry)
+	}
+	c.lock.RUnlock()
+
+	sort.Strings(txt)
+	if len(txt) == 0 {
+		txt = []string{""}
+	}
+	// the dump reflects the current state, so it must not be cached for long
+	return []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{Name: debugDumpName, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 1},
+		Txt: txt,
+	}}
+}
@@ -0,0 +1,135 @@
+package mdns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RFC 8305, section 5: Starting a new connection attempt does not affect
+// previous attempts [...]. A simple implementation can have a fixed delay for
+// how long to wait before starting the next connection attempt. This delay is
+// referred to as the "Connection Attempt Delay". [...] The recommended value
+// for a default delay is 250 milliseconds.
+const connectionAttemptDelay = 250 * time.Millisecond
+
+// DialService resolves the given fully qualified service instance, as Resolve
+// does, and connects to it over the given network, e.g. "tcp", on the port of
+// its SRV record. Addresses are tried in turn, as ordered by AddressOrder, each
+// given connectionAttemptDelay before the next is tried alongside it, as per
+// Happy Eyeballs (RFC 8305), and the first connection established wins. If none
+// can be, the cached records may be stale, e.g. the instance moved to another
+// address, so the SRV and address records tried are evicted and the instance is
+// resolved again, over the network, for a second and last round of attempts.
+func (c *Client) DialService(ctx context.Context, instance, network string) (net.Conn, error) {
+	for retried := false; ; retried = true {
+		entry, err := c.Resolve(ctx, instance)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := c.dialEntry(ctx, network, entry)
+		if err == nil || retried || ctx.Err() != nil {
+			return conn, err
+		}
+		c.evictEntry(entry)
+	}
+}
+
+// dialEntry connects to the first of the addresses of the given service entry
+// to accept a connection, racing them as per RFC 8305
+func (c *Client) dialEntry(ctx context.Context, network string, entry ServiceEntry) (net.Conn, error) {
+	if len(entry.IPs) == 0 {
+		return nil, fmt.Errorf("No addresses to connect to service instance %q", entry.Instance)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type attempt struct {
+		conn net.Conn
+		err  error
+	}
+	attempts := make(chan attempt, len(entry.IPs))
+	port := strconv.Itoa(int(entry.Port))
+	next, pending := 0, 0
+	var delay <-chan time.Time
+	start := func() {
+		addr := net.JoinHostPort(entry.IPs[next].String(), port)
+		next++
+		pending++
+		delay = nil
+		if next < len(entry.IPs) {
+			delay = c.Clock.After(connectionAttemptDelay)
+		}
+		go func() {
+			var dialer net.Dialer
+			conn, err := dialer.DialContext(ctx, network, addr)
+			attempts <- attempt{conn: conn, err: err}
+		}()
+	}
+
+	start()
+	var lastErr error
+	for pending > 0 {
+		select {
+		case <-delay:
+			start()
+		case a := <-attempts:
+			pending--
+			if a.err == nil {
+				// attempts still in flight are cancelled, but may connect all the same
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if late := <-attempts; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return a.conn, nil
+			}
+			lastErr = a.err
+			// RFC 8305, section 5: a failed attempt makes way for the next one right away
+			if next < len(entry.IPs) {
+				start()
+			}
+		}
+	}
+	return nil, fmt.Errorf("Failed to connect to service instance %q: %s", entry.Instance, lastErr)
+}
+
+// evictEntry evicts the cached SRV records of the given service entry and the
+// address records of its host, so that the instance is resolved afresh
+func (c *Client) evictEntry(entry ServiceEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	_, target := c.resolveCname(entry.Host)
+	for _, evicted := range []struct {
+		name  string
+		types []uint16
+	}{
+		{entry.Instance, []uint16{dns.TypeSRV}},
+		{target, []uint16{dns.TypeA, dns.TypeAAAA}},
+	} {
+		key := cacheKey(evicted.name)
+		var kept []*cacheEntry
+		for _, e := range c.cache[key] {
+			if !containsType(evicted.types, e.rr.Header().Rrtype) {
+				kept = append(kept, e)
+			}
+		}
+		if len(kept) == len(c.cache[key]) {
+			continue
+		}
+		c.lastChange = c.Clock.Now()
+		count(&c.metrics.Evictions, len(c.cache[key])-len(kept))
+		if len(kept) == 0 {
+			delete(c.cache, key)
+		} else {
+			c.cache[key] = kept
+		}
+	}
+}
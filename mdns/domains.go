@@ -0,0 +1,64 @@
+package mdns
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// RFC 6763, section 11.  Discovery of Browsing and Registration Domains
+//
+// b._dns-sd._udp.<domain>.  lists domains recommended for browsing, and
+// db._dns-sd._udp.<domain>. the single recommended default domain for browsing.
+// r._dns-sd._udp.<domain>.  lists domains recommended for registering services,
+// and dr._dns-sd._udp.<domain>. the recommended default domain for registration.
+// lb._dns-sd._udp.<domain>. is the "legacy browsing" or "automatic browsing"
+// domain(s), used by clients that do not offer a choice of domains.
+var (
+	browseDomainLabels       = []string{"b", "db"}
+	legacyDomainLabels       = []string{"lb"}
+	registrationDomainLabels = []string{"r", "dr"}
+)
+
+// EnumerateDomains asks the network for the browsing, legacy browsing and
+// registration domains recommended in the local. domain, as per RFC 6763,
+// section 11. Answers are collected during SettleWindow.
+func (c *Client) EnumerateDomains(ctx context.Context) (browse, legacy, registration []string, err error) {
+	queryName := func(label string) string {
+		return label + "._dns-sd._udp.local."
+	}
+	var questions []dns.Question
+	for _, labels := range [][]string{browseDomainLabels, legacyDomainLabels, registrationDomainLabels} {
+		for _, label := range labels {
+			questions = append(questions, dns.Question{Name: queryName(label), Qtype: dns.TypePTR, Qclass: dns.ClassINET})
+		}
+	}
+
+	answered, err := c.collect(ctx, questions, c.SettleWindow, 0)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// domains lists the distinct domains pointed to by the given enumeration names
+	domains := func(labels []string) []string {
+		seen := make(map[string]bool)
+		var list []string
+		for _, answer := range answered {
+			for _, label := range labels {
+				if !strings.EqualFold(answer.RR.Header().Name, queryName(label)) {
+					continue
+				}
+				domain := answer.RR.(*dns.PTR).Ptr
+				if !seen[strings.ToLower(domain)] {
+					seen[strings.ToLower(domain)] = true
+					list = append(list, domain)
+				}
+			}
+		}
+		sort.Strings(list)
+		return list
+	}
+	return domains(browseDomainLabels), domains(legacyDomainLabels), domains(registrationDomainLabels), nil
+}
@@ -0,0 +1,56 @@
+package mdns
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/epiclabs-io/ut"
+	"github.com/miekg/dns"
+	"github.com/tilinna/clock"
+)
+
+func TestEnumerateDomains(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+
+	t.Ok(err)
+	defer c.Close()
+
+	var browse, legacy, registration []string
+	var enumerateErr error
+	done := make(chan struct{})
+	go func() {
+		browse, legacy, registration, enumerateErr = c.EnumerateDomains(context.Background())
+		close(done)
+	}()
+	equalsMessage(t, "question.txt", <-mt.out)
+
+	response := new(dns.Msg)
+	response.Response = true
+	response.Answer = parseRecords(t, `
+	b._dns-sd._udp.local.		4500	IN	PTR		epiclabs.io.
+	b._dns-sd._udp.local.		4500	IN	PTR		example.com.
+	db._dns-sd._udp.local.		4500	IN	PTR		epiclabs.io.
+	lb._dns-sd._udp.local.		4500	IN	PTR		epiclabs.io.
+	r._dns-sd._udp.local.		4500	IN	PTR		dev.epiclabs.io.
+	`)
+	mt.in <- &Packet{Msg: response}
+	// the transport is unbuffered, so this one ensures the above was processed
+	mt.in <- &Packet{Msg: new(dns.Msg)}
+
+	clk.Add(c.SettleWindow)
+	<-done
+	t.Ok(enumerateErr)
+	t.Equals([]string{"epiclabs.io.", "example.com."}, browse)
+	t.Equals([]string{"epiclabs.io."}, legacy)
+	t.Equals([]string{"dev.epiclabs.io."}, registration)
+}
@@ -0,0 +1,51 @@
+package mdns
+
+import (
+	"time"
+
+	"github.com/tilinna/clock"
+)
+
+// IdleFunc is called when no packets were sent or received for the given time
+type IdleFunc func(since time.Duration)
+
+// packetSeen records that a packet was just sent or received, for idle detection
+func (c *Client) packetSeen() {
+	if c.OnIdle == nil {
+		return
+	}
+	c.idleLock.Lock()
+	c.lastPacket = c.Clock.Now()
+	c.idleLock.Unlock()
+}
+
+// idleLoop calls OnIdle once IdleTimeout elapses without packets being sent or
+// received, and once again after every later quiet stretch that follows traffic.
+// A dropped multicast group membership or a dead network look like this.
+func (c *Client) idleLoop(timer *clock.Timer) {
+	defer timer.Stop()
+
+	var notified time.Time // last packet seen when OnIdle was last called
+	for {
+		select {
+		case <-c.closedCh:
+			return
+		case <-timer.C:
+		}
+
+		c.idleLock.Lock()
+		last := c.lastPacket
+		c.idleLock.Unlock()
+
+		idle := c.Clock.Now().Sub(last)
+		if idle < c.IdleTimeout {
+			timer.Reset(c.IdleTimeout - idle)
+			continue
+		}
+		if !last.Equal(notified) {
+			notified = last
+			c.OnIdle(idle)
+		}
+		timer.Reset(c.IdleTimeout)
+	}
+}
@@ -0,0 +1,68 @@
+package mdns
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+)
+
+// ResolveOnInterface resolves the addresses of the given host name, only asking
+// on the given network interface and only considering the answers that arrived
+// through it. Useful in hosts attached to several network segments, where the
+// same name may exist on more than one.
+func (c *Client) ResolveOnInterface(ctx context.Context, name string, iface string) ([]dns.RR, error) {
+	name = dns.Fqdn(name)
+
+	// first, try to answer off the cache
+	if answers := c.interfaceAnswers(name, iface); answers != nil {
+		return answers, nil
+	}
+
+	msg := new(dns.Msg)
+	msg.Id = c.randomID()
+	msg.RecursionDesired = false
+	msg.Question = []dns.Question{
+		{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET},
+		{Name: name, Qtype: dns.TypeAAAA, Qclass: dns.ClassINET},
+	}
+	send := func(msg *dns.Msg) error {
+		return c.sendInterface(msg, iface)
+	}
+	return c.transmit(ctx, msg, send, func() []dns.RR {
+		return c.interfaceAnswers(name, iface)
+	})
+}
+
+// interfaceAnswers retrieves from cache the address records of the given name,
+// along with the cnames leading to them, that were seen on the given interface
+func (c *Client) interfaceAnswers(name, iface string) []dns.RR {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := c.Clock.Now()
+	var chain []dns.RR
+	for {
+		entry := c.cnames[cacheKey(name)]
+		if entry == nil || !entry.seenOn(iface) || entry.expired(now) {
+			break
+		}
+		rr := dns.Copy(entry.rr)
+		rr.Header().Ttl = entry.ttl(now)
+		chain = append(chain, rr)
+		name = entry.cname().Target
+	}
+
+	var answers []dns.RR
+	for _, entry := range c.cache[cacheKey(name)] {
+		t := entry.rr.Header().Rrtype
+		if (t == dns.TypeA || t == dns.TypeAAAA) && entry.seenOn(iface) && !entry.expired(now) {
+			rr := dns.Copy(entry.rr)
+			rr.Header().Ttl = entry.ttl(now)
+			answers = append(answers, rr)
+		}
+	}
+	if len(answers) == 0 {
+		return nil
+	}
+	return c.presentRecords(append(chain, answers...))
+}
@@ -0,0 +1,94 @@
+package mdns
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// LookupHost returns the addresses of the given host, off the cache if possible
+// or else asking over the network until answers are received or the context is
+// done. Like search domains in resolv.conf, a name without dots is tried in each
+// of SearchDomains and the addresses of the first one, in that order, that is
+// answered are returned. All domains are asked at once, so answers for a later
+// domain only win once SettleWindow passes, after asking, without any for the
+// earlier ones.
+// Names ending in a dot are looked up as given.
+func (c *Client) LookupHost(ctx context.Context, host string) ([]net.IP, error) {
+	names := c.searchNames(host)
+
+	// lookup collects the cached addresses of the first of the names, in search
+	// order, that has any, and returns its index, or -1 if none has
+	var ips []net.IP
+	lookup := func() int {
+		ips = nil
+		for i, name := range names {
+			records := c.CachedAnswers(name, dns.TypeANY, isAddress)
+			for _, rr := range records {
+				switch rr := rr.(type) {
+				case *dns.A:
+					ips = append(ips, rr.A)
+				case *dns.AAAA:
+					ips = append(ips, rr.AAAA)
+				}
+			}
+			if records != nil {
+				return i
+			}
+		}
+		return -1
+	}
+	if lookup() >= 0 {
+		return ips, nil
+	}
+
+	msg := new(dns.Msg)
+	msg.Id = c.randomID()
+	msg.RecursionDesired = false
+	for _, name := range names {
+		msg.Question = append(msg.Question,
+			dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET},
+			dns.Question{Name: name, Qtype: dns.TypeAAAA, Qclass: dns.ClassINET},
+		)
+	}
+
+	// the first domain answering wins right away, while later ones only do once
+	// SettleWindow passes after asking, so that the earlier ones have a chance
+	var settled int32
+	settle := c.Clock.AfterFunc(c.SettleWindow, func() {
+		atomic.StoreInt32(&settled, 1)
+		c.signal.raise()
+	})
+	defer settle.Stop()
+	_, err := c.transmit(ctx, msg, c.multicast, func() []dns.RR {
+		if i := lookup(); i == 0 || (i > 0 && atomic.LoadInt32(&settled) != 0) {
+			// no records to return, just signal we are done
+			return []dns.RR{}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ips, nil
+}
+
+// searchNames returns the fully qualified names to look up the given host name as
+func (c *Client) searchNames(host string) []string {
+	if strings.Contains(host, ".") || len(c.SearchDomains) == 0 {
+		return []string{dns.Fqdn(host)}
+	}
+	names := make([]string, 0, len(c.SearchDomains))
+	for _, domain := range c.SearchDomains {
+		names = append(names, dns.Fqdn(host+"."+strings.TrimPrefix(domain, ".")))
+	}
+	return names
+}
+
+// isAddress returns whether the record is an address record
+func isAddress(rr dns.RR) bool {
+	return rr.Header().Rrtype == dns.TypeA || rr.Header().Rrtype == dns.TypeAAAA
+}
@@ -0,0 +1,39 @@
+package mdns
+
+import "sync/atomic"
+
+// Metrics are counters of the activity of a client since it was created, as
+// returned by MetricsSnapshot. They only ever grow, as Prometheus counters do,
+// so rates are worked out by diffing successive snapshots.
+type Metrics struct {
+	QueriesSent     uint64 // Query messages sent, including retransmissions and probes
+	AnswersReceived uint64 // Records received in the answer section of responses
+	CacheHits       uint64 // Queries answered off the cache, without asking over the network
+	CacheMisses     uint64 // Queries asked over the network for lack of fresh answers in cache. Fresh queries, which always are, do not count
+	Evictions       uint64 // Records removed from the cache before expiring, e.g. to keep it to CacheTargetSize
+	Flushes         uint64 // Cached records set to expire early by newer ones received with the cache-flush bit
+	Conflicts       uint64 // Responses conflicting with registered records, either while probing or defended afterwards
+	ListenerDrops   uint64 // Received packets ResolveAll and Discover calls in progress missed for not keeping up, so that they undercount responders
+}
+
+// MetricsSnapshot returns the current value of the client counters. It is safe
+// to call at any time, and cheap enough to be scraped frequently.
+func (c *Client) MetricsSnapshot() Metrics {
+	return Metrics{
+		QueriesSent:     atomic.LoadUint64(&c.metrics.QueriesSent),
+		AnswersReceived: atomic.LoadUint64(&c.metrics.AnswersReceived),
+		CacheHits:       atomic.LoadUint64(&c.metrics.CacheHits),
+		CacheMisses:     atomic.LoadUint64(&c.metrics.CacheMisses),
+		Evictions:       atomic.LoadUint64(&c.metrics.Evictions),
+		Flushes:         atomic.LoadUint64(&c.metrics.Flushes),
+		Conflicts:       atomic.LoadUint64(&c.metrics.Conflicts),
+		ListenerDrops:   atomic.LoadUint64(&c.metrics.ListenerDrops),
+	}
+}
+
+// count adds n to the given counter of c.metrics
+func count(counter *uint64, n int) {
+	if n > 0 {
+		atomic.AddUint64(counter, uint64(n))
+	}
+}
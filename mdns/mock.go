@@ -0,0 +1,142 @@
+package mdns
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/epiclabs-io/epicmdns/mdns/udptransport"
+	"github.com/miekg/dns"
+)
+
+// mockQueueSize is how many packets an end of the mock network holds for its
+// client to read. Packets beyond that are dropped, as a busy network would.
+const mockQueueSize = 64
+
+// Addresses the ends of the mock network send packets from, and the one the
+// client end sends queries from when it acts as a simple resolver
+var (
+	mockResponderAddr   = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353}
+	mockClientAddr      = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 5353}
+	mockLegacyQueryAddr = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 49152}
+)
+
+// mockEnd is one end of an in-memory network linking two clients. Messages go
+// through the wire format, so that they are parsed as if received from a socket.
+type mockEnd struct {
+	addr      net.Addr // address packets from this end come from
+	queryAddr net.Addr // address queries from this end come from, if other than addr
+	peer      *mockEnd
+	in        chan *Packet
+	lock      sync.Mutex
+	closed    bool
+}
+
+// newMockNetwork links two transports together
+func newMockNetwork() (client, responder *mockEnd) {
+	client = &mockEnd{addr: mockClientAddr, in: make(chan *Packet, mockQueueSize)}
+	responder = &mockEnd{addr: mockResponderAddr, in: make(chan *Packet, mockQueueSize)}
+	client.peer, responder.peer = responder, client
+	return client, responder
+}
+
+// Send hands the message to the other end, whatever the destination
+func (m *mockEnd) Send(msg *dns.Msg, dst net.Addr) error {
+	m.lock.Lock()
+	closed := m.closed
+	m.lock.Unlock()
+	if closed {
+		return errors.New("Transport closed")
+	}
+	buf, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+	if !msg.Response && m.queryAddr != nil {
+		return m.peer.deliver(buf, m.queryAddr)
+	}
+	return m.peer.deliver(buf, m.addr)
+}
+
+// SendInterface works like Send, there being a single interface
+func (m *mockEnd) SendInterface(msg *dns.Msg, iface string) error {
+	return m.Send(msg, nil)
+}
+
+// deliver queues a packet for this end to receive, dropping it if the queue
+// is full or the end is closed
+func (m *mockEnd) deliver(buf []byte, src net.Addr) error {
+	msg, err := udptransport.Unpack(buf)
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return nil
+	}
+	select {
+	case m.in <- &Packet{Msg: msg, Src: src}:
+	default:
+	}
+	return nil
+}
+
+// Receive returns a channel that outputs the packets sent by the other end
+func (m *mockEnd) Receive() <-chan *Packet {
+	return m.in
+}
+
+// Close stops delivering packets to and from this end
+func (m *mockEnd) Close() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.closed = true
+}
+
+// NewMockResponder returns a Transport for a client to use in tests instead of
+// the network. The other end of it is linked, in memory, to a responder that
+// answers for the given services right away, without probing nor announcing
+// them first, as a client that registered them would. Responses too large for a
+// single packet are split as they would be on the network. Services that fail to
+// validate are logged and skipped. Call the returned function to shut down
+// the responder once done.
+func NewMockResponder(services []Service) (Transport, func()) {
+	client, end := newMockNetwork()
+	return client, mockRespond(end, services)
+}
+
+// NewMockLegacyResponder works like NewMockResponder, but queries come to the
+// responder from an ephemeral port rather than the mDNS one, as those of simple
+// resolvers do, so that it sends legacy unicast responses back (RFC 6762,
+// section 6.7). This is for testing how such responses are handled.
+func NewMockLegacyResponder(services []Service) (Transport, func()) {
+	client, end := newMockNetwork()
+	client.queryAddr = mockLegacyQueryAddr
+	return client, mockRespond(end, services)
+}
+
+// mockRespond starts a client answering for the given services on the given end
+// of the mock network. Returns the function that shuts down both ends.
+func mockRespond(end *mockEnd, services []Service) func() {
+	// New only fails to create the default UDP transport
+	responder, _ := New(&Config{Transport: end})
+
+	responder.lock.Lock()
+	for i := range services {
+		if err := services[i].validate(); err != nil {
+			log.Printf("error: %s", err)
+			continue
+		}
+		r := newRegistration(&services[i])
+		r.probing = false
+		responder.registrations[r.name()] = r
+	}
+	responder.lock.Unlock()
+
+	return func() {
+		_ = responder.Close()
+		end.peer.Close()
+	}
+}
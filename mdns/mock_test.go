@@ -0,0 +1,94 @@
+package mdns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/epiclabs-io/ut"
+	"github.com/miekg/dns"
+)
+
+func TestMockResponder(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	// enough services for the PTR records not to fit in a single packet
+	var services []Service
+	for i := 0; i < 30; i++ {
+		services = append(services, Service{
+			Instance: fmt.Sprintf("demo%02d %s", i, strings.Repeat("x", 40)),
+			Service:  "_service1._tcp",
+			Host:     "terminus.local",
+			Port:     uint16(8000 + i),
+			IPs:      []net.IP{net.ParseIP("5.6.7.8")},
+		})
+	}
+	transport, shutdown := NewMockResponder(services)
+	defer shutdown()
+
+	var responses int32
+	c, err := New(&Config{
+		Transport:    transport,
+		SettleWindow: 100 * time.Millisecond,
+		OnPacket: func(msg *dns.Msg, sent bool, addr net.Addr) {
+			if !sent && msg.Response {
+				atomic.AddInt32(&responses, 1)
+			}
+		},
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	answers, err := c.ResolveAll(ctx, dns.Question{Name: "_service1._tcp.local.", Qtype: dns.TypePTR, Qclass: dns.ClassINET})
+	t.Ok(err)
+	t.Equals(len(services), len(answers))
+	t.Assert(atomic.LoadInt32(&responses) > 1, "Expected the answers to be split in several packets")
+
+	entry, err := c.Resolve(ctx, MakeInstanceName(services[29].Instance, services[29].Service, ""))
+	t.Ok(err)
+	t.Equals(uint16(8029), entry.Port)
+	t.Equals("5.6.7.8", entry.IPs[0].String())
+}
+
+func TestMockLegacyResponder(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	transport, shutdown := NewMockLegacyResponder([]Service{demoService})
+	defer shutdown()
+
+	var queryID, responseID uint32
+	c, err := New(&Config{
+		Transport: transport,
+		OnPacket: func(msg *dns.Msg, sent bool, addr net.Addr) {
+			if sent && !msg.Response {
+				atomic.StoreUint32(&queryID, uint32(msg.Id))
+			}
+			if !sent && msg.Response {
+				atomic.StoreUint32(&responseID, uint32(msg.Id))
+			}
+		},
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	records, err := c.Query(ctx, dns.Question{Name: "demo._service1._tcp.local.", Qtype: dns.TypeSRV, Qclass: dns.ClassINET})
+	t.Ok(err)
+	t.Equals(dns.TypeSRV, records[0].Header().Rrtype)
+
+	// the query came from an ephemeral port, so it was answered as that of a
+	// simple resolver, echoing its ID and with capped TTLs
+	t.Equals(atomic.LoadUint32(&queryID), atomic.LoadUint32(&responseID))
+	for _, rr := range records {
+		t.Assert(rr.Header().Ttl <= legacyTTL, "Expected a legacy TTL, got %s", rr)
+	}
+}
@@ -1,12 +1,51 @@
 package mdns
 
 import (
+	"errors"
+	"net"
+
+	"github.com/epiclabs-io/epicmdns/mdns/udptransport"
 	"github.com/miekg/dns"
 )
 
-// transport is an interface to abstract the network transport and facilitate testing
-type transport interface {
-	Send(*dns.Msg) error
-	Receive() <-chan *dns.Msg
+// Packet is a DNS message received from the network, along with its origin
+type Packet = udptransport.Packet
+
+// Transport is an interface to abstract the network transport and facilitate testing
+type Transport interface {
+	Send(msg *dns.Msg, dst net.Addr) error // dst is nil to multicast
+	SendInterface(msg *dns.Msg, iface string) error
+	Receive() <-chan *Packet
 	Close()
 }
+
+// Reconnector is implemented by transports that can tell when their network
+// connection is back after a drop, e.g. once an interface is up again, so that
+// the client can ask again for the records cached until then. See OnReconnect.
+type Reconnector interface {
+	Reconnected() <-chan struct{}
+}
+
+// Exchanger is an interface to abstract fetching complete answers
+// from a single responder, e.g. over TCP, as tcptransport does
+type Exchanger interface {
+	Exchange(msg *dns.Msg, dst net.Addr) (*dns.Msg, error)
+}
+
+// errTransportClosed reports that the transport stopped delivering packets
+var errTransportClosed = errors.New("Transport closed unexpectedly")
+
+// TransportError is returned when the network transport fails, as opposed to
+// questions going unanswered until the context is done
+type TransportError struct {
+	Err error // underlying cause
+}
+
+func (e *TransportError) Error() string {
+	return "Transport failure: " + e.Err.Error()
+}
+
+// Unwrap returns the underlying cause
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
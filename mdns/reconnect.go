@@ -0,0 +1,110 @@
+package mdns
+
+import (
+	"log"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// reconnectGrace is how long records cached before the transport reconnected
+// have to be received again before they are evicted
+const reconnectGrace = 5 * time.Second
+
+// ReconnectFunc is called when the transport reports that it is connected to
+// the network again after a drop
+type ReconnectFunc func()
+
+// reconnects returns the channel the transport reports reconnections on, or
+// nil, which blocks forever, if it cannot tell
+func (c *Client) reconnects() <-chan struct{} {
+	if r, ok := c.Transport.(Reconnector); ok {
+		return r.Reconnected()
+	}
+	return nil
+}
+
+// reconnected handles a reconnection of the transport. Records cached until now
+// may have gone away during the drop, so they are suspect: the browsed services
+// and the questions being asked go out again right away, and the records that
+// are not received again within reconnectGrace are evicted.
+func (c *Client) reconnected() {
+	since := c.Clock.Now()
+	grace := c.Clock.NewTimer(reconnectGrace)
+	started := c.background(func() {
+		defer grace.Stop()
+		if c.OnReconnect != nil {
+			c.OnReconnect()
+		}
+		for _, service := range c.ActiveBrowses() {
+			c.serviceQuery(service)
+		}
+		if questions := c.ActiveQueries(); len(questions) > 0 {
+			msg := new(dns.Msg)
+			msg.Id = c.randomID()
+			msg.RecursionDesired = false
+			msg.Question = questions
+			if err := c.multicast(msg); err != nil {
+				log.Printf("error: %s", err)
+			}
+		}
+
+		select {
+		case <-grace.C:
+			c.evictUnconfirmed(since)
+		case <-c.closedCh:
+		}
+	})
+	if !started {
+		grace.Stop()
+	}
+}
+
+// evictUnconfirmed evicts the records last received before the given time,
+// but pinned ones and those of our own registrations, which warmCache put in
+// cache and are never received from the network
+func (c *Client) evictUnconfirmed(since time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for key, entries := range c.cache {
+		var kept []*cacheEntry
+		for _, entry := range entries {
+			if !entry.received.Before(since) || c.pinned(pinKey(entry.rr.Header().Name, entry.rr.Header().Rrtype)) || c.registered(entry.rr) {
+				kept = append(kept, entry)
+			}
+		}
+		if len(kept) != len(entries) {
+			c.lastChange = c.Clock.Now()
+			count(&c.metrics.Evictions, len(entries)-len(kept))
+		}
+		if len(kept) == 0 {
+			delete(c.cache, key)
+		} else {
+			c.cache[key] = kept
+		}
+	}
+	for key, entry := range c.cnames {
+		if entry.received.Before(since) && !c.registered(entry.rr) {
+			delete(c.cnames, key)
+			c.lastChange = c.Clock.Now()
+			count(&c.metrics.Evictions, 1)
+		}
+	}
+}
+
+// registered returns whether the given record is one of those of our
+// registrations. Must be called with the lock held.
+func (c *Client) registered(rr dns.RR) bool {
+	if c.owns(rr) {
+		return true
+	}
+	for _, r := range c.registrations {
+		for _, shared := range r.shared {
+			if isSameRecord(shared, rr) {
+				return true
+			}
+		}
+	}
+	return false
+}
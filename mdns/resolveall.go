@@ -0,0 +1,215 @@
+package mdns
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// AnsweredRecord is a record received from the network, along with
+// the responder that sent it
+type AnsweredRecord struct {
+	RR        dns.RR
+	Src       net.Addr // Address of the responder
+	Interface string   // Network interface the answer arrived on. Empty if unknown
+}
+
+// ResolveAll asks the given question over the network and collects, during
+// SettleWindow, the records every responder answers with. Unlike Query, the
+// answers are not merged, so that different hosts claiming the same name can
+// be told apart. Repeated answers of a responder are only returned once.
+func (c *Client) ResolveAll(ctx context.Context, q dns.Question) ([]AnsweredRecord, error) {
+	q.Name = dns.Fqdn(q.Name)
+	return c.collect(ctx, []dns.Question{q}, c.SettleWindow, 0)
+}
+
+// Discover asks the given question over the network, bypassing the cache, and
+// collects the records responders answer with during the settle window, like
+// ResolveAll does. Once maxResponders distinct responders have answered, it
+// returns without waiting for the window to end. A zero settle defaults to
+// SettleWindow, and a maxResponders of zero or less means no limit.
+func (c *Client) Discover(ctx context.Context, q dns.Question, maxResponders int, settle time.Duration) ([]AnsweredRecord, error) {
+	q.Name = dns.Fqdn(q.Name)
+	if settle == 0 {
+		settle = c.SettleWindow
+	}
+	return c.collect(ctx, []dns.Question{q}, settle, maxResponders)
+}
+
+// collect asks the given questions over the network and returns the answers
+// received from every responder during the settle window, or until answers
+// from maxResponders distinct responders are received, if more than zero
+func (c *Client) collect(ctx context.Context, questions []dns.Question, settle time.Duration, maxResponders int) ([]AnsweredRecord, error) {
+	release, err := c.acquireQuerySlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	defer c.trackQuery(questions)()
+
+	packets := make(chan *Packet, listenerBufferSize)
+	c.lock.Lock()
+	c.listeners[packets] = struct{}{}
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		delete(c.listeners, packets)
+		c.lock.Unlock()
+	}()
+
+	// ask for multicast responses, so that every responder answers
+	msg := new(dns.Msg)
+	msg.Id = c.randomID()
+	msg.RecursionDesired = false
+	msg.Question = questions
+	timer := c.Clock.NewTimer(settle)
+	defer timer.Stop()
+	if err := c.send(msg, nil); err != nil {
+		return nil, err
+	}
+
+	var answers []AnsweredRecord
+	for {
+		select {
+		case packet := <-packets:
+			answers = c.appendAnswers(answers, packet, questions)
+			if maxResponders > 0 && countSources(answers) >= maxResponders {
+				return answers, nil
+			}
+		case <-timer.C:
+			// packets received before the window closed still count
+			for {
+				select {
+				case packet := <-packets:
+					answers = c.appendAnswers(answers, packet, questions)
+				default:
+					return answers, nil
+				}
+			}
+		case <-c.transportDown:
+			return answers, &TransportError{Err: errTransportClosed}
+		case <-ctx.Done():
+			return answers, ctx.Err()
+		}
+	}
+}
+
+// answers returns whether the record answers any of the questions
+func answers(rr dns.RR, questions []dns.Question) bool {
+	for _, q := range questions {
+		if strings.EqualFold(rr.Header().Name, q.Name) && matchesType(rr, q.Qtype) {
+			return true
+		}
+	}
+	return false
+}
+
+// appendAnswers appends the records of the packet that answer the questions,
+// skipping the ones already answered by the same responder
+func (c *Client) appendAnswers(answered []AnsweredRecord, packet *Packet, questions []dns.Question) []AnsweredRecord {
+next:
+	for _, rr := range append(packet.Msg.Answer, packet.Msg.Extra...) {
+		if !answers(rr, questions) {
+			continue
+		}
+		for _, answer := range answered {
+			if sameSource(answer.Src, packet.Src) && dns.IsDuplicate(answer.RR, rr) {
+				continue next
+			}
+		}
+		if c.MaxSourcesPerRecord > 0 {
+			answered = capSources(answered, rr, packet.Src, c.MaxSourcesPerRecord)
+		}
+		answered = append(answered, AnsweredRecord{
+			RR:        c.presentRecords([]dns.RR{dns.Copy(rr)})[0],
+			Src:       packet.Src,
+			Interface: packet.Interface,
+		})
+	}
+	return answered
+}
+
+// capSources makes room for an answer with the given record from src, dropping
+// the answers of the responder that answered first for the same name and type
+// if max other responders did already. A device churning through addresses
+// would otherwise grow the answers without bound.
+func capSources(answered []AnsweredRecord, rr dns.RR, src net.Addr, max int) []AnsweredRecord {
+	sameRecord := func(other dns.RR) bool {
+		return other.Header().Rrtype == rr.Header().Rrtype && strings.EqualFold(other.Header().Name, rr.Header().Name)
+	}
+	var sources []net.Addr // in the order they first answered
+next:
+	for _, answer := range answered {
+		if !sameRecord(answer.RR) {
+			continue
+		}
+		for _, seen := range sources {
+			if sameSource(seen, answer.Src) {
+				continue next
+			}
+		}
+		if sameSource(answer.Src, src) {
+			// src is tracked already
+			return answered
+		}
+		sources = append(sources, answer.Src)
+	}
+	if len(sources) < max {
+		return answered
+	}
+
+	kept := answered[:0]
+	for _, answer := range answered {
+		if !sameRecord(answer.RR) || !sameSource(answer.Src, sources[0]) {
+			kept = append(kept, answer)
+		}
+	}
+	return kept
+}
+
+// countSources returns how many distinct responders sent the answers
+func countSources(answers []AnsweredRecord) int {
+	n := 0
+next:
+	for i, answer := range answers {
+		for _, previous := range answers[:i] {
+			if sameSource(previous.Src, answer.Src) {
+				continue next
+			}
+		}
+		n++
+	}
+	return n
+}
+
+// sameSource returns whether two packet source addresses are the same
+func sameSource(a, b net.Addr) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.String() == b.String()
+}
+
+// listenerBufferSize is how many received packets a ResolveAll or Discover in
+// progress can fall behind by. It is large enough for every responder of a busy
+// network to answer within a single scheduling hiccup of the caller.
+const listenerBufferSize = 256
+
+// notifyListeners hands a received packet to the ResolveAll calls in
+// progress. Listeners that are not keeping up miss the packet, which is
+// counted in Metrics.ListenerDrops, rather than holding up the receive path.
+func (c *Client) notifyListeners(packet *Packet) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for listener := range c.listeners {
+		select {
+		case listener <- packet:
+		default:
+			count(&c.metrics.ListenerDrops, 1)
+			c.logSampled("mdns: answer collector not keeping up, dropping packet from %v", packet.Src)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package mdns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/epiclabs-io/ut"
+	"github.com/miekg/dns"
+	"github.com/tilinna/clock"
+)
+
+func TestResolveAll(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+
+	t.Ok(err)
+	defer c.Close()
+
+	var answers []AnsweredRecord
+	var resolveErr error
+	done := make(chan struct{})
+	go func() {
+		answers, resolveErr = c.ResolveAll(context.Background(), dns.Question{Name: "printer.local", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+		close(done)
+	}()
+	equalsMessage(t, "question.txt", <-mt.out)
+
+	response := func(src string, zone string) *Packet {
+		msg := new(dns.Msg)
+		msg.Response = true
+		msg.Answer = parseRecords(t, zone)
+		return &Packet{Msg: msg, Src: &net.UDPAddr{IP: net.ParseIP(src), Port: 5353}, Interface: "eth0"}
+	}
+
+	// the legitimate printer and a rogue device claim the same name
+	mt.in <- response("10.0.0.2", `
+	printer.local.		120	IN	A		10.0.0.2
+	`)
+	mt.in <- response("10.0.0.66", `
+	printer.local.		120	IN	A		10.0.0.66
+	other.local.		120	IN	A		10.0.0.67
+	`)
+	// repeated answers are only reported once
+	mt.in <- response("10.0.0.2", `
+	printer.local.		120	IN	A		10.0.0.2
+	`)
+	// the transport is unbuffered, so this one ensures the above were processed
+	mt.in <- response("10.0.0.3", `
+	unrelated.local.	120	IN	A		10.0.0.3
+	`)
+
+	clk.Add(c.SettleWindow)
+	<-done
+	t.Ok(resolveErr)
+	t.Equals(2, len(answers))
+	t.Equals("10.0.0.2:5353", answers[0].Src.String())
+	t.Equals("10.0.0.66:5353", answers[1].Src.String())
+	t.Equals("eth0", answers[1].Interface)
+	t.EqualsTextFile("answers.txt", rr2string([]dns.RR{answers[0].RR, answers[1].RR}, nil))
+}
+
+func TestDiscover(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	// records already in cache do not count, the question is asked anyway
+	c.addToCache(parseRecords(t, `
+	_ipp._tcp.local.	4500	IN	PTR		cached._ipp._tcp.local.
+	`))
+
+	var answers []AnsweredRecord
+	var discoverErr error
+	done := make(chan struct{})
+	go func() {
+		answers, discoverErr = c.Discover(context.Background(), dns.Question{Name: "_ipp._tcp.local", Qtype: dns.TypePTR, Qclass: dns.ClassINET}, 2, 5*time.Second)
+		close(done)
+	}()
+	<-mt.out
+
+	response := func(src string, zone string) *Packet {
+		msg := new(dns.Msg)
+		msg.Response = true
+		msg.Answer = parseRecords(t, zone)
+		return &Packet{Msg: msg, Src: &net.UDPAddr{IP: net.ParseIP(src), Port: 5353}}
+	}
+
+	// the first responder answers twice, then a second one answers
+	mt.in <- response("10.0.0.2", `
+	_ipp._tcp.local.	4500	IN	PTR		first._ipp._tcp.local.
+	`)
+	mt.in <- response("10.0.0.2", `
+	_ipp._tcp.local.	4500	IN	PTR		first\ again._ipp._tcp.local.
+	`)
+	mt.in <- response("10.0.0.3", `
+	_ipp._tcp.local.	4500	IN	PTR		second._ipp._tcp.local.
+	`)
+
+	// having heard from two responders, the settle window is cut short
+	<-done
+	t.Ok(discoverErr)
+	t.Equals(3, len(answers))
+	t.Equals("10.0.0.2:5353", answers[1].Src.String())
+	t.Equals("10.0.0.3:5353", answers[2].Src.String())
+	t.Equals("second._ipp._tcp.local.", answers[2].RR.(*dns.PTR).Ptr)
+}
+
+func TestMaxSourcesPerRecord(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:               clk,
+		Transport:           mt,
+		MaxSourcesPerRecord: 3,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	var answers []AnsweredRecord
+	done := make(chan struct{})
+	go func() {
+		answers, err = c.ResolveAll(context.Background(), dns.Question{Name: "printer.local", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+		close(done)
+	}()
+	<-mt.out
+
+	// a flapping device answers from many addresses
+	for i := 1; i <= 10; i++ {
+		msg := new(dns.Msg)
+		msg.Response = true
+		msg.Answer = parseRecords(t, fmt.Sprintf("printer.local. 120 IN A 10.0.0.%d", i))
+		mt.in <- &Packet{Msg: msg, Src: &net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 5353}}
+	}
+	mt.in <- &Packet{Msg: new(dns.Msg)}
+	clk.Add(c.SettleWindow)
+	<-done
+	t.Ok(err)
+
+	// only the latest responders are kept
+	var sources []string
+	for _, answer := range answers {
+		sources = append(sources, answer.Src.String())
+	}
+	t.Equals([]string{"10.0.0.8:5353", "10.0.0.9:5353", "10.0.0.10:5353"}, sources)
+}
+
+func TestListenerDrops(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	mt := newMockTransport()
+	c, err := New(&Config{
+		Clock:     clock.NewMock(time.Unix(0, 0)),
+		Transport: mt,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	// a collector that does not keep up misses packets, which is accounted for
+	stuck := make(chan *Packet)
+	c.lock.Lock()
+	c.listeners[stuck] = struct{}{}
+	c.lock.Unlock()
+
+	response := new(dns.Msg)
+	response.Response = true
+	response.Answer = parseRecords(t, `
+	printer.local.		120	IN	A		10.0.0.2
+	`)
+	mt.in <- &Packet{Msg: response}
+	// a query, rather than an empty message, which would reach listeners too
+	query := new(dns.Msg)
+	query.SetQuestion("unknown.local.", dns.TypeA)
+	mt.in <- &Packet{Msg: query}
+	t.Equals(uint64(1), c.MetricsSnapshot().ListenerDrops)
+}
@@ -0,0 +1,147 @@
+package mdns
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Resolver is the set of DNS-SD operations common to most mDNS libraries.
+// Code written against it can swap Client for other implementations, or
+// for a fake in tests.
+type Resolver interface {
+	// Browse returns the instances of the given service type found on the network
+	Browse(ctx context.Context, service string) ([]ServiceEntry, error)
+	// Resolve returns the details of the given fully qualified service instance
+	Resolve(ctx context.Context, instance string) (ServiceEntry, error)
+	// Register advertises the given service on the network
+	Register(service *Service) error
+}
+
+var _ Resolver = (*Client)(nil)
+
+// Browse asks the network for instances of the given service type and returns
+// the ones fully resolved after SettleWindow, as per Snapshot
+func (c *Client) Browse(ctx context.Context, service string) ([]ServiceEntry, error) {
+	q := dns.Question{Name: dns.Fqdn(service), Qtype: dns.TypePTR, Qclass: dns.ClassINET}
+	if _, err := c.collect(ctx, []dns.Question{q}, c.SettleWindow, 0); err != nil {
+		return nil, err
+	}
+	return c.limitEntries(c.Snapshot(service), nil)
+}
+
+// BrowseOnce works like Browse, but collects answers for the given duration
+// instead of SettleWindow and only returns fully resolved instances, never
+// Incomplete ones. If the context is done first, the instances found so far
+// are returned along with the context error.
+func (c *Client) BrowseOnce(ctx context.Context, service string, duration time.Duration) ([]ServiceEntry, error) {
+	q := dns.Question{Name: dns.Fqdn(service), Qtype: dns.TypePTR, Qclass: dns.ClassINET}
+	_, err := c.collect(ctx, []dns.Question{q}, duration, 0)
+	if err != nil && ctx.Err() == nil {
+		return nil, err
+	}
+	return c.limitEntries(resolved(c.Snapshot(service)), err)
+}
+
+// limitEntries caps the entries to MaxAnswers, returning ErrTruncated if
+// there are more and no other error
+func (c *Client) limitEntries(entries []ServiceEntry, err error) ([]ServiceEntry, error) {
+	if err == nil && c.MaxAnswers > 0 && len(entries) > c.MaxAnswers {
+		return entries[:c.MaxAnswers], ErrTruncated
+	}
+	return entries, err
+}
+
+// Resolve asks the network for the SRV, TXT and address records of the given
+// fully qualified service instance, e.g. My\ Printer._ipp._tcp.local., until
+// it is fully resolved or the context is done
+func (c *Client) Resolve(ctx context.Context, instance string) (ServiceEntry, error) {
+	instance = dns.Fqdn(instance)
+	service := instance
+	if labels := dns.Split(instance); len(labels) > 1 {
+		service = instance[labels[1]:]
+	}
+
+	var entry ServiceEntry
+	resolved := func() bool {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		var ok bool
+		entry, ok = c.resolveEntry(service, instance, c.Clock.Now())
+		return ok
+	}
+	if resolved() {
+		return entry, nil
+	}
+
+	msg := new(dns.Msg)
+	msg.Id = c.randomID()
+	msg.RecursionDesired = false
+	msg.Question = []dns.Question{
+		{Name: instance, Qtype: dns.TypeSRV, Qclass: dns.ClassINET},
+		{Name: instance, Qtype: dns.TypeTXT, Qclass: dns.ClassINET},
+	}
+	_, err := c.transmit(ctx, msg, c.multicast, func() []dns.RR {
+		if resolved() {
+			// no records to return, just signal we are done
+			return []dns.RR{}
+		}
+		if entry.Host != "" && len(msg.Question) == 2 {
+			// the host is known now, ask for its addresses too in retransmissions
+			msg.Question = append(msg.Question,
+				dns.Question{Name: entry.Host, Qtype: dns.TypeA, Qclass: dns.ClassINET},
+				dns.Question{Name: entry.Host, Qtype: dns.TypeAAAA, Qclass: dns.ClassINET},
+			)
+		}
+		return nil
+	})
+	if err != nil {
+		return ServiceEntry{}, err
+	}
+	return entry, nil
+}
+
+// resolveTimeout bounds how long new instances are resolved in the background
+const resolveTimeout = 5 * time.Second
+
+// resolveNew resolves, in the background, the instances of browsed services that
+// the given PTR records, new to the cache, point to, so that the SRV, TXT and
+// address records are asked for even if responders leave them out of the
+// additional section. Instances received along with those records are resolved
+// off the cache, without any query.
+func (c *Client) resolveNew(added []dns.RR) {
+	for _, rr := range added {
+		ptr, ok := rr.(*dns.PTR)
+		if !ok || !c.isBrowsed(ptr.Hdr.Name) {
+			continue
+		}
+		instance := ptr.Ptr
+		c.background(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+			defer cancel()
+			go func() {
+				select {
+				case <-c.closedCh:
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+			if _, err := c.Resolve(ctx, instance); err != nil && ctx.Err() == nil {
+				log.Printf("error: %s", err)
+			}
+		})
+	}
+}
+
+// isBrowsed returns whether the given name is one of the browsed services
+func (c *Client) isBrowsed(name string) bool {
+	for _, service := range c.ActiveBrowses() {
+		if strings.EqualFold(service, dns.Fqdn(name)) {
+			return true
+		}
+	}
+	return false
+}
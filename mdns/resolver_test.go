@@ -0,0 +1,312 @@
+package mdns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/epiclabs-io/ut"
+	"github.com/miekg/dns"
+	"github.com/tilinna/clock"
+)
+
+func TestBrowse(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	var entries []ServiceEntry
+	var browseErr error
+	done := make(chan struct{})
+	go func() {
+		entries, browseErr = c.Browse(context.Background(), "_service1._tcp.local")
+		close(done)
+	}()
+	equalsMessage(t, "question.txt", <-mt.out)
+
+	response := new(dns.Msg)
+	response.Response = true
+	response.Answer = parseRecords(t, zone)
+	mt.in <- &Packet{Msg: response}
+	mt.in <- &Packet{Msg: new(dns.Msg)}
+	clk.Add(c.SettleWindow)
+	<-done
+	t.Ok(browseErr)
+	t.EqualsFile("entries.json", entries)
+}
+
+func TestBrowseOnce(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	var entries []ServiceEntry
+	var browseErr error
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		entries, browseErr = c.BrowseOnce(ctx, "_service1._tcp.local", 10*time.Second)
+		close(done)
+	}()
+	<-mt.out
+
+	response := new(dns.Msg)
+	response.Response = true
+	response.Answer = parseRecords(t, zone)
+	mt.in <- &Packet{Msg: response}
+	mt.in <- &Packet{Msg: new(dns.Msg)}
+
+	// answers are collected for the whole duration, unless cancelled
+	clk.Add(5 * time.Second)
+	select {
+	case <-done:
+		t.Fatal("Expected BrowseOnce to keep collecting answers")
+	default:
+	}
+	cancel()
+	<-done
+	t.Equals(context.Canceled, browseErr)
+	t.Equals(1, len(entries))
+	t.Equals("epic._service1._tcp.local.", entries[0].Instance)
+
+	// otherwise, they are returned once the duration is over
+	done = make(chan struct{})
+	go func() {
+		entries, browseErr = c.BrowseOnce(context.Background(), "_service1._tcp.local", 10*time.Second)
+		close(done)
+	}()
+	<-mt.out
+	clk.Add(10 * time.Second)
+	<-done
+	t.Ok(browseErr)
+	t.Equals(1, len(entries))
+}
+
+func TestResolve(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	var entry ServiceEntry
+	var resolveErr error
+	done := make(chan struct{})
+	go func() {
+		entry, resolveErr = c.Resolve(context.Background(), "epic._service1._tcp.local")
+		close(done)
+	}()
+	equalsMessage(t, "question.txt", <-mt.out)
+
+	// the responder does not include the addresses
+	response := new(dns.Msg)
+	response.Response = true
+	response.Answer = parseRecords(t, `
+	epic._service1._tcp.local.	230	IN	SRV		1 2 7979 praetor.epiclabs.io.
+	epic._service1._tcp.local.	240	IN	TXT		"some text"
+	`)
+	mt.in <- &Packet{Msg: response}
+	mt.in <- &Packet{Msg: new(dns.Msg)}
+
+	// so they are asked for as well
+	equalsMessage(t, "retransmit.txt", nextMessage(clk, mt))
+	response.Answer = parseRecords(t, `
+	praetor.epiclabs.io.		120	IN	A		1.2.3.4
+	`)
+	mt.in <- &Packet{Msg: response}
+	<-done
+	t.Ok(resolveErr)
+	t.EqualsFile("entry.json", entry)
+}
+
+func TestProactiveResolve(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:            clk,
+		Transport:        mt,
+		BrowseServices:   []string{"_service1._tcp.local"},
+		ProactiveResolve: true,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	// a minimal responder only answers with the PTR record
+	response := new(dns.Msg)
+	response.Response = true
+	response.Answer = parseRecords(t, `
+	_service1._tcp.local.	4500	IN	PTR		epic._service1._tcp.local.
+	_service2._tcp.local.	4500	IN	PTR		other._service2._tcp.local.
+	`)
+	mt.in <- &Packet{Msg: response}
+
+	// so the instance of the browsed service is asked for right away
+	msg := <-mt.out
+	t.Equals(2, len(msg.Question))
+	for i, qtype := range []uint16{dns.TypeSRV, dns.TypeTXT} {
+		t.Equals("epic._service1._tcp.local.", msg.Question[i].Name)
+		t.Equals(qtype, msg.Question[i].Qtype)
+	}
+
+	response.Answer = parseRecords(t, `
+	epic._service1._tcp.local.	120	IN	SRV		0 0 7979 praetor.local.
+	epic._service1._tcp.local.	120	IN	TXT		"some text"
+	praetor.local.			120	IN	A		10.20.30.40
+	`)
+	mt.in <- &Packet{Msg: response}
+	mt.in <- &Packet{Msg: new(dns.Msg)}
+	entries := c.Snapshot("_service1._tcp.local.")
+	t.Equals(1, len(entries))
+	t.Equals("praetor.local.", entries[0].Host)
+
+	// instances received along with their records need no queries
+	response.Answer = parseRecords(t, `
+	_service1._tcp.local.	4500	IN	PTR		demo._service1._tcp.local.
+	demo._service1._tcp.local.	120	IN	SRV		0 0 8080 praetor.local.
+	demo._service1._tcp.local.	120	IN	TXT		"some text"
+	`)
+	mt.in <- &Packet{Msg: response}
+	select {
+	case msg := <-mt.out:
+		t.Fatalf("Unexpected query %s", msg)
+	case mt.in <- &Packet{Msg: new(dns.Msg)}:
+	}
+}
+
+func TestResolveChain(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	response := new(dns.Msg)
+	response.Response = true
+	response.Answer = parseRecords(t, `
+	_service1._tcp.local.		4500	IN	PTR		epic._service1._tcp.local.
+	epic._service1._tcp.local.	120	IN	SRV		1 2 7979 www.epiclabs.io.
+	epic._service1._tcp.local.	4500	IN	TXT		"some text"
+	www.epiclabs.io.		120	IN	CNAME	praetor.epiclabs.io.
+	praetor.epiclabs.io.		120	IN	A		1.2.3.4
+	demo._service1._tcp.local.	120	IN	SRV		5 6 8080 broken.epiclabs.io.
+	broken.epiclabs.io.		120	IN	CNAME	terminus.epiclabs.io.
+	direct._service1._tcp.local.	120	IN	SRV		1 2 7979 praetor.epiclabs.io.
+	direct._service1._tcp.local.	4500	IN	TXT		"some text"
+	`)
+	mt.in <- &Packet{Msg: response}
+	mt.in <- &Packet{Msg: new(dns.Msg)}
+
+	// a fully resolved instance is resolved off the cache
+	chain, err := c.ResolveChain(context.Background(), "epic._service1._tcp.local")
+	t.Ok(err)
+	t.EqualsTextFile("chain.txt", chain.String())
+
+	// an instance no PTR points to, e.g. resolved directly, is no dead end
+	chain, err = c.ResolveChain(context.Background(), "direct._service1._tcp.local")
+	t.Ok(err)
+	t.Equals("", chain.Root.Error)
+	t.Equals("No cached PTR record points to the instance", chain.Root.Note)
+
+	// dead ends are flagged, and returned once the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		chain, err = c.ResolveChain(ctx, "demo._service1._tcp.local")
+		close(done)
+	}()
+	<-mt.out
+	cancel()
+	<-done
+	t.Equals(context.Canceled, err)
+	t.EqualsTextFile("deadend.txt", chain.String())
+}
+
+func TestDialService(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	t.Ok(err)
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	// the cached address is stale, nothing listens there anymore
+	response := new(dns.Msg)
+	response.Response = true
+	response.Answer = parseRecords(t, fmt.Sprintf(`
+	epic._service1._tcp.local.	120	IN	SRV		1 2 %d praetor.local.
+	epic._service1._tcp.local.	4500	IN	TXT		"some text"
+	praetor.local.			120	IN	A		127.0.0.2
+	`, port))
+	mt.in <- &Packet{Msg: response}
+	mt.in <- &Packet{Msg: new(dns.Msg)}
+
+	var conn net.Conn
+	done := make(chan struct{})
+	go func() {
+		conn, err = c.DialService(context.Background(), "epic._service1._tcp.local.", "tcp")
+		close(done)
+	}()
+
+	// so the instance is resolved again, and the new address connected to
+	msg := <-mt.out
+	t.Equals("epic._service1._tcp.local.", msg.Question[0].Name)
+	t.Equals(dns.TypeSRV, msg.Question[0].Qtype)
+	response.Answer = parseRecords(t, fmt.Sprintf(`
+	epic._service1._tcp.local.	120	IN	SRV		1 2 %d praetor.local.
+	praetor.local.			120	IN	A		127.0.0.1
+	`, port))
+	mt.in <- &Packet{Msg: response}
+	<-done
+	t.Ok(err)
+	defer conn.Close()
+	t.Equals(listener.Addr().String(), conn.RemoteAddr().String())
+}
@@ -0,0 +1,905 @@
+package mdns
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RFC 6762, section 8.1.  Probing
+//
+// 250 ms after the first query, the host should send a second; then, 250 ms
+// after that, a third.  If, by 250 ms after the third probe, no conflicting
+// Multicast DNS responses have been received, the host may move to the next
+// step, announcing.
+//
+// RFC 6762, section 8.3.  Announcing
+//
+// The Multicast DNS responder MUST send at least two unsolicited responses,
+// one second apart.
+const (
+	probeCount       = 3
+	probeInterval    = 250 * time.Millisecond
+	announceCount    = 2
+	announceInterval = time.Second
+)
+
+// announceBatchWindow is how long a registration that finished probing waits for
+// others to finish too, so that, e.g. services registered together at startup are
+// announced in combined messages rather than in a burst each
+const announceBatchWindow = 20 * time.Millisecond
+
+// maxMessageSize is the largest mDNS response we send in a single packet.
+// RFC 6762, section 17: a Multicast DNS packet SHOULD NOT exceed the MTU of
+// the network, so we keep to a 1500 byte Ethernet frame minus the IPv6 and UDP
+// headers.
+const maxMessageSize = 1500 - 40 - 8
+
+// cacheFlushBit is the top bit of the rrclass field, used in responses to
+// indicate the record is unique (RFC 6762, section 10.2)
+const cacheFlushBit = 1 << 15
+
+// mDNSPort is the port mDNS queriers and responders talk from. Queries
+// coming from any other port are legacy unicast queries
+const mDNSPort = 5353
+
+// legacyTTL is the highest TTL given in legacy unicast responses
+const legacyTTL = 10
+
+var (
+	errConflict = errors.New("Name conflict detected while probing")
+	errClosed   = errors.New("Client closed")
+)
+
+// registration keeps track of a service advertised by this client
+type registration struct {
+	service   Service
+	shared    []dns.RR    // records other responders may also own, e.g. PTR
+	unique    []dns.RR    // records only we own: SRV, TXT, A, AAAA
+	reverse   []dns.RR    // reverse mapping PTR records of the host addresses, only sent in answers
+	probing   bool        // the registration cannot be used for answers until probing ends
+	conflicts chan string // receives the conflicting name when a conflicting response is seen while probing
+	defended  time.Time   // last time the records were announced again to correct a conflicting response
+}
+
+// newRegistration builds the set of records to advertise for a service
+func newRegistration(service *Service) *registration {
+	r := &registration{
+		service:   *service,
+		probing:   true,
+		conflicts: make(chan string, 1),
+	}
+	r.shared, r.unique = r.service.records()
+	r.reverse = r.service.reverseRecords()
+	return r
+}
+
+// name returns the key identifying this registration
+func (r *registration) name() string {
+	return strings.ToLower(r.service.instanceName())
+}
+
+// records returns all records of this registration, with the cache-flush
+// bit set on the unique ones
+func (r *registration) records() []dns.RR {
+	records := copyRecords(r.shared)
+	for _, rr := range copyRecords(r.unique) {
+		rr.Header().Class |= cacheFlushBit
+		records = append(records, rr)
+	}
+	return records
+}
+
+// isUnique returns whether the given name belongs to one of our unique records
+func (r *registration) isUnique(name string) bool {
+	for _, rr := range r.unique {
+		if strings.EqualFold(rr.Header().Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Register advertises the given service on the network. The records of the
+// service are probed for uniqueness and then announced in the background.
+// If the instance name is found to be in use by another host, the instance
+// is renamed to "<instance> (2)", "<instance> (3)"... or as per RenameFormat,
+// until a free name is found.
+// Registering an instance name already registered in this client is an error.
+// Unless PartialAnswers is set, the PTR and SRV records of a service whose host
+// has no registered addresses are neither announced nor answered, since they
+// would lead queriers nowhere. Its TXT record still is. Once announced, the
+// records are added to the cache too, so that queries of this client for them
+// need no network round trip.
+func (c *Client) Register(service *Service) error {
+	if atomic.LoadInt32(&c.closed) != 0 {
+		return errClosed
+	}
+	if err := service.validate(); err != nil {
+		return err
+	}
+	r := newRegistration(service)
+
+	c.lock.Lock()
+	if _, ok := c.registrations[r.name()]; ok {
+		c.lock.Unlock()
+		return fmt.Errorf("Service instance %q is already registered", r.service.instanceName())
+	}
+	c.registrations[r.name()] = r
+	c.lock.Unlock()
+
+	if !c.background(func() { c.advertise(r) }) {
+		c.lock.Lock()
+		delete(c.registrations, r.name())
+		c.lock.Unlock()
+		return errClosed
+	}
+	return nil
+}
+
+// advertise probes the registration unique records, renaming the service
+// instance on conflicts, and then announces them to the network
+func (c *Client) advertise(r *registration) {
+	base := r.service.Instance
+	for n := 2; ; n++ {
+		name, err := c.probe(r)
+		if err == nil {
+			break
+		}
+		if err != errConflict {
+			return
+		}
+
+		c.lock.Lock()
+		delete(c.registrations, r.name())
+		if !strings.EqualFold(name, r.service.instanceName()) {
+			// renaming the instance does not fix a conflicting host name
+			c.lock.Unlock()
+			log.Printf("mdns: host name %q is in use, giving up registration of %q", name, r.service.Instance)
+			return
+		}
+		r.service.Instance = c.rename(base, n)
+		for c.registrations[r.name()] != nil {
+			// skip names taken by our own registrations
+			n++
+			r.service.Instance = c.rename(base, n)
+		}
+		r.shared, r.unique = r.service.records()
+		r.reverse = r.service.reverseRecords()
+		c.registrations[r.name()] = r
+		c.lock.Unlock()
+
+		log.Printf("mdns: name conflict, renaming service instance to %q", r.service.Instance)
+	}
+
+	c.lock.Lock()
+	r.probing = false
+	first := c.queueAnnouncement(r)
+	c.lock.Unlock()
+
+	// the first registration in the queue announces the whole batch
+	if first {
+		c.announce()
+	}
+}
+
+// RenameFunc returns the n-th name to try, n starting at 2, for a service
+// instance originally named base, once the previous ones were found in use
+type RenameFunc func(base string, n int) string
+
+// rename returns the n-th name to try for the service instance named base, as
+// per RenameFormat.
+//
+// RFC 6762, section 9: [...] the host MUST then choose a new name [...]. For
+// example, it might add "-2" for host names ("myhost-2.local.") or " (2)" for
+// service instance names ("Bob's Music (2)._music._tcp.local.").
+func (c *Client) rename(base string, n int) string {
+	if c.RenameFormat != nil {
+		return c.RenameFormat(base, n)
+	}
+	return fmt.Sprintf("%s (%d)", base, n)
+}
+
+// Announce sends the current records of the given registered service instance
+// again, e.g. to prompt browsers to refresh after a change. The instance may be
+// given by its name, e.g. "My Printer", or fully qualified. Announcements go
+// out in the background, as for newly registered services.
+func (c *Client) Announce(instance string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var matched []*registration
+	for _, r := range c.registrations {
+		if strings.EqualFold(r.service.Instance, instance) ||
+			strings.EqualFold(r.service.instanceName(), dns.Fqdn(instance)) {
+			matched = append(matched, r)
+		}
+	}
+	if len(matched) == 0 {
+		return fmt.Errorf("Service instance %q is not registered", instance)
+	}
+	for _, r := range matched {
+		if r.probing {
+			return fmt.Errorf("Service instance %q is still probing", instance)
+		}
+	}
+	for _, r := range matched {
+		if c.queueAnnouncement(r) {
+			c.background(c.announce)
+		}
+	}
+	return nil
+}
+
+// queueAnnouncement adds the registration to the announcement queue, unless it is
+// already there. Returns true if the queue was empty, in which case the caller
+// must call announce. Must be called with the lock held.
+func (c *Client) queueAnnouncement(r *registration) bool {
+	for _, queued := range c.announceQueue {
+		if queued == r {
+			return false
+		}
+	}
+	c.announceQueue = append(c.announceQueue, r)
+	return len(c.announceQueue) == 1
+}
+
+// probe sends out probe queries asking for our unique records. Returns
+// errConflict along with the conflicting name if another host answered for any of them.
+func (c *Client) probe(r *registration) (string, error) {
+	for i := 0; i < probeCount; i++ {
+		msg := new(dns.Msg)
+		msg.Id = c.randomID()
+		names := make(map[string]bool)
+		for _, rr := range r.unique {
+			name := strings.ToLower(rr.Header().Name)
+			if !names[name] {
+				names[name] = true
+				q := dns.Question{Name: rr.Header().Name, Qtype: dns.TypeANY, Qclass: dns.ClassINET}
+				if i == 0 {
+					// RFC 6762, section 8.1: the first probe SHOULD request a unicast response
+					q.Qclass |= 1 << 15
+				}
+				msg.Question = append(msg.Question, q)
+			}
+		}
+		// proposed records go in the authority section, for tie-breaking
+		msg.Ns = copyRecords(r.unique)
+
+		wait := c.Clock.After(probeInterval)
+		if err := c.send(msg, nil); err != nil {
+			log.Printf("error: %s", err)
+		}
+		select {
+		case <-wait:
+		case name := <-r.conflicts:
+			return name, errConflict
+		case <-c.closedCh:
+			return "", errClosed
+		}
+	}
+	return "", nil
+}
+
+// announce waits for announceBatchWindow and then sends unsolicited responses
+// with all the records of the registrations queued for announcement
+func (c *Client) announce() {
+	select {
+	case <-c.Clock.After(announceBatchWindow):
+	case <-c.closedCh:
+		return
+	}
+	c.lock.Lock()
+	batch := c.announceQueue
+	c.announceQueue = nil
+	c.lock.Unlock()
+
+	for i := 0; i < announceCount; i++ {
+		var records []dns.RR
+		c.lock.RLock()
+		for _, r := range batch {
+		next:
+			for _, rr := range r.records() {
+				// announcements hold back the same records answers do
+				if !c.PartialAnswers && !c.isComplete(r, rr) {
+					continue
+				}
+				// services on the same host share the address records
+				for _, included := range records {
+					if isSameRecord(included, rr) {
+						continue next
+					}
+				}
+				records = append(records, rr)
+			}
+		}
+		c.lock.RUnlock()
+
+		if i == 0 {
+			c.warmCache(records)
+		}
+		wait := c.Clock.After(announceInterval << uint(i))
+		c.sendResponse(records, nil, nil)
+		if i == announceCount-1 {
+			return
+		}
+		select {
+		case <-wait:
+		case <-c.closedCh:
+			return
+		}
+	}
+}
+
+// warmCache adds the announced records to the cache, so that queries of our own
+// for registered services are answered right away, as those of other hosts are
+// once they see the announcement. The records then expire as received ones do.
+func (c *Client) warmCache(announced []dns.RR) {
+	records := copyRecords(announced)
+	for _, rr := range records {
+		rr.Header().Class &^= cacheFlushBit
+	}
+	c.addToCache(records)
+	c.signal.raise()
+}
+
+// goodbye announces that all registered records are going away,
+// by sending them with a TTL of zero (RFC 6762, section 10.1)
+func (c *Client) goodbye() {
+	var records []dns.RR
+	c.lock.RLock()
+	for _, r := range c.registrations {
+		if !r.probing {
+			records = append(records, r.records()...)
+		}
+	}
+	c.lock.RUnlock()
+
+	if len(records) == 0 {
+		return
+	}
+	for _, rr := range records {
+		rr.Header().Ttl = 0
+	}
+	c.sendResponse(records, nil, nil)
+}
+
+// ConflictFunc is called when another host, at src, answers for the given
+// host name of ours with the address theirs. ours is one of our addresses of
+// the same family, or nil if there are none.
+type ConflictFunc func(name string, ours, theirs net.IP, src net.Addr)
+
+// detectAddressConflicts reports through OnAddressConflict the address records
+// received for the host names of announced registrations that carry addresses
+// other than ours, meaning another host on the link uses the same name. Unlike
+// detectConflicts, this is about names already claimed.
+func (c *Client) detectAddressConflicts(packet *Packet) {
+	if c.OnAddressConflict == nil {
+		return
+	}
+	type conflict struct {
+		name         string
+		ours, theirs net.IP
+	}
+	var conflicts []conflict
+
+	c.lock.RLock()
+	for _, rr := range append(packet.Msg.Answer, packet.Msg.Extra...) {
+		var theirs net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			theirs = rr.A
+		case *dns.AAAA:
+			theirs = rr.AAAA
+		default:
+			continue
+		}
+		if rr.Header().Ttl == 0 {
+			continue // goodbyes do not claim anything
+		}
+		var ours net.IP
+		matched, owned := false, false
+		for _, r := range c.registrations {
+			if r.probing || r.service.Target != "" || !strings.EqualFold(rr.Header().Name, r.service.hostName()) {
+				continue
+			}
+			matched = true
+			for _, ip := range r.service.IPs {
+				if ip.Equal(theirs) {
+					owned = true
+				} else if ours == nil && (ip.To4() == nil) == (theirs.To4() == nil) {
+					ours = ip
+				}
+			}
+		}
+		if matched && !owned {
+			conflicts = append(conflicts, conflict{name: rr.Header().Name, ours: ours, theirs: theirs})
+		}
+	}
+	c.lock.RUnlock()
+
+	for _, conflict := range conflicts {
+		c.OnAddressConflict(conflict.name, conflict.ours, conflict.theirs, packet.Src)
+	}
+}
+
+// defendInterval is how long a registration waits at least before defending its
+// records again, so that two hosts claiming the same ones do not flood the link
+const defendInterval = 10 * time.Second
+
+// defendRecords announces again the unique records of announced registrations
+// that a received response carries different data for, at most once every
+// defendInterval per registration.
+//
+// RFC 6762, section 9: a response containing a record with the same name,
+// rrtype and rrclass as one of our unique records, but different rdata, is a
+// conflict. Having won the name by probing, the records go out again with the
+// cache-flush bit, so that caches on the link drop the conflicting data.
+func (c *Client) defendRecords(msg *dns.Msg) {
+	now := c.Clock.Now()
+	var records []dns.RR
+
+	c.lock.Lock()
+	var received []dns.RR
+	for _, rr := range append(msg.Answer, msg.Extra...) {
+		// goodbyes do not claim anything, and our own records, e.g. looped back,
+		// do not conflict with those of other registrations on the same host
+		if rr.Header().Ttl != 0 && !c.owns(rr) {
+			received = append(received, rr)
+		}
+	}
+	for _, r := range c.registrations {
+		if len(received) == 0 || r.probing || now.Sub(r.defended) < defendInterval {
+			continue
+		}
+		defended := false
+		for _, rr := range received {
+		ours:
+			for _, own := range r.unique {
+				if own.Header().Rrtype != rr.Header().Rrtype || !strings.EqualFold(own.Header().Name, rr.Header().Name) ||
+					(!c.PartialAnswers && !c.isComplete(r, own)) {
+					continue
+				}
+				defended = true
+				// services on the same host share the address records
+				for _, included := range records {
+					if isSameRecord(included, own) {
+						continue ours
+					}
+				}
+				own = dns.Copy(own)
+				own.Header().Class |= cacheFlushBit
+				records = append(records, own)
+			}
+		}
+		if defended {
+			r.defended = now
+			count(&c.metrics.Conflicts, 1)
+		}
+	}
+	c.lock.Unlock()
+
+	if len(records) > 0 {
+		c.background(func() { c.sendResponse(records, nil, nil) })
+	}
+}
+
+// owns returns whether the given record is one of the unique records of our
+// registrations. Must be called with the lock held.
+func (c *Client) owns(rr dns.RR) bool {
+	for _, r := range c.registrations {
+		for _, own := range r.unique {
+			if isSameRecord(own, rr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// detectConflicts checks whether a received response contains records
+// for names we are currently probing, signalling the conflict
+func (c *Client) detectConflicts(msg *dns.Msg) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	for _, r := range c.registrations {
+		if !r.probing {
+			continue
+		}
+	records:
+		for _, rr := range append(msg.Answer, msg.Extra...) {
+			if !r.isUnique(rr.Header().Name) {
+				continue
+			}
+			for _, own := range r.unique {
+				if isSameRecord(own, rr) {
+					continue records
+				}
+			}
+			count(&c.metrics.Conflicts, 1)
+			select {
+			case r.conflicts <- rr.Header().Name:
+			default:
+			}
+			break
+		}
+	}
+}
+
+// answerQuery responds to an incoming query with the registered records
+// that answer it, if any. Answers are only ever sourced from the registration
+// table: records learned from other hosts in the cache are never used, so the
+// responder cannot disclose what it happened to overhear on the network.
+func (c *Client) answerQuery(packet *Packet) {
+	query := packet.Msg
+	if c.AllowDebugDump && packet.Src != nil {
+		c.sendDebugDump(query, packet.Src)
+	}
+	if src, ok := packet.Src.(*net.UDPAddr); ok && src.Port != mDNSPort && !c.ForceMulticastResponses {
+		if answers, extra := c.registeredAnswers(query.Question, query.Answer); len(answers) > 0 {
+			c.sendLegacyResponse(query, src, answers, extra)
+		}
+		return
+	}
+
+	// RFC 6762, section 5.4: questions with the unicast-response bit set are
+	// answered via unicast to the querier and the others via multicast, so a
+	// query mixing both kinds gets two responses. ForceMulticastResponses
+	// answers them all via multicast instead.
+	var unicast, multicast []dns.Question
+	for _, question := range query.Question {
+		if question.Qclass&(1<<15) != 0 && packet.Src != nil && !c.ForceMulticastResponses {
+			unicast = append(unicast, question)
+		} else {
+			multicast = append(multicast, question)
+		}
+	}
+	if answers, extra := c.registeredAnswers(multicast, query.Answer); len(answers) > 0 {
+		if answers = c.suppressAnswered(answers); len(answers) > 0 {
+			c.sendResponseInterface(answers, extra, packet.Interface)
+		}
+	}
+	if answers, extra := c.registeredAnswers(unicast, query.Answer); len(answers) > 0 {
+		c.sendResponse(answers, extra, packet.Src)
+	}
+}
+
+// answerSuppression is how long records multicast in answers are not multicast
+// again. RFC 6762, section 6: A Multicast DNS responder MUST NOT multicast a
+// record on a given interface until at least one second has elapsed since the
+// last time that record was multicast on that particular interface.
+const answerSuppression = time.Second
+
+// answerKey identifies a record by its content, regardless of TTL and cache-flush bit
+func answerKey(rr dns.RR) string {
+	key := dns.Copy(rr)
+	key.Header().Name = strings.ToLower(key.Header().Name)
+	key.Header().Class &^= cacheFlushBit
+	key.Header().Ttl = 0
+	return key.String()
+}
+
+// suppressAnswered drops the answers multicast within answerSuppression, on any
+// interface, and notes the others as multicast now. A client joined to several
+// interfaces of the same link sees queries once per interface, and would answer
+// each copy otherwise.
+func (c *Client) suppressAnswered(answers []dns.RR) []dns.RR {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := c.Clock.Now()
+	for key, sent := range c.answered {
+		if now.Sub(sent) >= answerSuppression {
+			delete(c.answered, key)
+		}
+	}
+	var fresh []dns.RR
+	for _, rr := range answers {
+		key := answerKey(rr)
+		if _, ok := c.answered[key]; !ok {
+			c.answered[key] = now
+			fresh = append(fresh, rr)
+		}
+	}
+	return fresh
+}
+
+// observeAnswers notes again the records of a received response that we
+// multicast within answerSuppression, since they are our own answers looped
+// back on another interface, so that the copies of the query that follow them
+// are not answered again
+func (c *Client) observeAnswers(msg *dns.Msg) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.answered) == 0 {
+		return
+	}
+	now := c.Clock.Now()
+	for _, rr := range msg.Answer {
+		key := answerKey(rr)
+		if sent, ok := c.answered[key]; ok && rr.Header().Ttl > 0 && now.Sub(sent) < answerSuppression {
+			c.answered[key] = now
+		}
+	}
+}
+
+// sendLegacyResponse answers a query coming from a simple resolver.
+//
+// RFC 6762, section 6.7: If the source UDP port in a received Multicast DNS
+// query is not port 5353, this indicates that the querier originating the
+// query is a simple resolver [...] the Multicast DNS responder MUST send a UDP
+// response directly back to the querier, via unicast, to the query packet's
+// source IP address and port. [...] it MUST repeat the query ID and the
+// question given in the query message. In addition, the cache-flush bit
+// described in Section 10.2 MUST NOT be set in legacy unicast responses.
+// The resource record TTL given in a legacy unicast response SHOULD NOT be
+// greater than ten seconds.
+func (c *Client) sendLegacyResponse(query *dns.Msg, dst net.Addr, answers, extra []dns.RR) {
+	legacy := func(records []dns.RR) []dns.RR {
+		out := make([]dns.RR, len(records))
+		for i, rr := range records {
+			out[i] = dns.Copy(rr)
+			out[i].Header().Class &^= cacheFlushBit
+			if out[i].Header().Ttl > legacyTTL {
+				out[i].Header().Ttl = legacyTTL
+			}
+		}
+		return out
+	}
+	for _, msg := range packResponses(legacy(answers), legacy(extra)) {
+		msg.Id = query.Id
+		msg.Question = query.Question
+		if err := c.send(msg, dst); err != nil {
+			c.logSampled("error: %s", err)
+		}
+	}
+}
+
+// registeredAnswers looks up the registered records that answer the given questions,
+// along with the related records that the querier will likely need next
+func (c *Client) registeredAnswers(questions []dns.Question, knownAnswers []dns.RR) (answers, extra []dns.RR) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	included := func(list []dns.RR, rr dns.RR) bool {
+		for _, r := range list {
+			if isSameRecord(r, rr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// unique names in the response, to assert which types they have
+	nsecs := make(map[string]dns.RR)
+	var nsecNames []string
+	addNSEC := func(r *registration, rr dns.RR) {
+		name := strings.ToLower(rr.Header().Name)
+		if nsecs[name] == nil && r.isUnique(name) {
+			nsecs[name] = r.nsec(name)
+			nsecNames = append(nsecNames, name)
+		}
+	}
+
+	for _, question := range questions {
+		for _, r := range c.registrations {
+			if r.probing {
+				continue
+			}
+			records := r.records()
+			if isReverseName(question.Name) {
+				for _, rr := range copyRecords(r.reverse) {
+					rr.Header().Class |= cacheFlushBit
+					records = append(records, rr)
+				}
+			}
+			for _, rr := range records {
+				if !strings.EqualFold(rr.Header().Name, question.Name) ||
+					(question.Qtype != dns.TypeANY && question.Qtype != rr.Header().Rrtype) {
+					continue
+				}
+				if isKnownAnswer(rr, knownAnswers) || included(answers, rr) {
+					continue
+				}
+				if !c.PartialAnswers && !c.isComplete(r, rr) {
+					continue
+				}
+				answers = append(answers, rr)
+				addNSEC(r, rr)
+				for _, additional := range r.additional(rr) {
+					extra = append(extra, additional)
+					addNSEC(r, additional)
+				}
+			}
+		}
+	}
+
+	// records in the answer section need not be repeated in the additional section
+	var filtered []dns.RR
+	for _, rr := range extra {
+		if !included(answers, rr) && !included(filtered, rr) {
+			filtered = append(filtered, rr)
+		}
+	}
+	for _, name := range nsecNames {
+		filtered = append(filtered, nsecs[name])
+	}
+	return answers, filtered
+}
+
+// nsec builds the NSEC record asserting which record types exist for the given
+// unique name of the registration. RFC 6762, section 6.1: when a responder
+// answers with unique records, it SHOULD include NSEC records in the additional
+// section, so that queriers know that other types do not exist and do not need
+// to ask for them.
+func (r *registration) nsec(name string) dns.RR {
+	nsec := &dns.NSEC{
+		Hdr: dns.RR_Header{Rrtype: dns.TypeNSEC, Class: dns.ClassINET | cacheFlushBit},
+	}
+	for _, rr := range r.unique {
+		if !strings.EqualFold(rr.Header().Name, name) {
+			continue
+		}
+		if nsec.Hdr.Name == "" || rr.Header().Ttl < nsec.Hdr.Ttl {
+			nsec.Hdr.Ttl = rr.Header().Ttl
+		}
+		nsec.Hdr.Name = rr.Header().Name
+		nsec.NextDomain = rr.Header().Name
+		if t := rr.Header().Rrtype; !containsType(nsec.TypeBitMap, t) {
+			nsec.TypeBitMap = append(nsec.TypeBitMap, t)
+		}
+	}
+	sort.Slice(nsec.TypeBitMap, func(i, j int) bool {
+		return nsec.TypeBitMap[i] < nsec.TypeBitMap[j]
+	})
+	return nsec
+}
+
+// containsType checks whether the list of record types includes the given one
+func containsType(types []uint16, t uint16) bool {
+	for _, x := range types {
+		if x == t {
+			return true
+		}
+	}
+	return false
+}
+
+// isComplete checks whether an answer with the given record of the registration
+// leads the querier to a usable service, that is, whether there are addresses
+// registered for the target host of PTR and SRV records. RFC 6762, section 6:
+// a responder that only knows part of the answer should let a more complete one
+// answer instead. Must be called with the lock held.
+func (c *Client) isComplete(r *registration, rr dns.RR) bool {
+	if t := rr.Header().Rrtype; t != dns.TypePTR && t != dns.TypeSRV {
+		return true
+	}
+	if r.service.Target != "" {
+		// the target host is resolved by other means
+		return true
+	}
+	host := r.service.hostName()
+	for _, other := range c.registrations {
+		if other.probing {
+			continue
+		}
+		for _, a := range other.unique {
+			if t := a.Header().Rrtype; (t == dns.TypeA || t == dns.TypeAAAA) && strings.EqualFold(a.Header().Name, host) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// additional returns records that should go in the additional section when
+// answering with the given record (RFC 6763, section 12)
+func (r *registration) additional(answer dns.RR) []dns.RR {
+	if strings.EqualFold(answer.Header().Name, r.service.serviceTypesName()) {
+		// service type enumeration needs no more records
+		return nil
+	}
+	var extra []dns.RR
+	for _, rr := range r.records() {
+		switch {
+		case answer.Header().Rrtype == dns.TypePTR && !isReverseName(answer.Header().Name):
+			// include SRV, TXT and address records
+			if !isSameRecord(rr, answer) && rr.Header().Rrtype != dns.TypePTR {
+				extra = append(extra, rr)
+			}
+		case answer.Header().Rrtype == dns.TypeSRV, answer.Header().Rrtype == dns.TypePTR:
+			// include address records, also for reverse mapping PTR records
+			if t := rr.Header().Rrtype; t == dns.TypeA || t == dns.TypeAAAA {
+				extra = append(extra, rr)
+			}
+		}
+	}
+	return extra
+}
+
+// isKnownAnswer checks whether the querier already knows the record, with at least half
+// its TTL remaining, in which case we must not answer with it (RFC 6762, section 7.1)
+func isKnownAnswer(rr dns.RR, knownAnswers []dns.RR) bool {
+	for _, known := range knownAnswers {
+		if isSameRecord(rr, known) && known.Header().Ttl >= rr.Header().Ttl/2 {
+			return true
+		}
+	}
+	return false
+}
+
+// isSameRecord compares two records ignoring TTL and the cache-flush bit
+func isSameRecord(a, b dns.RR) bool {
+	a, b = dns.Copy(a), dns.Copy(b)
+	a.Header().Class &^= cacheFlushBit
+	b.Header().Class &^= cacheFlushBit
+	return dns.IsDuplicate(a, b)
+}
+
+// sendResponse sends out the given records in as many response messages as
+// necessary, to dst, or to the mDNS multicast group if dst is nil
+func (c *Client) sendResponse(answers, extra []dns.RR, dst net.Addr) {
+	for _, msg := range packResponses(answers, extra) {
+		if err := c.send(msg, dst); err != nil {
+			c.logSampled("error: %s", err)
+		}
+	}
+}
+
+// sendResponseInterface multicasts the response on the given network interface,
+// the one the query arrived on, so that answers do not leak to other segments
+// in multi-homed hosts. If the interface is unknown, it goes out on all of them.
+func (c *Client) sendResponseInterface(answers, extra []dns.RR, iface string) {
+	if iface == "" {
+		c.sendResponse(answers, extra, nil)
+		return
+	}
+	for _, msg := range packResponses(answers, extra) {
+		if err := c.sendInterface(msg, iface); err != nil {
+			c.logSampled("error: %s", err)
+		}
+	}
+}
+
+// packResponses splits the given records in response messages that do not exceed
+// maxMessageSize once compressed. Additional records are optional, so they are
+// only included in the last message as long as they fit.
+func packResponses(answers, extra []dns.RR) []*dns.Msg {
+	var msgs []*dns.Msg
+	msg := newResponse()
+	for _, rr := range answers {
+		msg.Answer = append(msg.Answer, rr)
+		if len(msg.Answer) > 1 && msg.Len() > maxMessageSize {
+			msg.Answer = msg.Answer[:len(msg.Answer)-1]
+			msgs = append(msgs, msg)
+			msg = newResponse()
+			msg.Answer = []dns.RR{rr}
+		}
+	}
+	for _, rr := range extra {
+		msg.Extra = append(msg.Extra, rr)
+		if msg.Len() > maxMessageSize {
+			msg.Extra = msg.Extra[:len(msg.Extra)-1]
+		}
+	}
+	return append(msgs, msg)
+}
+
+// newResponse builds an empty mDNS response message. Records in mDNS responses
+// share long suffixes such as ._tcp.local., so name compression is always on
+func newResponse() *dns.Msg {
+	msg := new(dns.Msg)
+	msg.Response = true
+	msg.Authoritative = true
+	msg.Compress = true
+	return msg
+}
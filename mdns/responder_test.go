@@ -0,0 +1,1405 @@
+package mdns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/epiclabs-io/ut"
+	"github.com/miekg/dns"
+	"github.com/tilinna/clock"
+)
+
+var demoService = Service{
+	Instance: "demo",
+	Service:  "_service1._tcp",
+	Host:     "terminus.local",
+	Port:     8080,
+	Text:     map[string]string{"path": "/demo", "version": "1"},
+	IPs:      []net.IP{net.ParseIP("5.6.7.8"), net.ParseIP("fe80::abc:cdef:0123:4567")},
+}
+
+// nextMessage advances the clock in small steps until the client sends a message,
+// for messages whose timing depends on when background goroutines arm their timers
+func nextMessage(clk *clock.Mock, mt *mockTransport) *dns.Msg {
+	for {
+		select {
+		case msg := <-mt.out:
+			return msg
+		default:
+			clk.Add(announceBatchWindow / 4)
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestRegister(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+
+	t.MustFail(c.Register(&Service{Service: "_service1._tcp", Host: "terminus.local"}), "Expected an error registering a service without instance name")
+
+	service := demoService
+	t.Ok(c.Register(&service))
+
+	// the unique records must be probed first
+	for i := 0; i < probeCount; i++ {
+		msg := <-mt.out
+		equalsMessage(t, fmt.Sprintf("probe%02d.txt", i), msg)
+		clk.Add(probeInterval)
+	}
+
+	// then all records are announced, setting the cache-flush bit
+	// only on the unique records
+	for i := 0; i < announceCount; i++ {
+		var msg *dns.Msg
+		if i == 0 {
+			msg = nextMessage(clk, mt)
+		} else {
+			msg = <-mt.out
+		}
+		equalsMessage(t, fmt.Sprintf("announce%02d.txt", i), msg)
+		for _, rr := range msg.Answer {
+			if rr.Header().Rrtype == dns.TypePTR {
+				t.Equals(uint16(dns.ClassINET), rr.Header().Class)
+			} else {
+				t.Equals(uint16(dns.ClassINET|cacheFlushBit), rr.Header().Class)
+			}
+		}
+		clk.Add(announceInterval)
+	}
+
+	// queries for the service are answered with the registered records
+	query := new(dns.Msg)
+	query.SetQuestion("_service1._tcp.local.", dns.TypePTR)
+	mt.in <- &Packet{Msg: query}
+	answer := <-mt.out
+	equalsMessage(t, "answer.txt", answer)
+
+	// known answers are not repeated
+	query.Answer = answer.Answer
+	query.Question[0].Qtype = dns.TypeANY
+	query.Question = append(query.Question, dns.Question{Name: "terminus.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	mt.in <- &Packet{Msg: query}
+	equalsMessage(t, "answer-known.txt", <-mt.out)
+
+	// closing the client says goodbye
+	go c.Close()
+	equalsMessage(t, "goodbye.txt", <-mt.out)
+}
+
+func TestRegisterTarget(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+
+	// the service runs on a host we only proxy for
+	service := demoService
+	service.Host = ""
+	service.Target = "printer.example.com"
+	t.Ok(c.Register(&service))
+
+	// only the instance name is probed
+	equalsMessage(t, "probe.txt", <-mt.out)
+	for i := 0; i < probeCount; i++ {
+		clk.Add(probeInterval)
+		if i < probeCount-1 {
+			<-mt.out
+		}
+	}
+
+	// and no address records are announced
+	msg := nextMessage(clk, mt)
+	equalsMessage(t, "announce.txt", msg)
+	for _, rr := range append(msg.Answer, msg.Extra...) {
+		rrtype := rr.Header().Rrtype
+		t.Assert(rrtype != dns.TypeA && rrtype != dns.TypeAAAA, "Unexpected address record announced: %s", rr)
+	}
+	clk.Add(announceInterval)
+	<-mt.out
+
+	// the service is answered for, even though it has no registered addresses
+	query := new(dns.Msg)
+	query.SetQuestion("_service1._tcp.local.", dns.TypePTR)
+	mt.in <- &Packet{Msg: query}
+	equalsMessage(t, "answer.txt", <-mt.out)
+
+	go c.Close()
+	<-mt.out
+}
+
+func TestRegisterConflict(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+
+	service := demoService
+	t.Ok(c.Register(&service))
+	<-mt.out
+
+	// another host answers with a different SRV for our instance name
+	conflict := new(dns.Msg)
+	conflict.Response = true
+	conflict.Answer = parseRecords(t, `
+	demo._service1._tcp.local.	120	IN	SRV		0 0 80 praetor.local.
+	`)
+	mt.in <- &Packet{Msg: conflict}
+
+	// probing restarts with a new instance name
+	equalsMessage(t, "probe-renamed.txt", <-mt.out)
+	clk.Add(probeInterval)
+	<-mt.out
+	clk.Add(probeInterval)
+	<-mt.out
+	clk.Add(probeInterval)
+	equalsMessage(t, "announce-renamed.txt", nextMessage(clk, mt))
+	clk.Add(announceInterval)
+	<-mt.out
+
+	go c.Close()
+	<-mt.out
+}
+
+func TestRenameFormat(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+		RenameFormat: func(base string, n int) string {
+			return fmt.Sprintf("%s-%d", base, n)
+		},
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	service := demoService
+	t.Ok(c.Register(&service))
+	<-mt.out
+
+	conflict := new(dns.Msg)
+	conflict.Response = true
+	conflict.Answer = parseRecords(t, `
+	demo._service1._tcp.local.	120	IN	SRV		0 0 80 praetor.local.
+	`)
+	mt.in <- &Packet{Msg: conflict}
+
+	// probing restarts with the name built by RenameFormat
+	t.Equals("demo-2._service1._tcp.local.", (<-mt.out).Question[0].Name)
+}
+
+func TestRegisterBatch(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+
+	const count = 10
+	for i := 0; i < count; i++ {
+		service := demoService
+		service.Instance = fmt.Sprintf("demo%02d", i)
+		t.Ok(c.Register(&service))
+	}
+	for i := 0; i < probeCount; i++ {
+		for j := 0; j < count; j++ {
+			<-mt.out
+		}
+		clk.Add(probeInterval)
+	}
+
+	// all services are announced together, in as few messages as fit
+	for i := 0; i < announceCount; i++ {
+		msg := nextMessage(clk, mt)
+		instances := 0
+		for _, rr := range msg.Answer {
+			if rr.Header().Rrtype == dns.TypePTR && rr.Header().Name == "_service1._tcp.local." {
+				instances++
+			}
+		}
+		t.Equals(count, instances)
+		clk.Add(announceInterval)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		c.Close()
+		close(done)
+	}()
+	// the goodbye may take several messages
+	for closed := false; !closed; {
+		select {
+		case <-mt.out:
+		case <-done:
+			closed = true
+		}
+	}
+}
+
+func TestAnswerSource(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+
+	service := demoService
+	t.Ok(c.Register(&service))
+	for i := 0; i < probeCount; i++ {
+		<-mt.out
+		clk.Add(probeInterval)
+	}
+	nextMessage(clk, mt)
+	clk.Add(announceInterval)
+	<-mt.out
+
+	// the cache learns other instances of the same service type and other hosts
+	c.addToCache(parseRecords(t, zone))
+
+	// queries only about cached records are not answered at all
+	query := new(dns.Msg)
+	query.SetQuestion("www.epiclabs.io.", dns.TypeA)
+	mt.in <- &Packet{Msg: query}
+
+	// queries about registered records are answered without the cached ones
+	query = new(dns.Msg)
+	query.SetQuestion("_service1._tcp.local.", dns.TypePTR)
+	mt.in <- &Packet{Msg: query}
+	answer := <-mt.out
+	equalsMessage(t, "answer.txt", answer)
+	t.Equals(1, len(answer.Answer))
+
+	go c.Close()
+	<-mt.out
+}
+
+func TestLegacyUnicast(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+
+	service := demoService
+	t.Ok(c.Register(&service))
+	for i := 0; i < probeCount; i++ {
+		<-mt.out
+		clk.Add(probeInterval)
+	}
+	nextMessage(clk, mt)
+	clk.Add(announceInterval)
+	<-mt.out
+
+	// queries from the mDNS port are answered by multicast
+	query := new(dns.Msg)
+	query.SetQuestion("demo._service1._tcp.local.", dns.TypeSRV)
+	mt.in <- &Packet{Msg: query, Src: &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 5353}}
+	<-mt.out
+	t.Assert(mt.dst == nil, "Expected a multicast response")
+
+	// queries from any other port get a unicast reply to the querier,
+	// echoing the query, with capped TTLs and no cache-flush bit
+	query.Id = 4321
+	src := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 49152}
+	mt.in <- &Packet{Msg: query, Src: src}
+	answer := <-mt.out
+	t.Equals(src, mt.dst)
+	t.Equals(query.Id, answer.Id)
+	equalsMessage(t, "answer.txt", answer)
+
+	go c.Close()
+	<-mt.out
+}
+
+func TestAnnounce(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+
+	service := demoService
+	t.Ok(c.Register(&service))
+	<-mt.out
+
+	// services cannot be announced until probing is over
+	err = c.Announce("demo")
+	t.MustFail(err, "Expected an error announcing while probing")
+	t.Equals(`Service instance "demo" is still probing`, err.Error())
+
+	for i := 1; i < probeCount; i++ {
+		clk.Add(probeInterval)
+		<-mt.out
+	}
+	clk.Add(probeInterval)
+	nextMessage(clk, mt)
+	clk.Add(announceInterval)
+	<-mt.out
+
+	err = c.Announce("other")
+	t.MustFail(err, "Expected an error announcing an unknown instance")
+	t.Equals(`Service instance "other" is not registered`, err.Error())
+
+	// the registered records go out again, as many times as when registering
+	t.Ok(c.Announce("demo._service1._tcp.local"))
+	equalsMessage(t, "announce00.txt", nextMessage(clk, mt))
+	clk.Add(announceInterval)
+	equalsMessage(t, "announce01.txt", <-mt.out)
+
+	go c.Close()
+	<-mt.out
+}
+
+func TestDebugDump(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	service := demoService
+	t.Ok(c.Register(&service))
+	<-mt.out
+
+	// the dump is not answered by default
+	query := new(dns.Msg)
+	query.SetQuestion(debugDumpName, dns.TypeTXT)
+	mt.in <- &Packet{Msg: query}
+	// the transport is unbuffered, so this one ensures the above was processed
+	// without sending anything
+	mt.in <- &Packet{Msg: new(dns.Msg)}
+
+	// once allowed, it is only sent to the querier
+	c.AllowDebugDump = true
+	src := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 5353}
+	mt.in <- &Packet{Msg: query, Src: src}
+	equalsMessage(t, "dump.txt", <-mt.out)
+	t.Equals(src, mt.dst)
+}
+
+func TestLogSampleRate(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:          clk,
+		Transport:      mt,
+		AllowDebugDump: true,
+		LogSampleRate:  3,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	service := demoService
+	t.Ok(c.Register(&service))
+	<-mt.out
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	// every dump fails to be sent, but only one in three failures is logged
+	mt.err = errors.New("Network is down")
+	query := new(dns.Msg)
+	query.SetQuestion(debugDumpName, dns.TypeTXT)
+	src := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 5353}
+	for i := 0; i < 7; i++ {
+		mt.in <- &Packet{Msg: query, Src: src}
+	}
+	mt.in <- &Packet{Msg: new(dns.Msg)}
+	t.Equals(3, strings.Count(buf.String(), "Network is down"))
+}
+
+func TestPartialAnswers(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+
+	// a service without addresses for its host
+	service := demoService
+	service.IPs = nil
+	t.Ok(c.Register(&service))
+	for i := 0; i < probeCount; i++ {
+		<-mt.out
+		clk.Add(probeInterval)
+	}
+
+	// only the TXT record is announced, like it is answered below
+	equalsMessage(t, "announce.txt", nextMessage(clk, mt))
+	clk.Add(announceInterval)
+	<-mt.out
+
+	// by default, we stay silent and let a more complete responder answer
+	query := new(dns.Msg)
+	query.SetQuestion("demo._service1._tcp.local.", dns.TypeSRV)
+	mt.in <- &Packet{Msg: query}
+	// the transport is unbuffered, so this one ensures the above was processed
+	// without sending anything
+	mt.in <- &Packet{Msg: new(dns.Msg)}
+
+	// records that do not depend on addresses are still answered
+	txtQuery := new(dns.Msg)
+	txtQuery.SetQuestion("demo._service1._tcp.local.", dns.TypeTXT)
+	mt.in <- &Packet{Msg: txtQuery}
+	equalsMessage(t, "answer-txt.txt", <-mt.out)
+
+	// when allowed, we answer with what we have
+	c.PartialAnswers = true
+	mt.in <- &Packet{Msg: query}
+	equalsMessage(t, "answer-partial.txt", <-mt.out)
+
+	go c.Close()
+	<-mt.out
+}
+
+func TestCloseContext(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+
+	service := demoService
+	t.Ok(c.Register(&service))
+	for i := 0; i < probeCount; i++ {
+		<-mt.out
+		clk.Add(probeInterval)
+	}
+	nextMessage(clk, mt)
+	clk.Add(announceInterval)
+	<-mt.out
+
+	// nobody reads the goodbye, so shutdown cannot complete in time
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	t.Equals(context.DeadlineExceeded, c.CloseContext(ctx))
+	<-mt.out
+
+	// the client is closed anyway
+	t.Equals(errClosed, c.Register(&service))
+	t.Ok(c.Close())
+}
+
+func TestNSEC(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+
+	// a host with an IPv4 address only
+	service := demoService
+	service.IPs = service.IPs[:1]
+	t.Ok(c.Register(&service))
+	for i := 0; i < probeCount; i++ {
+		<-mt.out
+		clk.Add(probeInterval)
+	}
+	nextMessage(clk, mt)
+	clk.Add(announceInterval)
+	<-mt.out
+
+	// the answer asserts the host has no AAAA record
+	query := new(dns.Msg)
+	query.SetQuestion("terminus.local.", dns.TypeA)
+	mt.in <- &Packet{Msg: query}
+	answer := <-mt.out
+	equalsMessage(t, "answer.txt", answer)
+	t.Equals(1, len(answer.Extra))
+	nsec := answer.Extra[0].(*dns.NSEC)
+	t.Equals("terminus.local.", nsec.NextDomain)
+	t.Equals([]uint16{dns.TypeA}, nsec.TypeBitMap)
+
+	go c.Close()
+	<-mt.out
+}
+
+func TestMixedUnicastQuery(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+
+	service := demoService
+	t.Ok(c.Register(&service))
+	for i := 0; i < probeCount; i++ {
+		<-mt.out
+		clk.Add(probeInterval)
+	}
+	nextMessage(clk, mt)
+	clk.Add(announceInterval)
+	<-mt.out
+
+	// the QM question is answered via multicast, the QU one via unicast
+	src := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 5353}
+	query := new(dns.Msg)
+	query.Question = []dns.Question{
+		{Name: "_service1._tcp.local.", Qtype: dns.TypePTR, Qclass: dns.ClassINET},
+		{Name: "terminus.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET | 1<<15},
+	}
+	mt.in <- &Packet{Msg: query, Src: src}
+	equalsMessage(t, "multicast.txt", <-mt.out)
+	equalsMessage(t, "unicast.txt", <-mt.out)
+	t.Equals(src, mt.dst)
+
+	go c.Close()
+	<-mt.out
+}
+
+func TestReverseMapping(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+
+	service := demoService
+	t.Ok(c.Register(&service))
+	for i := 0; i < probeCount; i++ {
+		<-mt.out
+		clk.Add(probeInterval)
+	}
+	nextMessage(clk, mt)
+	clk.Add(announceInterval)
+	<-mt.out
+
+	// both addresses map back to the host name
+	query := new(dns.Msg)
+	query.Question = []dns.Question{
+		{Name: "8.7.6.5.in-addr.arpa.", Qtype: dns.TypePTR, Qclass: dns.ClassINET},
+		{Name: "7.6.5.4.3.2.1.0.f.e.d.c.c.b.a.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.e.f.ip6.arpa.", Qtype: dns.TypePTR, Qclass: dns.ClassINET},
+	}
+	mt.in <- &Packet{Msg: query}
+	equalsMessage(t, "response.txt", <-mt.out)
+
+	// addresses not registered are not answered for
+	query.Question = []dns.Question{{Name: "9.7.6.5.in-addr.arpa.", Qtype: dns.TypePTR, Qclass: dns.ClassINET}}
+	mt.in <- &Packet{Msg: query}
+	select {
+	case msg := <-mt.out:
+		t.Fatalf("Unexpected response: %s", msg)
+	case mt.in <- &Packet{Msg: new(dns.Msg)}:
+	}
+
+	go c.Close()
+	<-mt.out
+}
+
+func TestServiceTypes(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+
+	service := demoService
+	service.Service = "_http._tcp"
+	t.Ok(c.Register(&service))
+	for i := 0; i < probeCount; i++ {
+		<-mt.out
+		clk.Add(probeInterval)
+	}
+
+	// the service type is announced along with the instance
+	meta := "_services._dns-sd._udp.local.\t4500\tIN\tPTR\t_http._tcp.local."
+	announced := false
+	for _, rr := range nextMessage(clk, mt).Answer {
+		announced = announced || rr.String() == meta
+	}
+	t.Assert(announced, "Expected the service type to be announced")
+	clk.Add(announceInterval)
+	<-mt.out
+
+	// and answered for, with no additional records
+	query := new(dns.Msg)
+	query.SetQuestion("_services._dns-sd._udp.local.", dns.TypePTR)
+	mt.in <- &Packet{Msg: query}
+	equalsMessage(t, "response.txt", <-mt.out)
+
+	go c.Close()
+	<-mt.out
+}
+
+func TestReplyInterface(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+
+	service := demoService
+	t.Ok(c.Register(&service))
+	for i := 0; i < probeCount; i++ {
+		<-mt.out
+		clk.Add(probeInterval)
+	}
+	nextMessage(clk, mt)
+	clk.Add(announceInterval)
+	<-mt.out
+
+	// multicast answers only go out on the interface the query arrived on
+	query := new(dns.Msg)
+	query.SetQuestion("terminus.local.", dns.TypeA)
+	mt.in <- &Packet{Msg: query, Interface: "eth1"}
+	t.Equals(1, len((<-mt.out).Answer))
+	t.Equals("eth1", mt.iface)
+
+	// or on all of them, if unknown
+	clk.Add(answerSuppression)
+	mt.in <- &Packet{Msg: query}
+	t.Equals(1, len((<-mt.out).Answer))
+	t.Equals("", mt.iface)
+
+	go c.Close()
+	<-mt.out
+}
+
+func TestMultihomedHost(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+
+	// an address listed twice is only published once
+	service := demoService
+	service.IPs = []net.IP{
+		net.ParseIP("192.168.1.10"),
+		net.ParseIP("10.0.0.10"),
+		net.ParseIP("fe80::10"),
+		net.ParseIP("::ffff:10.0.0.10"),
+	}
+	t.Ok(c.Register(&service))
+	for i := 0; i < probeCount; i++ {
+		<-mt.out
+		clk.Add(probeInterval)
+	}
+	equalsMessage(t, "announcement.txt", nextMessage(clk, mt))
+	clk.Add(announceInterval)
+	<-mt.out
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		query := new(dns.Msg)
+		query.SetQuestion("terminus.local.", qtype)
+		mt.in <- &Packet{Msg: query}
+		equalsMessage(t, dns.TypeToString[qtype]+".txt", <-mt.out)
+	}
+
+	go c.Close()
+	<-mt.out
+}
+
+func TestDualStackQuery(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+
+	dualStack := Service{
+		Instance: "epic",
+		Service:  "_service1._tcp",
+		Host:     "primus.local",
+		Port:     7979,
+		IPs:      []net.IP{net.ParseIP("1.2.3.4"), net.ParseIP("fe80::abc:cdef:0123:4567")},
+	}
+	ipv4Only := demoService
+	ipv4Only.IPs = ipv4Only.IPs[:1]
+	for _, service := range []*Service{&dualStack, &ipv4Only} {
+		t.Ok(c.Register(service))
+		for i := 0; i < probeCount; i++ {
+			<-mt.out
+			clk.Add(probeInterval)
+		}
+		nextMessage(clk, mt)
+		clk.Add(announceInterval)
+		<-mt.out
+	}
+
+	// asking for both families gets a single response, asserting with NSEC
+	// which of them do not exist
+	for _, host := range []string{"primus.local.", "terminus.local."} {
+		query := new(dns.Msg)
+		query.Question = []dns.Question{
+			{Name: host, Qtype: dns.TypeA, Qclass: dns.ClassINET},
+			{Name: host, Qtype: dns.TypeAAAA, Qclass: dns.ClassINET},
+		}
+		mt.in <- &Packet{Msg: query}
+		equalsMessage(t, strings.TrimSuffix(host, ".local.")+".txt", <-mt.out)
+		select {
+		case msg := <-mt.out:
+			t.Fatal("Expected a single response, got another one: %s", msg)
+		case mt.in <- &Packet{Msg: new(dns.Msg)}:
+		}
+	}
+
+	go c.Close()
+	<-mt.out
+}
+
+func TestAddressConflict(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	var conflicts []string
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+		OnAddressConflict: func(name string, ours, theirs net.IP, src net.Addr) {
+			conflicts = append(conflicts, fmt.Sprintf("%s %s %s %s", name, ours, theirs, src))
+		},
+	})
+	t.Ok(err)
+
+	service := demoService
+	t.Ok(c.Register(&service))
+	for i := 0; i < probeCount; i++ {
+		<-mt.out
+		clk.Add(probeInterval)
+	}
+	nextMessage(clk, mt)
+	clk.Add(announceInterval)
+	<-mt.out
+
+	// another host answers for our host name, along with our own addresses
+	// looped back, which are no conflict, nor are goodbyes
+	src := &net.UDPAddr{IP: net.ParseIP("5.6.7.9"), Port: 5353}
+	msg := new(dns.Msg)
+	msg.Response = true
+	msg.Answer = parseRecords(t, `
+	terminus.local.		120	IN	A		5.6.7.9
+	terminus.local.		120	IN	A		5.6.7.8
+	terminus.local.		120	IN	AAAA	fe80::abc:cdef:0123:4567
+	terminus.local.		0	IN	AAAA	fe80::1
+	other.local.		120	IN	A		5.6.7.10
+	`)
+	mt.in <- &Packet{Msg: msg, Src: src}
+	// our address is defended, see TestDefendRecords
+	<-mt.out
+	t.Equals([]string{"terminus.local. 5.6.7.8 5.6.7.9 5.6.7.9:5353"}, conflicts)
+
+	go c.Close()
+	<-mt.out
+}
+
+func TestDefendRecords(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+
+	service := demoService
+	t.Ok(c.Register(&service))
+	for i := 0; i < probeCount; i++ {
+		<-mt.out
+		clk.Add(probeInterval)
+	}
+	nextMessage(clk, mt)
+	clk.Add(announceInterval)
+	<-mt.out
+
+	// another host answers for our host name with a different address, so
+	// our address goes out again to correct it
+	msg := new(dns.Msg)
+	msg.Response = true
+	msg.Answer = parseRecords(t, `
+	terminus.local.		120	IN	A		5.6.7.9
+	`)
+	mt.in <- &Packet{Msg: msg}
+	equalsMessage(t, "defense.txt", <-mt.out)
+
+	// but not again right away
+	mt.in <- &Packet{Msg: msg}
+	select {
+	case msg := <-mt.out:
+		t.Fatalf("Unexpected defense sent right away: %s", msg)
+	case mt.in <- &Packet{Msg: new(dns.Msg)}:
+	}
+
+	clk.Add(defendInterval)
+	mt.in <- &Packet{Msg: msg}
+	equalsMessage(t, "defense.txt", <-mt.out)
+
+	go c.Close()
+	<-mt.out
+}
+
+func TestRegisterTwice(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	service := demoService
+	t.Ok(c.Register(&service))
+	<-mt.out
+
+	// registering the same instance name again, even with different case, is refused
+	again := demoService
+	again.Instance = "Demo"
+	again.Port = 9090
+	err = c.Register(&again)
+	t.MustFail(err, "Expected an error registering the same instance twice")
+	t.Equals(`Service instance "Demo._service1._tcp.local." is already registered`, err.Error())
+}
+
+func TestPackResponses(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	var records []dns.RR
+	for i := 0; i < 30; i++ {
+		records = append(records, &dns.PTR{
+			Hdr: dns.RR_Header{Name: "_service1._tcp.local.", Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: otherTTL},
+			Ptr: fmt.Sprintf("instance%02d._service1._tcp.local.", i),
+		})
+	}
+
+	// without compression, the records would not fit in a single message
+	uncompressed := &dns.Msg{Answer: records}
+	t.Assert(uncompressed.Len() > maxMessageSize, "Expected uncompressed message to exceed %d bytes", maxMessageSize)
+
+	// compression allows them to go in a single packet
+	msgs := packResponses(records, nil)
+	t.Equals(1, len(msgs))
+	t.Equals(30, len(msgs[0].Answer))
+	buf, err := msgs[0].Pack()
+	t.Ok(err)
+	t.Assert(len(buf) <= maxMessageSize, "Expected packed message to fit in %d bytes, got %d", maxMessageSize, len(buf))
+
+	// records that do not fit are split in several messages
+	for i := 30; i < 200; i++ {
+		records = append(records, &dns.PTR{
+			Hdr: dns.RR_Header{Name: "_service1._tcp.local.", Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: otherTTL},
+			Ptr: fmt.Sprintf("instance%03d._service1._tcp.local.", i),
+		})
+	}
+	msgs = packResponses(records, records[:10])
+	t.Assert(len(msgs) > 1, "Expected records to be split in several messages")
+	count := 0
+	for _, msg := range msgs {
+		buf, err := msg.Pack()
+		t.Ok(err)
+		t.Assert(len(buf) <= maxMessageSize, "Expected packed message to fit in %d bytes, got %d", maxMessageSize, len(buf))
+		count += len(msg.Answer)
+	}
+	t.Equals(len(records), count)
+}
+
+func TestServiceText(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	// a metadata map with entries right at the TXT string limit
+	service := demoService
+	service.Text = map[string]string{
+		"a":    strings.Repeat("x", maxTXTStringSize-2),
+		"b":    strings.Repeat("y", maxTXTStringSize-2),
+		"path": `C:\demo`,
+	}
+	t.Ok(service.validate())
+
+	// each entry must go in its own string within a single TXT record
+	_, unique := service.records()
+	var txt *dns.TXT
+	for _, rr := range unique {
+		if record, ok := rr.(*dns.TXT); ok {
+			txt = record
+		}
+	}
+	t.Assert(txt != nil, "Expected a TXT record")
+	msg := &dns.Msg{Answer: []dns.RR{txt}}
+	buf, err := msg.Pack()
+	t.Ok(err)
+	t.Ok(msg.Unpack(buf))
+	parsed := msg.Answer[0].(*dns.TXT)
+	t.Equals(3, len(parsed.Txt))
+	t.Equals(maxTXTStringSize, len(parsed.Txt[0]))
+	t.Equals(maxTXTStringSize, len(parsed.Txt[1]))
+	t.Equals(`path=C:\\demo`, parsed.Txt[2])
+
+	// one byte more does not fit in a TXT string
+	service.Text["a"] += "x"
+	err = service.validate()
+	t.MustFail(err, "Expected oversized text entry to be rejected")
+	t.Equals(`Service text entry "a" is 256 bytes long, exceeding the 255 bytes limit`, err.Error())
+
+	c, err := New(&Config{
+		Clock:     clock.NewMock(time.Unix(0, 0)),
+		Transport: newMockTransport(),
+	})
+	t.Ok(err)
+	defer c.Close()
+	t.MustFail(c.Register(&service), "Expected Register to reject the oversized text entry")
+}
+
+func TestInstanceName(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	t.Equals(`My\ Printer._ipp._tcp.local.`, MakeInstanceName("My Printer", "_ipp._tcp", ""))
+	t.Equals(`a\.b._http._tcp.example.com.`, MakeInstanceName("a.b", "_http._tcp.", "example.com"))
+
+	for _, instance := range []string{
+		"My Printer",
+		"Dots. Everywhere.",
+		`C:\shared (2)`,
+		`"quoted"; @home`,
+		"Café\tTab",
+		"\\063",
+	} {
+		name := MakeInstanceName(instance, "_ipp._tcp", "local.")
+
+		// the name compares equal to the same name received off the wire
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeSRV)
+		buf, err := msg.Pack()
+		t.Ok(err)
+		t.Ok(msg.Unpack(buf))
+		t.Equals(name, msg.Question[0].Name)
+
+		parsed, service, domain, err := ParseInstanceName(name)
+		t.Ok(err)
+		t.Equals(instance, parsed)
+		t.Equals("_ipp._tcp", service)
+		t.Equals("local.", domain)
+	}
+
+	_, _, _, err := ParseInstanceName("myhost.local.")
+	t.MustFail(err, "Expected a host name to be rejected")
+	_, _, _, err = ParseInstanceName("epic.service1.tcp.local.")
+	t.MustFail(err, "Expected a name without service labels to be rejected")
+	_, _, _, err = ParseInstanceName(`epic\._ipp._tcp.local.`)
+	t.MustFail(err, "Expected an escaped dot not to split labels")
+}
+
+func TestRegisterWarmCache(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+
+	service := demoService
+	t.Ok(c.Register(&service))
+	for i := 0; i < probeCount; i++ {
+		<-mt.out
+		clk.Add(probeInterval)
+	}
+	nextMessage(clk, mt)
+
+	// once announced, the service resolves off the cache
+	var records []dns.RR
+	done := make(chan struct{})
+	go func() {
+		records, err = c.Query(context.Background(), dns.Question{Name: "_service1._tcp.local.", Qtype: dns.TypePTR, Qclass: dns.ClassINET})
+		close(done)
+	}()
+	select {
+	case msg := <-mt.out:
+		t.Fatalf("Expected no network traffic, got %s", msg)
+	case <-done:
+	}
+	t.Ok(err)
+	types := make(map[uint16]int)
+	for _, rr := range records {
+		t.Equals(uint16(dns.ClassINET), rr.Header().Class)
+		types[rr.Header().Rrtype]++
+	}
+	t.Equals(map[uint16]int{dns.TypePTR: 1, dns.TypeSRV: 1, dns.TypeTXT: 1, dns.TypeA: 1, dns.TypeAAAA: 1}, types)
+
+	go c.Close()
+	<-mt.out
+}
+
+func TestAnswerSuppression(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+
+	service := demoService
+	t.Ok(c.Register(&service))
+	for i := 0; i < probeCount; i++ {
+		<-mt.out
+		clk.Add(probeInterval)
+	}
+	nextMessage(clk, mt)
+	clk.Add(announceInterval)
+	<-mt.out
+
+	// a query seen on one interface is answered
+	query := new(dns.Msg)
+	query.SetQuestion("terminus.local.", dns.TypeA)
+	mt.in <- &Packet{Msg: query, Interface: "eth0"}
+	answer := <-mt.out
+
+	// our answer loops back on another interface, followed by the same query
+	clk.Add(answerSuppression / 2)
+	mt.in <- &Packet{Msg: answer, Interface: "eth1"}
+	mt.in <- &Packet{Msg: new(dns.Msg)}
+	clk.Add(answerSuppression / 2)
+	mt.in <- &Packet{Msg: query, Interface: "eth1"}
+	select {
+	case msg := <-mt.out:
+		t.Fatalf("Expected the looped back query not to be answered again, got %s", msg)
+	case mt.in <- &Packet{Msg: new(dns.Msg)}:
+	}
+
+	// once the answer is not recent anymore, the query is answered again
+	clk.Add(answerSuppression)
+	mt.in <- &Packet{Msg: query, Interface: "eth1"}
+	t.Equals(1, len((<-mt.out).Answer))
+
+	go c.Close()
+	<-mt.out
+}
+
+func TestBuildTXT(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	txt, err := BuildTXT(map[string]string{"version": "1", "path": `/a\b`, "empty": "", "a-b": "2", "a": "x=y"})
+	t.Ok(err)
+	t.Equals([]string{"a=x=y", "a-b=2", "empty=", "path=/a\\b", "version=1"}, txt)
+
+	// the record is the same once packed and received
+	rr := &dns.TXT{Hdr: dns.RR_Header{Name: "demo._service1._tcp.local.", Rrtype: dns.TypeTXT, Class: dns.ClassINET}}
+	rr.Txt = (&Service{Text: map[string]string{"version": "1", "path": `/a\b`, "empty": "", "a-b": "2", "a": "x=y"}}).text()
+	buf := make([]byte, 512)
+	n, err := dns.PackRR(rr, buf, 0, nil, false)
+	t.Ok(err)
+	received, _, err := dns.UnpackRR(buf[:n], 0)
+	t.Ok(err)
+	t.Equals(rr.Txt, received.(*dns.TXT).Txt)
+
+	txt, err = BuildTXT(nil)
+	t.Ok(err)
+	t.Equals([]string{""}, txt)
+
+	for _, key := range []string{"", "a=b", "tab\t", "new\nline", "café"} {
+		_, err = BuildTXT(map[string]string{key: "value"})
+		t.MustFail(err, "Expected key %q to be rejected", key)
+	}
+	_, err = BuildTXT(map[string]string{"long": strings.Repeat("x", 300)})
+	t.MustFail(err, "Expected an entry longer than 255 bytes to be rejected")
+
+	// Register validates the text as well
+	c, err := New(&Config{Clock: clock.NewMock(time.Unix(0, 0)), Transport: newMockTransport()})
+	t.Ok(err)
+	defer c.Close()
+	service := demoService
+	service.Text = map[string]string{"a=b": "c"}
+	t.MustFail(c.Register(&service), "Expected an invalid text key to be rejected")
+}
+
+func TestForceMulticastResponses(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:                   clk,
+		Transport:               mt,
+		ForceMulticastResponses: true,
+	})
+	t.Ok(err)
+
+	service := demoService
+	t.Ok(c.Register(&service))
+	for i := 0; i < probeCount; i++ {
+		<-mt.out
+		clk.Add(probeInterval)
+	}
+	nextMessage(clk, mt)
+	clk.Add(announceInterval)
+	<-mt.out
+
+	// QU questions get a single multicast response along with the QM ones
+	query := new(dns.Msg)
+	query.Question = []dns.Question{
+		{Name: "_service1._tcp.local.", Qtype: dns.TypePTR, Qclass: dns.ClassINET},
+		{Name: "terminus.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET | 1<<15},
+	}
+	mt.in <- &Packet{Msg: query, Src: &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 5353}}
+	msg := <-mt.out
+	t.Equals(nil, mt.dst)
+	t.Equals(2, len(msg.Answer))
+
+	// and so do legacy queriers
+	clk.Add(answerSuppression)
+	query.Question = query.Question[1:]
+	mt.in <- &Packet{Msg: query, Src: &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 40000}}
+	msg = <-mt.out
+	t.Equals(nil, mt.dst)
+	t.Equals("terminus.local.", msg.Answer[0].Header().Name)
+
+	go c.Close()
+	<-mt.out
+}
+
+func TestBeacon(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	stop := c.Beacon("sensor.local", net.ParseIP("10.0.0.9"), 5*time.Minute)
+
+	// the record goes out right away, and then every period
+	for i := 0; i < 3; i++ {
+		msg := <-mt.out
+		t.Equals(1, len(msg.Answer))
+		t.Equals("sensor.local.\t600\tCLASS32769\tA\t10.0.0.9", msg.Answer[0].String())
+		clk.Add(5*time.Minute - time.Second)
+		select {
+		case msg := <-mt.out:
+			t.Fatalf("Unexpected beacon before the period is over: %s", msg)
+		case mt.in <- &Packet{Msg: new(dns.Msg)}:
+		}
+		clk.Add(time.Second)
+	}
+	<-mt.out
+
+	// until stopped
+	stop()
+	stop()
+	clk.Add(time.Hour)
+	select {
+	case msg := <-mt.out:
+		t.Fatalf("Unexpected beacon once stopped: %s", msg)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// invalid periods are raised to the minimum, rather than panicking
+	stop = c.Beacon("sensor.local", net.ParseIP("fe80::9"), 0)
+	t.Equals("sensor.local.\t120\tCLASS32769\tAAAA\tfe80::9", (<-mt.out).Answer[0].String())
+	clk.Add(minBeaconPeriod)
+	<-mt.out
+	stop()
+
+	// and invalid addresses start no beacon at all
+	c.Beacon("sensor.local", nil, time.Minute)()
+	c.Beacon("sensor.local", net.IP{1, 2, 3}, time.Minute)()
+	clk.Add(time.Hour)
+	select {
+	case msg := <-mt.out:
+		t.Fatalf("Unexpected beacon for an invalid address: %s", msg)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestReconnectKeepsRegistrations(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+
+	service := demoService
+	t.Ok(c.Register(&service))
+	for i := 0; i < probeCount; i++ {
+		<-mt.out
+		clk.Add(probeInterval)
+	}
+	for i := 0; i < announceCount; i++ {
+		if i == 0 {
+			nextMessage(clk, mt)
+		} else {
+			<-mt.out
+		}
+		clk.Add(announceInterval)
+	}
+	c.addToCache(parseRecords(t, `
+	gone.local.		120	IN	A		10.0.0.1
+	`))
+	registered := dumpCache(c)
+	clk.Add(time.Second)
+
+	// our own records, which are never received again, survive the reconnection,
+	// unlike those of other hosts
+	mt.reconnects <- struct{}{}
+	for strings.Contains(dumpCache(c), "gone.") {
+		clk.Add(reconnectGrace)
+		time.Sleep(time.Millisecond)
+	}
+	t.Equals(strings.Count(registered, "\n")-1, strings.Count(dumpCache(c), "\n"))
+	t.Assert(strings.Contains(dumpCache(c), "terminus.local."), "Expected the registered addresses to stay")
+
+	go c.Close()
+	<-mt.out
+}
@@ -0,0 +1,335 @@
+package mdns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// RFC 6762, section 10.  Resource Record TTL Values and Cache Coherency
+//
+// As a general rule, the recommended TTL value for Multicast DNS resource
+// records with a host name as the resource record's name (e.g., A, AAAA,
+// HINFO) or a host name contained within the resource record's rdata (e.g.,
+// SRV, reverse mapping PTR record) SHOULD be 120 seconds.
+//
+// The recommended TTL value for other Multicast DNS resource records is 75
+// minutes.
+const (
+	hostTTL  = 120
+	otherTTL = 75 * 60
+)
+
+// RFC 6763, section 6.1: each constituent string of a DNS TXT record is
+// limited to 255 bytes, and the whole record data to 65535 bytes
+const (
+	maxTXTStringSize = 255
+	maxTXTSize       = 65535
+)
+
+// Service describes a DNS-SD service instance to advertise on the network
+type Service struct {
+	Instance string            // Instance name, e.g. "My Printer"
+	Service  string            // Service type, e.g. "_ipp._tcp"
+	Domain   string            // Domain to advertise in. Defaults to "local."
+	Host     string            // Host name offering the service, e.g. "myhost.local."
+	Port     uint16            // Port the service listens on
+	Text     map[string]string // Key/value pairs to publish in the TXT record
+	IPs      []net.IP          // Addresses to publish for Host, one address record each
+	Target   string            // SRV target host not owned by this machine, e.g. when proxying. If set, Host and IPs are ignored and no address records are published
+}
+
+// validate checks the service description is complete
+func (s *Service) validate() error {
+	if s.Instance == "" {
+		return errors.New("Service instance name is required")
+	}
+	if s.Service == "" {
+		return errors.New("Service type is required")
+	}
+	if s.Host == "" && s.Target == "" {
+		return errors.New("Service host name is required")
+	}
+	_, err := BuildTXT(s.Text)
+	return err
+}
+
+// BuildTXT builds the strings of a TXT record out of the given key/value pairs,
+// as "key=value", sorted by key so that the record is the same every time.
+// Keys must be valid and every string, as well as the whole record, must fit in
+// a TXT record. No pairs build a record with a single empty string.
+//
+// RFC 6763, section 6.4: The key MUST be at least one character. [...] The
+// characters of a key MUST be printable US-ASCII values (0x20-0x7E) [...],
+// excluding '=' (0x3D).
+func BuildTXT(kv map[string]string) ([]string, error) {
+	keys := make([]string, 0, len(kv))
+	for k := range kv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	txt := make([]string, 0, len(kv))
+	size := 0
+	for _, k := range keys {
+		if k == "" {
+			return nil, errors.New("Service text keys cannot be empty")
+		}
+		for _, r := range k {
+			if r < 0x20 || r > 0x7e || r == '=' {
+				return nil, fmt.Errorf("Service text key %q contains invalid character %q", k, r)
+			}
+		}
+		entry := k + "=" + kv[k]
+		n := len(entry)
+		if n > maxTXTStringSize {
+			return nil, fmt.Errorf("Service text entry %q is %d bytes long, exceeding the %d bytes limit", k, n, maxTXTStringSize)
+		}
+		size += 1 + n
+		txt = append(txt, entry)
+	}
+	if size > maxTXTSize {
+		return nil, fmt.Errorf("Service text is %d bytes long, exceeding the %d bytes limit", size, maxTXTSize)
+	}
+	if len(txt) == 0 {
+		// RFC 6763, section 6.1: An empty TXT record containing zero strings is
+		// not allowed. DNS-SD implementations MUST NOT emit empty TXT records.
+		txt = []string{""}
+	}
+	return txt, nil
+}
+
+// domain returns the fully qualified domain the service is advertised in
+func (s *Service) domain() string {
+	if s.Domain == "" {
+		return "local."
+	}
+	return strings.Trim(s.Domain, ".") + "."
+}
+
+// serviceName returns the fully qualified service type name, e.g. _ipp._tcp.local.
+func (s *Service) serviceName() string {
+	return strings.Trim(s.Service, ".") + "." + s.domain()
+}
+
+// serviceTypesName returns the fully qualified name to enumerate the service
+// types in the domain of the service by, e.g. _services._dns-sd._udp.local.
+func (s *Service) serviceTypesName() string {
+	return "_services._dns-sd._udp." + s.domain()
+}
+
+// instanceName returns the fully qualified service instance name,
+// e.g. My\ Printer._ipp._tcp.local.
+func (s *Service) instanceName() string {
+	return escapeLabel(s.Instance) + "." + s.serviceName()
+}
+
+// hostName returns the fully qualified name of the host the SRV record targets
+func (s *Service) hostName() string {
+	if s.Target != "" {
+		return dns.Fqdn(s.Target)
+	}
+	return dns.Fqdn(s.Host)
+}
+
+// text returns the TXT record strings, as built by BuildTXT, escaped for packing.
+// The service must be valid.
+func (s *Service) text() []string {
+	txt, _ := BuildTXT(s.Text)
+	for i := range txt {
+		// miekg/dns interprets backslashes as escape sequences when packing
+		txt[i] = strings.ReplaceAll(txt[i], `\`, `\\`)
+	}
+	return txt
+}
+
+// records builds the resource records that advertise the service.
+//
+// RFC 6762, section 2: A "shared" resource record set is one where several
+// Multicast DNS responders may have records with the same name, rrtype, and
+// rrclass, such as the PTR record enumerating a service type. A "unique"
+// resource record set is one where all the records with that name, rrtype,
+// and rrclass are conceptually under the control or ownership of a single
+// responder, such as the SRV, TXT and address records of an instance.
+// Unique records are probed before use and announced with the cache-flush bit.
+func (s *Service) records() (shared, unique []dns.RR) {
+	instance := s.instanceName()
+	host := s.hostName()
+
+	shared = append(shared, &dns.PTR{
+		Hdr: dns.RR_Header{Name: s.serviceName(), Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: otherTTL},
+		Ptr: instance,
+	})
+
+	// RFC 6763, section 9: a DNS query for PTR records with the name
+	// "_services._dns-sd._udp.<Domain>" yields a set of PTR records, where the
+	// rdata of each PTR record is the two-label <Service> name, plus the same
+	// domain, e.g., "_http._tcp.<Domain>".
+	shared = append(shared, &dns.PTR{
+		Hdr: dns.RR_Header{Name: s.serviceTypesName(), Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: otherTTL},
+		Ptr: s.serviceName(),
+	})
+
+	unique = append(unique,
+		&dns.SRV{
+			Hdr:    dns.RR_Header{Name: instance, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: hostTTL},
+			Target: host,
+			Port:   s.Port,
+		},
+		&dns.TXT{
+			Hdr: dns.RR_Header{Name: instance, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: otherTTL},
+			Txt: s.text(),
+		},
+	)
+	if s.Target != "" {
+		// the addresses of a host we do not own are not ours to publish
+		return shared, unique
+	}
+	// multi-homed hosts publish one address record per distinct address
+	seen := make(map[string]bool)
+	for _, ip := range s.IPs {
+		if seen[ip.String()] {
+			continue
+		}
+		seen[ip.String()] = true
+		if ip4 := ip.To4(); ip4 != nil {
+			unique = append(unique, &dns.A{
+				Hdr: dns.RR_Header{Name: host, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: hostTTL},
+				A:   ip4,
+			})
+		} else {
+			unique = append(unique, &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: host, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: hostTTL},
+				AAAA: ip,
+			})
+		}
+	}
+	return shared, unique
+}
+
+// reverseRecords builds the reverse mapping PTR records pointing the addresses
+// of the host back to its name, e.g. 4.3.2.1.in-addr.arpa. for 1.2.3.4.
+//
+// RFC 6762, section 4.  Reverse Address Mapping
+//
+// Like ".local.", the IPv4 and IPv6 reverse mapping domains are also defined
+// to be link-local: Any DNS query for a name ending with "254.169.in-addr.arpa."
+// MUST be sent to the mDNS IPv4 link-local multicast address 224.0.0.251 or the
+// mDNS IPv6 multicast address FF02::FB.
+func (s *Service) reverseRecords() []dns.RR {
+	if s.Target != "" {
+		return nil
+	}
+	var records []dns.RR
+	seen := make(map[string]bool)
+	for _, ip := range s.IPs {
+		name, err := dns.ReverseAddr(ip.String())
+		if err != nil || seen[name] {
+			continue
+		}
+		seen[name] = true
+		records = append(records, &dns.PTR{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: hostTTL},
+			Ptr: s.hostName(),
+		})
+	}
+	return records
+}
+
+// isReverseName returns whether the given name is in the IPv4 or IPv6
+// reverse mapping domains
+func isReverseName(name string) bool {
+	name = strings.ToLower(dns.Fqdn(name))
+	return strings.HasSuffix(name, ".in-addr.arpa.") || strings.HasSuffix(name, ".ip6.arpa.")
+}
+
+// escapeLabel turns a single DNS label into presentation format, escaping
+// the same characters miekg/dns does, so that names we build compare equal
+// to names received off the wire
+func escapeLabel(label string) string {
+	var b strings.Builder
+	for i := 0; i < len(label); i++ {
+		switch c := label[i]; {
+		case strings.IndexByte(`. '@;()"\`, c) >= 0:
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&b, "\\%03d", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// unescapeLabel turns a single DNS label in presentation format back into
+// the raw label, undoing escapeLabel
+func unescapeLabel(label string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(label); i++ {
+		if label[i] != '\\' {
+			b.WriteByte(label[i])
+			continue
+		}
+		if i+3 < len(label) && isDigits(label[i+1:i+4]) {
+			n := int(label[i+1]-'0')*100 + int(label[i+2]-'0')*10 + int(label[i+3]-'0')
+			if n > 255 {
+				return "", fmt.Errorf("Invalid escape sequence in label %q", label)
+			}
+			b.WriteByte(byte(n))
+			i += 3
+			continue
+		}
+		if i+1 == len(label) {
+			return "", fmt.Errorf("Trailing backslash in label %q", label)
+		}
+		i++
+		b.WriteByte(label[i])
+	}
+	return b.String(), nil
+}
+
+// isDigits returns whether s only contains decimal digits
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// MakeInstanceName returns the fully qualified service instance name in
+// presentation format, e.g. My\ Printer._ipp._tcp.local., escaping whatever
+// dots, spaces or other special characters the instance name contains.
+// The domain defaults to "local." if empty.
+//
+// RFC 6763, section 4.1.1: the <Instance> portion of the Service Instance Name
+// is a user-friendly name consisting of arbitrary Net-Unicode text. [...] it
+// MUST NOT contain ASCII control characters.
+func MakeInstanceName(instance, service, domain string) string {
+	s := Service{Instance: instance, Service: service, Domain: domain}
+	return s.instanceName()
+}
+
+// ParseInstanceName splits a fully qualified service instance name, such as
+// those in ServiceEntry.Instance, into the unescaped instance name, the service
+// type, e.g. "_ipp._tcp", and the fully qualified domain, e.g. "local."
+func ParseInstanceName(fqdn string) (instance, service, domain string, err error) {
+	labels := dns.SplitDomainName(fqdn)
+	if len(labels) < 4 {
+		return "", "", "", fmt.Errorf("Not a service instance name: %q", fqdn)
+	}
+	if !strings.HasPrefix(labels[1], "_") || !strings.HasPrefix(labels[2], "_") {
+		return "", "", "", fmt.Errorf("Invalid service type in instance name %q", fqdn)
+	}
+	instance, err = unescapeLabel(labels[0])
+	if err != nil {
+		return "", "", "", err
+	}
+	return instance, labels[1] + "." + labels[2], strings.Join(labels[3:], ".") + ".", nil
+}
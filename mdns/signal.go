@@ -1,8 +1,12 @@
 package mdns
 
-// signal is a simple way to release a number of goroutines when something happens
+import "sync"
+
+// signal is a simple way to release a number of goroutines when something happens.
+// It can be raised from several goroutines at once.
 type signal struct {
-	c chan struct{}
+	lock sync.Mutex
+	c    chan struct{}
 }
 
 func newSignal() *signal {
@@ -12,10 +16,14 @@ func newSignal() *signal {
 }
 
 func (s *signal) waitCh() <-chan struct{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	return s.c
 }
 
 func (s *signal) raise() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	c := s.c
 	s.c = make(chan struct{})
 	close(c)
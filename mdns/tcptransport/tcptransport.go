@@ -0,0 +1,59 @@
+package tcptransport
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const mDNSPort = 5353
+
+// TCPTransport fetches complete answer sets from mDNS responders over TCP,
+// for responses too large to fit in UDP packets
+type TCPTransport struct {
+	client *dns.Client
+}
+
+// Config contains the configuration for TCPTransport
+type Config struct {
+	Timeout time.Duration // How long to wait for a responder to connect and answer. Defaults to 2s
+}
+
+// New instantiates a new TCPTransport
+func New(config *Config) *TCPTransport {
+	timeout := config.Timeout
+	if timeout == 0 {
+		timeout = 2 * time.Second
+	}
+	return &TCPTransport{
+		client: &dns.Client{Net: "tcp", Timeout: timeout},
+	}
+}
+
+// Exchange sends the query to the responder at the given address, on the mDNS
+// port, and returns its response
+func (t *TCPTransport) Exchange(msg *dns.Msg, dst net.Addr) (*dns.Msg, error) {
+	var ip net.IP
+	var zone string // needed to reach IPv6 link-local addresses
+	switch addr := dst.(type) {
+	case *net.UDPAddr:
+		ip, zone = addr.IP, addr.Zone
+	case *net.TCPAddr:
+		ip, zone = addr.IP, addr.Zone
+	case *net.IPAddr:
+		ip, zone = addr.IP, addr.Zone
+	}
+	if ip == nil {
+		return nil, fmt.Errorf("Unsupported responder address %s", dst)
+	}
+	host := ip.String()
+	if zone != "" {
+		host += "%" + zone
+	}
+
+	reply, _, err := t.client.Exchange(msg, net.JoinHostPort(host, strconv.Itoa(mDNSPort)))
+	return reply, err
+}
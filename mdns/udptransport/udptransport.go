@@ -2,9 +2,14 @@ package udptransport
 
 import (
 	"errors"
+	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 
 	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 const (
@@ -18,18 +23,60 @@ var (
 	mDNSAddr6 = &net.UDPAddr{IP: net.ParseIP(mDNSIP6), Port: mDNSPort}
 )
 
+// IPv6 multicast scopes, as per RFC 4291, section 2.7
+const (
+	ScopeLinkLocal = 0x2
+	ScopeSiteLocal = 0x5
+	ScopeOrgLocal  = 0x8
+	ScopeGlobal    = 0xe
+)
+
+// MulticastAddr6 returns the address of the mDNS IPv6 multicast group in the
+// given scope, FF0X::FB, where X is the scope, e.g. ff05::fb for site-local.
+// A zero scope means link-local, ff02::fb, the only one RFC 6762 defines.
+func MulticastAddr6(scope uint8) (*net.UDPAddr, error) {
+	if scope == 0 {
+		return mDNSAddr6, nil
+	}
+	// the scope is the low 4 bits of the second byte, the high ones being flags
+	if scope > 0xf {
+		return nil, fmt.Errorf("Invalid IPv6 multicast scope %#x", scope)
+	}
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, mDNSAddr6.IP.To16())
+	ip[1] = scope
+	return &net.UDPAddr{IP: ip, Port: mDNSPort}, nil
+}
+
+// Packet is a DNS message received from the network, along with its origin
+type Packet struct {
+	Msg       *dns.Msg
+	Src       net.Addr // Address the message was sent from
+	Interface string   // Name of the network interface the message arrived on. Empty if unknown
+}
+
 // UDPTransport implements the transport interface with UDP
 type UDPTransport struct {
-	uc4, uc6 *net.UDPConn // unicasts sockets
-	mc4, mc6 *net.UDPConn // multicast sockets
-	closed   chan struct{}
-	msgs     chan *dns.Msg
+	uc4, uc6    conn           // unicasts sockets
+	mc4, mc6    conn           // multicast sockets
+	unicastOnly bool           // whether multicast is unavailable, and messages go to peers instead
+	peers       []*net.UDPAddr // where to send multicast messages to in unicast-only mode
+	closed      chan struct{}
+	msgs        chan *Packet
+	ifaces      interfaceNames
+	group6      *net.UDPAddr  // IPv6 multicast group joined and sent to
+	down        int32         // whether the last attempt to send failed, accessed atomically
+	reconnected chan struct{} // signalled once sending works again after failing
 }
 
 // Config contains the configuration for UDPTransport
 type Config struct {
-	BindIPAddressV4 net.IP // Address to bind to
-	BindIPAddressV6 net.IP
+	BindIPAddressV4  net.IP // Address to bind to
+	BindIPAddressV6  net.IP
+	AllowUnicastOnly bool            // whether to carry on in unicast-only mode, sending to Peers, if no multicast socket can be bound, instead of failing
+	Peers            []*net.UDPAddr  // Addresses to send messages meant for the multicast group to in unicast-only mode
+	OnUnicastOnly    func(err error) // If set, called with the reason when falling back to unicast-only mode
+	MulticastScopeV6 uint8           // IPv6 multicast scope of the mDNS group to join and send to, e.g. ScopeSiteLocal for ff05::fb. Defaults to link-local, ff02::fb
 }
 
 // New instantiates a new UDPTransport
@@ -40,98 +87,360 @@ func New(config *Config) (*UDPTransport, error) {
 	if config.BindIPAddressV6 == nil {
 		config.BindIPAddressV6 = net.IPv6zero
 	}
-	uc4, _ := net.ListenUDP("udp4", &net.UDPAddr{IP: config.BindIPAddressV4, Port: 0})
-	uc6, _ := net.ListenUDP("udp6", &net.UDPAddr{IP: config.BindIPAddressV6, Port: 0})
+	group6, err := MulticastAddr6(config.MulticastScopeV6)
+	if err != nil {
+		return nil, err
+	}
+	uc4 := newConn4(net.ListenUDP("udp4", &net.UDPAddr{IP: config.BindIPAddressV4, Port: 0}))
+	uc6 := newConn6(net.ListenUDP("udp6", &net.UDPAddr{IP: config.BindIPAddressV6, Port: 0}))
 	if uc4 == nil && uc6 == nil {
 		return nil, errors.New("Failed to bind to any unicast UDP port")
 	}
 
-	mc4, _ := net.ListenMulticastUDP("udp4", nil, mDNSAddr4)
-	mc6, _ := net.ListenMulticastUDP("udp6", nil, mDNSAddr6)
-	if uc4 == nil && uc6 == nil {
-		if uc4 != nil {
-			_ = uc4.Close()
+	mc4 := newConn4(net.ListenMulticastUDP("udp4", nil, mDNSAddr4))
+	mc6 := newConn6(net.ListenMulticastUDP("udp6", nil, group6))
+	unicastOnly := mc4 == nil && mc6 == nil
+	if unicastOnly {
+		err := errors.New("Failed to bind to any multicast UDP port")
+		if !config.AllowUnicastOnly {
+			if uc4 != nil {
+				_ = uc4.close()
+			}
+			if uc6 != nil {
+				_ = uc6.close()
+			}
+			return nil, err
+		}
+		if config.OnUnicastOnly != nil {
+			config.OnUnicastOnly(err)
+		}
+	}
+
+	u := &UDPTransport{
+		uc4:         uc4,
+		uc6:         uc6,
+		mc4:         mc4,
+		mc6:         mc6,
+		unicastOnly: unicastOnly,
+		peers:       config.Peers,
+		closed:      make(chan struct{}),
+		msgs:        make(chan *Packet),
+		ifaces:      interfaceNames{names: make(map[int]string)},
+		group6:      group6,
+		reconnected: make(chan struct{}, 1),
+	}
+	u.joinAll()
+
+	go u.recv(uc4)
+	go u.recv(uc6)
+	go u.recv(mc4)
+	go u.recv(mc6)
+
+	return u, nil
+}
+
+// joinAll joins the multicast group on all the interfaces that are up, since
+// the multicast sockets only joined it on the default one, so that segments
+// can be told apart
+func (u *UDPTransport) joinAll() {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return
+	}
+	for i := range ifaces {
+		if ifaces[i].Flags&net.FlagUp == 0 || ifaces[i].Flags&net.FlagMulticast == 0 {
+			continue
 		}
-		if uc6 != nil {
-			_ = uc6.Close()
+		if u.mc4 != nil {
+			_ = u.mc4.join(&ifaces[i], mDNSAddr4)
 		}
-		return nil, errors.New("Failed to bind to any multicast TCP port")
+		if u.mc6 != nil {
+			_ = u.mc6.join(&ifaces[i], u.group6)
+		}
+	}
+}
+
+// Send sends a dns message to the given destination, or over all UDP
+// connections to the mDNS multicast group if dst is nil.
+// Queries are sent from the unicast sockets, while responses
+// are sent from the multicast sockets, since RFC 6762, section 11
+// requires responses to have a source port of 5353
+func (u *UDPTransport) Send(msg *dns.Msg, dst net.Addr) error {
+	if dst == nil {
+		return u.send(msg, 0)
+	}
+	udpAddr, ok := dst.(*net.UDPAddr)
+	if !ok {
+		return fmt.Errorf("Unsupported destination address %s", dst)
+	}
+	buf, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+
+	c := u.socket(udpAddr.IP.To4() != nil, msg.Response)
+	if c == nil {
+		return fmt.Errorf("No socket available to send to %s", dst)
 	}
+	return u.track(c.writeTo(buf, 0, dst))
+}
 
-	msgs := make(chan *dns.Msg)
-	closed := make(chan struct{})
+// socket returns the socket to send messages of the given IP family and kind from.
+// In unicast-only mode, there are only the unicast sockets to do so.
+func (u *UDPTransport) socket(ipv4, response bool) conn {
+	if ipv4 {
+		if response && !u.unicastOnly {
+			return u.mc4
+		}
+		return u.uc4
+	}
+	if response && !u.unicastOnly {
+		return u.mc6
+	}
+	return u.uc6
+}
 
-	go recv(uc4, msgs, closed)
-	go recv(uc6, msgs, closed)
-	go recv(mc4, msgs, closed)
-	go recv(mc6, msgs, closed)
+// UnicastOnly returns whether multicast is unavailable, so messages meant for
+// the multicast group are sent to the configured peers instead
+func (u *UDPTransport) UnicastOnly() bool {
+	return u.unicastOnly
+}
 
-	return &UDPTransport{
-		uc4:    uc4,
-		uc6:    uc6,
-		mc4:    mc4,
-		mc6:    mc6,
-		closed: closed,
-		msgs:   msgs,
-	}, nil
+// SendInterface works like Send, but only sends the message
+// on the given network interface
+func (u *UDPTransport) SendInterface(msg *dns.Msg, iface string) error {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return err
+	}
+	return u.send(msg, ifi.Index)
 }
 
-// Send sends a dns message over all UDP connections
-func (u *UDPTransport) Send(msg *dns.Msg) error {
+// send sends a dns message on the given interface index, or
+// through the default interface if zero, to the mDNS multicast group
+// or, in unicast-only mode, to each of the peers
+func (u *UDPTransport) send(msg *dns.Msg, ifIndex int) error {
 	buf, err := msg.Pack()
 	if err != nil {
 		return err
 	}
 
-	if u.uc4 != nil {
-		u.uc4.WriteToUDP(buf, mDNSAddr4)
+	// multicasting is best effort, so failures are only tracked, as long as
+	// the message goes out on any socket
+	var sent bool
+	var lastErr error
+	write := func(c conn, dst net.Addr) {
+		if c == nil {
+			return
+		}
+		if err := c.writeTo(buf, ifIndex, dst); err != nil {
+			lastErr = err
+		} else {
+			sent = true
+		}
+	}
+	if u.unicastOnly {
+		for _, peer := range u.peers {
+			write(u.socket(peer.IP.To4() != nil, msg.Response), peer)
+		}
+	} else {
+		write(u.socket(true, msg.Response), mDNSAddr4)
+		write(u.socket(false, msg.Response), u.group6)
 	}
-	if u.uc6 != nil {
-		u.uc6.WriteToUDP(buf, mDNSAddr6)
+	switch {
+	case sent:
+		_ = u.track(nil)
+	case lastErr != nil:
+		_ = u.track(lastErr)
 	}
+	return nil
+}
 
+// track notes the outcome of sending a message, and returns the error, if any.
+// Once a message goes out after sending failed, e.g. while the network
+// interface was down, the groups are joined again, as memberships may have
+// been lost meanwhile, and the reconnection is reported through Reconnected.
+func (u *UDPTransport) track(err error) error {
+	if err != nil {
+		atomic.StoreInt32(&u.down, 1)
+		return err
+	}
+	if atomic.CompareAndSwapInt32(&u.down, 1, 0) {
+		u.joinAll()
+		select {
+		case u.reconnected <- struct{}{}:
+		default:
+		}
+	}
 	return nil
 }
 
+// Reconnected returns a channel that receives a value whenever sending works
+// again after failing, so that clients can tell cached records may be stale
+func (u *UDPTransport) Reconnected() <-chan struct{} {
+	return u.reconnected
+}
+
 // Receive returns a channel that outputs received dns messages
-func (u *UDPTransport) Receive() <-chan *dns.Msg {
+func (u *UDPTransport) Receive() <-chan *Packet {
 	return u.msgs
 }
 
 // Close shuts down all sockets
 func (u *UDPTransport) Close() {
 	close(u.closed)
+	for _, c := range []conn{u.uc4, u.uc6, u.mc4, u.mc6} {
+		if c != nil {
+			_ = c.close()
+		}
+	}
 }
 
 // recv reads and parses all DNS packets coming from the socket and sends them
 // over the channel
-func recv(l *net.UDPConn, msgCh chan *dns.Msg, closed chan struct{}) {
-	if l == nil {
+func (u *UDPTransport) recv(c conn) {
+	if c == nil {
 		return
 	}
 
 	buf := make([]byte, 65536)
 	for {
-		n, err := l.Read(buf)
+		n, ifIndex, src, err := c.readFrom(buf)
 		if err != nil {
-			continue
+			select {
+			case <-u.closed:
+				return
+			default:
+				continue
+			}
 		}
-		msg := new(dns.Msg)
-		if err := msg.Unpack(buf[:n]); err != nil {
-			continue
-		}
-		if msg.Response == false {
+		msg, err := Unpack(buf[:n])
+		if err != nil {
 			continue
 		}
 
-		for _, rr := range msg.Answer {
-			rr.Header().Class &= 0x7FFF
-		}
-
 		select {
-		case msgCh <- msg:
-		case <-closed:
+		case u.msgs <- &Packet{Msg: msg, Src: src, Interface: u.ifaces.name(ifIndex)}:
+		case <-u.closed:
 			return
 		}
 	}
 }
+
+// Unpack parses a DNS message as received off the wire.
+// Packets that fail to parse are dropped
+func Unpack(buf []byte) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(buf); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// interfaceNames caches the names of network interfaces by index
+type interfaceNames struct {
+	lock  sync.Mutex
+	names map[int]string
+}
+
+// name returns the name of the interface with the given index
+func (n *interfaceNames) name(index int) string {
+	if index == 0 {
+		return ""
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	name, ok := n.names[index]
+	if !ok {
+		if ifi, err := net.InterfaceByIndex(index); err == nil {
+			name = ifi.Name
+		}
+		n.names[index] = name
+	}
+	return name
+}
+
+// conn abstracts IPv4 and IPv6 sockets that can tell which interface
+// packets come through and send packets through a specific interface
+type conn interface {
+	readFrom(b []byte) (n int, ifIndex int, src net.Addr, err error)
+	writeTo(b []byte, ifIndex int, dst net.Addr) error
+	join(ifi *net.Interface, group net.Addr) error
+	close() error
+}
+
+type conn4 struct {
+	pc *ipv4.PacketConn
+}
+
+func newConn4(c *net.UDPConn, err error) conn {
+	if err != nil {
+		return nil
+	}
+	pc := ipv4.NewPacketConn(c)
+	_ = pc.SetControlMessage(ipv4.FlagInterface, true)
+	return &conn4{pc: pc}
+}
+
+func (c *conn4) readFrom(b []byte) (int, int, net.Addr, error) {
+	n, cm, src, err := c.pc.ReadFrom(b)
+	if cm == nil {
+		return n, 0, src, err
+	}
+	return n, cm.IfIndex, src, err
+}
+
+func (c *conn4) writeTo(b []byte, ifIndex int, dst net.Addr) error {
+	var cm *ipv4.ControlMessage
+	if ifIndex != 0 {
+		cm = &ipv4.ControlMessage{IfIndex: ifIndex}
+	}
+	_, err := c.pc.WriteTo(b, cm, dst)
+	return err
+}
+
+func (c *conn4) join(ifi *net.Interface, group net.Addr) error {
+	return c.pc.JoinGroup(ifi, group)
+}
+
+func (c *conn4) close() error {
+	return c.pc.Close()
+}
+
+type conn6 struct {
+	pc *ipv6.PacketConn
+}
+
+func newConn6(c *net.UDPConn, err error) conn {
+	if err != nil {
+		return nil
+	}
+	pc := ipv6.NewPacketConn(c)
+	_ = pc.SetControlMessage(ipv6.FlagInterface, true)
+	return &conn6{pc: pc}
+}
+
+func (c *conn6) readFrom(b []byte) (int, int, net.Addr, error) {
+	n, cm, src, err := c.pc.ReadFrom(b)
+	if cm == nil {
+		return n, 0, src, err
+	}
+	return n, cm.IfIndex, src, err
+}
+
+func (c *conn6) writeTo(b []byte, ifIndex int, dst net.Addr) error {
+	var cm *ipv6.ControlMessage
+	if ifIndex != 0 {
+		cm = &ipv6.ControlMessage{IfIndex: ifIndex}
+	}
+	_, err := c.pc.WriteTo(b, cm, dst)
+	return err
+}
+
+func (c *conn6) join(ifi *net.Interface, group net.Addr) error {
+	return c.pc.JoinGroup(ifi, group)
+}
+
+func (c *conn6) close() error {
+	return c.pc.Close()
+}
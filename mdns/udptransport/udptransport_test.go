@@ -0,0 +1,78 @@
+package udptransport
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+	"github.com/miekg/dns"
+)
+
+func TestMulticastAddr6(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	// link-local by default
+	addr, err := MulticastAddr6(0)
+	t.Ok(err)
+	t.Equals("[ff02::fb]:5353", addr.String())
+
+	addr, err = MulticastAddr6(ScopeLinkLocal)
+	t.Ok(err)
+	t.Equals("[ff02::fb]:5353", addr.String())
+
+	addr, err = MulticastAddr6(ScopeSiteLocal)
+	t.Ok(err)
+	t.Equals("[ff05::fb]:5353", addr.String())
+
+	// the default group is left untouched
+	t.Equals("[ff02::fb]:5353", mDNSAddr6.String())
+
+	_, err = MulticastAddr6(0x10)
+	t.MustFail(err, "scopes only take 4 bits")
+}
+
+// fakeConn is a socket that fails to send while err is set
+type fakeConn struct {
+	err error
+}
+
+func (c *fakeConn) readFrom(b []byte) (int, int, net.Addr, error)     { return 0, 0, nil, c.err }
+func (c *fakeConn) writeTo(b []byte, ifIndex int, dst net.Addr) error { return c.err }
+func (c *fakeConn) join(ifi *net.Interface, group net.Addr) error     { return nil }
+func (c *fakeConn) close() error                                      { return nil }
+
+func TestReconnected(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	mc4 := &fakeConn{}
+	u := &UDPTransport{mc4: mc4, group6: mDNSAddr6, reconnected: make(chan struct{}, 1)}
+	reconnected := func() bool {
+		select {
+		case <-u.Reconnected():
+			return true
+		default:
+			return false
+		}
+	}
+	msg := new(dns.Msg)
+	msg.Response = true
+	msg.SetQuestion("printer.local.", dns.TypeA)
+
+	// sending as usual is no news
+	t.Ok(u.send(msg, 0))
+	t.Assert(!reconnected(), "Unexpected reconnection")
+
+	// multicasting failures are not reported, but sending again afterwards is
+	mc4.err = errors.New("Network is unreachable")
+	t.Ok(u.send(msg, 0))
+	t.Ok(u.send(msg, 0))
+	t.Assert(!reconnected(), "Unexpected reconnection while sending fails")
+	mc4.err = nil
+	t.Ok(u.send(msg, 0))
+	t.Assert(reconnected(), "Expected a reconnection once sending works again")
+	t.Ok(u.send(msg, 0))
+	t.Assert(!reconnected(), "Unexpected reconnection")
+}
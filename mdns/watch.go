@@ -0,0 +1,164 @@
+package mdns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// InstanceHandle keeps a service instance resolved for callers that dial it
+// repeatedly, as returned by Watch
+type InstanceHandle struct {
+	c         *Client
+	service   string // fully qualified service type name
+	name      string // fully qualified instance name
+	network   string // "tcp" or "udp", as per the service type
+	lock      sync.Mutex
+	addr      net.Addr
+	host      string   // SRV target the host pins are held for
+	held      []string // pin keys held for the instance records
+	changes   chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Watch resolves the given service instance in the background and returns a
+// handle that keeps its records pinned, so that they are asked for again as
+// they expire. The service type is fully qualified, e.g. "_ipp._tcp.local.",
+// and the instance name is unescaped, e.g. "My Printer". Call Close on the
+// handle once done.
+func (c *Client) Watch(service, instance string) (*InstanceHandle, error) {
+	service = strings.Trim(service, ".") + "."
+	name := escapeLabel(instance) + "." + service
+	_, _, _, err := ParseInstanceName(name)
+	if err != nil {
+		return nil, err
+	}
+	network := strings.TrimPrefix(strings.ToLower(dns.SplitDomainName(service)[1]), "_")
+	if network != "tcp" && network != "udp" {
+		return nil, fmt.Errorf("Unsupported service protocol %q", network)
+	}
+
+	h := &InstanceHandle{
+		c:       c,
+		service: service,
+		name:    name,
+		network: network,
+		held:    []string{pinKey(name, dns.TypeSRV), pinKey(name, dns.TypeTXT)},
+		changes: make(chan struct{}, 1),
+		closed:  make(chan struct{}),
+	}
+	c.hold(h.held...)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	started := c.background(func() {
+		defer cancel()
+		select {
+		case <-h.closed:
+		case <-c.closedCh:
+		}
+	})
+	started = started && c.background(func() { _, _ = c.Resolve(ctx, name) })
+	started = started && c.background(h.maintain)
+	if !started {
+		cancel()
+		h.Close()
+		return nil, errClosed
+	}
+	return h, nil
+}
+
+// Addr returns the address to dial the instance at, a *net.TCPAddr or a
+// *net.UDPAddr as per the service protocol, made of the preferred address of
+// the SRV target, in AddressOrder, and the SRV port. The last address known is
+// kept while records are being refreshed. Returns nil if the instance is not
+// resolved yet.
+func (h *InstanceHandle) Addr() net.Addr {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.addr
+}
+
+// Changes returns a channel that receives a value whenever Addr changes, so
+// that connections to the previous address can be dropped. Changes that happen
+// before the value is received are coalesced.
+func (h *InstanceHandle) Changes() <-chan struct{} {
+	return h.changes
+}
+
+// Close stops maintaining the instance and unpins its records
+func (h *InstanceHandle) Close() {
+	h.closeOnce.Do(func() {
+		close(h.closed)
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		h.c.release(h.held...)
+		if h.host != "" {
+			h.c.release(hostKeys(h.host)...)
+		}
+	})
+}
+
+// maintain updates the address every time new records are received,
+// until the handle or the client are closed
+func (h *InstanceHandle) maintain() {
+	for {
+		received := h.c.signal.waitCh()
+		h.update()
+		select {
+		case <-received:
+		case <-h.closed:
+			return
+		case <-h.c.closedCh:
+			return
+		}
+	}
+}
+
+// update resolves the instance off the cache, moving the host pins to the
+// current SRV target and letting Changes know if the address is different
+func (h *InstanceHandle) update() {
+	h.c.lock.Lock()
+	entry, _ := h.c.resolveEntry(h.service, h.name, h.c.Clock.Now())
+	h.c.lock.Unlock()
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	select {
+	case <-h.closed:
+		return
+	default:
+	}
+	if entry.Host != "" && !strings.EqualFold(entry.Host, h.host) {
+		h.c.hold(hostKeys(entry.Host)...)
+		if h.host != "" {
+			h.c.release(hostKeys(h.host)...)
+		}
+		h.host = entry.Host
+	}
+	if len(entry.IPs) == 0 {
+		return
+	}
+
+	var addr net.Addr = &net.TCPAddr{IP: entry.IPs[0], Port: int(entry.Port)}
+	if h.network == "udp" {
+		addr = &net.UDPAddr{IP: entry.IPs[0], Port: int(entry.Port)}
+	}
+	if h.addr != nil && h.addr.String() == addr.String() {
+		return
+	}
+	h.addr = addr
+	select {
+	case h.changes <- struct{}{}:
+	default:
+	}
+}
+
+// hostKeys returns the pin keys of the address records of the given host
+func hostKeys(host string) []string {
+	return []string{pinKey(host, dns.TypeA), pinKey(host, dns.TypeAAAA)}
+}
@@ -0,0 +1,68 @@
+package mdns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/epiclabs-io/ut"
+	"github.com/miekg/dns"
+	"github.com/tilinna/clock"
+)
+
+func TestWatch(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	mt := newMockTransport()
+
+	c, err := New(&Config{
+		Clock:     clk,
+		Transport: mt,
+	})
+	t.Ok(err)
+	defer c.Close()
+
+	_, err = c.Watch("local.", "epic")
+	t.MustFail(err, "Expected a name without service type to be rejected")
+
+	h, err := c.Watch("_service1._tcp.local", "epic")
+	t.Ok(err)
+	t.Equals(nil, h.Addr())
+
+	// the instance is resolved in the background
+	msg := <-mt.out
+	t.Equals("epic._service1._tcp.local.", msg.Question[0].Name)
+	response := new(dns.Msg)
+	response.Response = true
+	response.Answer = parseRecords(t, `
+	epic._service1._tcp.local.	230	IN	SRV		10 0 7979 praetor.local.
+	epic._service1._tcp.local.	240	IN	TXT		"some text"
+	praetor.local.			120	IN	A		10.20.30.40
+	`)
+	mt.in <- &Packet{Msg: response}
+	<-h.Changes()
+	t.Equals("10.20.30.40:7979", h.Addr().String())
+
+	// a preferred SRV record moves the handle to another host
+	response.Answer = parseRecords(t, `
+	epic._service1._tcp.local.	230	IN	SRV		0 0 8080 backup.local.
+	backup.local.			120	IN	A		10.20.30.50
+	`)
+	mt.in <- &Packet{Msg: response}
+	<-h.Changes()
+	t.Equals("10.20.30.50:8080", h.Addr().String())
+
+	c.lock.RLock()
+	t.Equals(4, len(c.holds))
+	t.Equals(1, c.holds[pinKey("backup.local.", dns.TypeA)])
+	t.Equals(0, c.holds[pinKey("praetor.local.", dns.TypeA)])
+	c.lock.RUnlock()
+
+	// closing the handle releases its pins
+	h.Close()
+	h.Close()
+	c.lock.RLock()
+	t.Equals(0, len(c.holds))
+	c.lock.RUnlock()
+}